@@ -0,0 +1,267 @@
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/golang-io/mqtt/topic"
+)
+
+// Access 主题访问类型
+type Access uint8
+
+const (
+	// AccessPublish 向主题发布消息
+	AccessPublish Access = 1 << iota
+
+	// AccessSubscribe 订阅主题过滤器
+	AccessSubscribe
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessPublish:
+		return "publish"
+	case AccessSubscribe:
+		return "subscribe"
+	case AccessPublish | AccessSubscribe:
+		return "readwrite"
+	default:
+		return "none"
+	}
+}
+
+// ClientInfo 已认证客户端的信息
+type ClientInfo struct {
+	ClientID string
+	Username string
+	ConnInfo
+}
+
+// Authorizer 主题级别的访问控制
+//
+// MQTT v3.1.1: 参考章节 5.4.2 Authorization of Clients by the Server
+// MQTT v5.0: 参考章节 5.4.2 Authorization of Clients by the Server
+// - 发布: topicName为PUBLISH报文的主题名. 拒绝时v5.0返回原因码0x87, v3.1.1丢弃消息但仍然正常确认
+// - 订阅: topicName为SUBSCRIBE报文的主题过滤器. 拒绝时v5.0返回原因码0x87, v3.1.1返回0x80
+type Authorizer interface {
+	Authorize(client ClientInfo, access Access, topicName string) bool
+}
+
+// The AuthorizerFunc type is an adapter to allow the use of
+// ordinary functions as authorizers.
+type AuthorizerFunc func(client ClientInfo, access Access, topicName string) bool
+
+func (f AuthorizerFunc) Authorize(client ClientInfo, access Access, topicName string) bool {
+	return f(client, access, topicName)
+}
+
+// aclRule ACL文件中的一条规则
+type aclRule struct {
+	access  Access
+	deny    bool
+	filter  string
+	pattern bool // 为true时filter中的%u和%c会被替换为用户名和ClientID
+}
+
+// ACL 基于文件的访问控制列表, 默认拒绝所有访问
+//
+// 文件格式与mosquitto的acl_file类似, 每行一条指令, 空行和以'#'开头的行会被忽略:
+//
+//	topic [read|write|readwrite|deny] <filter>    对当前段落的客户端生效
+//	pattern [read|write|readwrite|deny] <filter>  对所有客户端生效, %u替换为用户名, %c替换为ClientID
+//	user <username>                               之后的topic规则只对该用户名生效
+//	client <clientId>                             之后的topic规则只对该ClientID生效
+//
+// 出现在第一个user/client之前的topic规则对所有客户端生效. 省略访问类型时为readwrite.
+// read对应订阅, write对应发布; deny规则优先于其他规则, 订阅的主题过滤器与deny规则可能匹配同一个主题名时拒绝订阅.
+// 订阅时要求规则的过滤器完整覆盖订阅的主题过滤器, 例如规则 a/# 允许订阅 a/+/b, 但规则 a/+ 不允许订阅 a/#.
+type ACL struct {
+	global  []aclRule
+	users   map[string][]aclRule
+	clients map[string][]aclRule
+}
+
+// LoadACLFile 从文件加载ACL
+func LoadACLFile(name string) (*ACL, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// ParseACL 解析ACL文件内容
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{users: make(map[string][]aclRule), clients: make(map[string][]aclRule)}
+	var section map[string][]aclRule // nil表示全局段落
+	var name string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "user", "client":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("acl: line %d: expected %s <name>", line, fields[0])
+			}
+			section, name = acl.users, fields[1]
+			if fields[0] == "client" {
+				section = acl.clients
+			}
+		case "topic", "pattern":
+			rule, err := parseACLRule(fields)
+			if err != nil {
+				return nil, fmt.Errorf("acl: line %d: %w", line, err)
+			}
+			if rule.pattern || section == nil {
+				acl.global = append(acl.global, rule)
+			} else {
+				section[name] = append(section[name], rule)
+			}
+		default:
+			return nil, fmt.Errorf("acl: line %d: unknown directive %q", line, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func parseACLRule(fields []string) (aclRule, error) {
+	rule := aclRule{access: AccessPublish | AccessSubscribe, pattern: fields[0] == "pattern"}
+	switch len(fields) {
+	case 2:
+		rule.filter = fields[1]
+	case 3:
+		switch fields[1] {
+		case "read":
+			rule.access = AccessSubscribe
+		case "write":
+			rule.access = AccessPublish
+		case "readwrite":
+		case "deny":
+			rule.deny = true
+		default:
+			return rule, fmt.Errorf("unknown access %q", fields[1])
+		}
+		rule.filter = fields[2]
+	default:
+		return rule, fmt.Errorf("expected %s [access] <filter>", fields[0])
+	}
+	return rule, nil
+}
+
+func (acl *ACL) Authorize(client ClientInfo, access Access, topicName string) bool {
+	allowed := false
+	for _, rules := range [][]aclRule{acl.global, acl.users[client.Username], acl.clients[client.ClientID]} {
+		for _, rule := range rules {
+			filter, ok := rule.expand(client)
+			if !ok {
+				continue
+			}
+			if rule.deny {
+				if denied(filter, access, topicName) {
+					return false
+				}
+				continue
+			}
+			if rule.access&access != 0 && granted(filter, access, topicName) {
+				allowed = true
+			}
+		}
+	}
+	return allowed
+}
+
+// expand 替换pattern规则中的%u和%c. 用户名或ClientID为空, 或者包含通配符和层级分隔符时规则不生效,
+// 防止客户端通过构造ClientID(例如"#")获得额外的权限
+func (rule aclRule) expand(client ClientInfo) (string, bool) {
+	if !rule.pattern {
+		return rule.filter, true
+	}
+	for placeholder, value := range map[string]string{"%u": client.Username, "%c": client.ClientID} {
+		if strings.Contains(rule.filter, placeholder) && (value == "" || strings.ContainsAny(value, "+#/")) {
+			return "", false
+		}
+	}
+	return strings.NewReplacer("%u", client.Username, "%c", client.ClientID).Replace(rule.filter), true
+}
+
+// granted 发布时判断主题名是否匹配规则, 订阅时判断规则是否完整覆盖订阅的主题过滤器
+func granted(filter string, access Access, topicName string) bool {
+	if access == AccessSubscribe {
+		return covers(filter, topicName)
+	}
+	return topic.Match(filter, topicName)
+}
+
+// denied 发布时判断主题名是否匹配deny规则, 订阅时只要订阅的主题过滤器与deny规则可能匹配同一个主题名就拒绝
+func denied(filter string, access Access, topicName string) bool {
+	if access == AccessSubscribe {
+		return overlaps(filter, topicName)
+	}
+	return topic.Match(filter, topicName)
+}
+
+// covers 判断主题过滤器filter是否覆盖sub, 即所有匹配sub的主题名也都匹配filter
+func covers(filter, sub string) bool {
+	// 以通配符开头的过滤器不匹配以'$'开头的主题名 [MQTT-4.7.2-1]
+	if strings.HasPrefix(sub, "$") && wildcardPrefix(filter) {
+		return false
+	}
+	filters, subs := strings.Split(filter, "/"), strings.Split(sub, "/")
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i >= len(subs) {
+			return false
+		}
+		switch s := subs[i]; {
+		case s == "#":
+			return false
+		case f == "+":
+		case f != s:
+			return false
+		}
+	}
+	return len(filters) == len(subs)
+}
+
+// overlaps 判断两个主题过滤器是否存在同时匹配的主题名
+func overlaps(a, b string) bool {
+	if strings.HasPrefix(a, "$") && wildcardPrefix(b) || strings.HasPrefix(b, "$") && wildcardPrefix(a) {
+		return false
+	}
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	n := min(len(as), len(bs))
+	for i := 0; i < n; i++ {
+		if as[i] == "#" || bs[i] == "#" {
+			return true
+		}
+		if as[i] != "+" && bs[i] != "+" && as[i] != bs[i] {
+			return false
+		}
+	}
+	if len(as) == len(bs) {
+		return true
+	}
+	// "a/#" 同样匹配父层级 "a"
+	longer := as
+	if len(bs) > len(as) {
+		longer = bs
+	}
+	return len(longer) == n+1 && longer[n] == "#"
+}
+
+func wildcardPrefix(filter string) bool {
+	return strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")
+}
@@ -0,0 +1,164 @@
+package mqtt
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+const testACL = `
+# 所有客户端
+topic read public/#
+pattern readwrite devices/%c/#
+pattern read users/%u/inbox
+
+user alice
+topic readwrite sensors/#
+topic deny sensors/secret
+
+client bridge-1
+topic write bridge/#
+`
+
+func TestACLAuthorize(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := ClientInfo{ClientID: "c1", Username: "alice"}
+	bob := ClientInfo{ClientID: "c2", Username: "bob"}
+	bridge := ClientInfo{ClientID: "bridge-1"}
+
+	testCases := []struct {
+		name   string
+		client ClientInfo
+		access Access
+		topic  string
+		want   bool
+	}{
+		{"GlobalRead", bob, AccessSubscribe, "public/news", true},
+		{"GlobalReadWildcard", bob, AccessSubscribe, "public/+/x", true},
+		{"GlobalNoWrite", bob, AccessPublish, "public/news", false},
+		{"NotCovered", bob, AccessSubscribe, "#", false},
+		{"PatternClientID", bob, AccessPublish, "devices/c2/status", true},
+		{"PatternOtherClientID", bob, AccessPublish, "devices/c1/status", false},
+		{"PatternUsername", alice, AccessSubscribe, "users/alice/inbox", true},
+		{"PatternUsernameWrite", alice, AccessPublish, "users/alice/inbox", false},
+		{"PatternEmptyUsername", bridge, AccessSubscribe, "users//inbox", false},
+		{"UserSection", alice, AccessPublish, "sensors/temp", true},
+		{"UserSectionOtherUser", bob, AccessPublish, "sensors/temp", false},
+		{"DenyPublish", alice, AccessPublish, "sensors/secret", false},
+		{"DenySubscribeOverlap", alice, AccessSubscribe, "sensors/#", false},
+		{"DenyNoOverlap", alice, AccessSubscribe, "sensors/+/x", true},
+		{"ClientSection", bridge, AccessPublish, "bridge/a/b", true},
+		{"ClientSectionRead", bridge, AccessSubscribe, "bridge/a/b", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := acl.Authorize(tc.client, tc.access, tc.topic); got != tc.want {
+				t.Errorf("Authorize(%+v, %s, %s) = %v, want %v", tc.client, tc.access, tc.topic, got, tc.want)
+			}
+		})
+	}
+
+	// ClientID中的通配符不能扩大pattern规则的权限
+	evil := ClientInfo{ClientID: "#"}
+	if acl.Authorize(evil, AccessSubscribe, "devices/#") {
+		t.Error("wildcard ClientID should not match pattern rules")
+	}
+}
+
+func TestParseACLErrors(t *testing.T) {
+	for _, bad := range []string{"topic", "topic execute a/b", "user", "group admin"} {
+		if _, err := ParseACL(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseACL(%q) should fail", bad)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	testCases := []struct {
+		filter, sub string
+		want        bool
+	}{
+		{"a/#", "a", true},
+		{"a/#", "a/+/c", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/#", false},
+		{"a/b", "a/+", false},
+		{"#", "$SYS/x", false},
+		{"$SYS/#", "$SYS/x", true},
+	}
+	for _, tc := range testCases {
+		if got := covers(tc.filter, tc.sub); got != tc.want {
+			t.Errorf("covers(%s, %s) = %v, want %v", tc.filter, tc.sub, got, tc.want)
+		}
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	testCases := []struct {
+		a, b string
+		want bool
+	}{
+		{"a/b", "a/+", true},
+		{"a/#", "a", true},
+		{"a/b", "a/c", false},
+		{"a/+/c", "a/b/d", false},
+		{"+/b", "a/#", true},
+		{"a/b/c", "a", false},
+		{"#", "$SYS/x", false},
+	}
+	for _, tc := range testCases {
+		if got := overlaps(tc.a, tc.b); got != tc.want {
+			t.Errorf("overlaps(%s, %s) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestServerAuthorizer(t *testing.T) {
+	s := NewServer(context.Background())
+	s.Authorizer = AuthorizerFunc(func(client ClientInfo, access Access, topicName string) bool {
+		return !strings.HasPrefix(topicName, "private")
+	})
+
+	rw, _ := connectTestServer(t, s, &packet.CONNECT{ClientID: "v3"})
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION311, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{TopicFilter: "private/#"}, {TopicFilter: "public/#"}},
+	})
+	suback, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.SUBACK)
+	if !ok || len(suback.ReasonCode) != 2 {
+		t.Fatalf("expected SUBACK with 2 reason codes, got %v", suback)
+	}
+	if suback.ReasonCode[0].Code != 0x80 || suback.ReasonCode[1].Code != 0x00 {
+		t.Errorf("SUBACK = %v, want [0x80 0x00]", suback.ReasonCode)
+	}
+
+	// v3.1.1的未授权发布被正常确认, 但不会被转发
+	writeTestPacket(t, rw, &packet.PUBLISH{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBLISH, QoS: 1},
+		PacketID:    2,
+		Message:     &packet.Message{TopicName: "private/x", Content: []byte("x")},
+	})
+	if _, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBACK); !ok {
+		t.Fatal("expected PUBACK")
+	}
+	if len(s.memorySubscribed.trie().Match("private/x")) != 0 {
+		t.Error("unauthorized subscription should not be routed")
+	}
+
+	v5, _ := connectTestServer(t, s, &packet.CONNECT{FixedHeader: &packet.FixedHeader{Version: packet.VERSION500}, ClientID: "v5"})
+	writeTestPacket(t, v5, &packet.PUBLISH{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION500, Kind: PUBLISH, QoS: 1},
+		PacketID:    1,
+		Message:     &packet.Message{TopicName: "private/x", Content: []byte("x")},
+	})
+	puback, ok := readTestPacket(t, v5, packet.VERSION500).(*packet.PUBACK)
+	if !ok || puback.ReasonCode.Code != packet.ErrNotAuthorized.Code {
+		t.Fatalf("PUBACK = %v, want reason 0x87", puback)
+	}
+}
@@ -0,0 +1,100 @@
+package mqtt
+
+import (
+	"sync"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+// topicAliases 发送方向的主题别名映射, 只在单个网络连接内有效
+//
+// MQTT v5.0: 参考章节 3.3.2.3.4 Topic Alias
+// - 发送方不能发送0或者大于接收方声明的主题别名最大值的别名 [MQTT-3.1.2-26] [MQTT-3.2.2-17]
+// - 第一次使用别名时同时发送主题名和别名建立映射, 之后发送长度为0的主题名和别名
+// - 新的网络连接开始时, 别名映射全部失效 [MQTT-3.3.2-7]
+type topicAliases struct {
+	mu      sync.Mutex
+	max     uint16            // 接收方的主题别名最大值, 0表示不使用别名
+	hot     map[string]bool   // 只为这些主题名分配别名, nil表示按发送顺序为所有主题名分配
+	aliases map[string]uint16 // 主题名: 主题别名
+}
+
+// reset 在新的网络连接上重新开始分配别名
+func (a *topicAliases) reset(max uint16, hot []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.max, a.hot, a.aliases = max, nil, make(map[string]uint16)
+	if len(hot) > 0 {
+		a.hot = make(map[string]bool, len(hot))
+		for _, name := range hot {
+			a.hot[name] = true
+		}
+	}
+}
+
+// send 为报文设置主题别名后调用write发送. 分配别名和写出报文在同一个锁内完成,
+// 保证建立映射的报文先于只使用别名的报文到达接收方
+func (a *topicAliases) send(pub *packet.PUBLISH, write func(*packet.PUBLISH) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return write(a.apply(pub))
+}
+
+// apply 返回设置了主题别名的报文副本, 不修改原报文; 别名已经用完或者不需要别名时返回原报文
+func (a *topicAliases) apply(pub *packet.PUBLISH) *packet.PUBLISH {
+	if a.max == 0 || pub.Version != packet.VERSION500 {
+		return pub
+	}
+	name := pub.Message.TopicName
+	alias, established := a.aliases[name]
+	if !established {
+		if len(a.aliases) >= int(a.max) || a.hot != nil && !a.hot[name] {
+			return pub
+		}
+		alias = uint16(len(a.aliases) + 1)
+		a.aliases[name] = alias
+	}
+	out := *pub
+	props := packet.PublishProperties{}
+	if pub.Props != nil {
+		props = *pub.Props
+	}
+	props.TopicAlias = packet.TopicAlias(alias)
+	out.Props = &props
+	if established {
+		message := *pub.Message
+		message.TopicName = ""
+		out.Message = &message
+	}
+	return &out
+}
+
+// resolveTopicAlias 解析客户端PUBLISH报文中的主题别名, 将报文的主题名替换为别名映射的主题名
+//
+// MQTT v5.0: 参考章节 3.3.2.3.4 Topic Alias
+// - 别名为0或者大于服务端在CONNACK中声明的主题别名最大值时, 使用原因码0x94断开连接 [MQTT-3.3.2-9] [MQTT-3.3.2-10]
+// - 主题名长度为0且别名没有映射时是协议错误, 使用原因码0x82断开连接
+//
+// 返回原因码为0表示解析成功
+func (c *conn) resolveTopicAlias(pub *packet.PUBLISH) packet.ReasonCode {
+	if pub.Props == nil || pub.Props.TopicAlias == 0 {
+		return packet.CodeSuccess
+	}
+	alias := pub.Props.TopicAlias.Uint16()
+	if alias > c.server.TopicAliasMaximum {
+		return packet.ErrTopicAliasInvalid
+	}
+	if pub.Message.TopicName != "" {
+		if c.inAliases == nil {
+			c.inAliases = make(map[uint16]string)
+		}
+		c.inAliases[alias] = pub.Message.TopicName
+	} else if name, ok := c.inAliases[alias]; ok {
+		pub.Message.TopicName = name
+	} else {
+		return packet.ErrProtocolErr
+	}
+	// 别名只对当前网络连接有效, 转发给订阅者之前移除
+	pub.Props.TopicAlias = 0
+	return packet.CodeSuccess
+}
@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+func TestTopicAliasesApply(t *testing.T) {
+	var a topicAliases
+	a.reset(1, nil)
+
+	pubs := map[string]*packet.PUBLISH{}
+	for _, topicName := range []string{"a/b", "c/d", "cold", "hot"} {
+		pubs[topicName] = newTestPublish(topicName, "", 0)
+		pubs[topicName].Version = packet.VERSION500
+	}
+
+	first := a.apply(pubs["a/b"])
+	if first.Message.TopicName != "a/b" || first.Props.TopicAlias != 1 {
+		t.Fatalf("first = %s alias %d, want a/b alias 1", first.Message.TopicName, first.Props.TopicAlias)
+	}
+	pub := pubs["a/b"]
+	second := a.apply(pub)
+	if second.Message.TopicName != "" || second.Props.TopicAlias != 1 {
+		t.Fatalf("second = %q alias %d, want empty topic alias 1", second.Message.TopicName, second.Props.TopicAlias)
+	}
+	if pub.Message.TopicName != "a/b" || pub.Props != nil {
+		t.Fatal("apply modified the original packet")
+	}
+	// 别名已经用完
+	if other := a.apply(pubs["c/d"]); other.Props != nil {
+		t.Fatalf("c/d got alias %d beyond the maximum", other.Props.TopicAlias)
+	}
+
+	a.reset(2, []string{"hot"})
+	if cold := a.apply(pubs["cold"]); cold.Props != nil {
+		t.Fatal("alias assigned to a topic that is not hot")
+	}
+	if hot := a.apply(pubs["hot"]); hot.Props == nil || hot.Props.TopicAlias != 1 {
+		t.Fatal("expected alias 1 for the hot topic")
+	}
+}
+
+func TestInboundTopicAlias(t *testing.T) {
+	s := NewServer(context.Background())
+	s.TopicAliasMaximum = 2
+	sub, _ := subscribeTestServer(t, s, "sub", packet.Subscription{TopicFilter: "a/b"})
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader:  &packet.FixedHeader{Version: packet.VERSION500},
+		ConnectFlags: packet.ConnectFlags(0x02),
+		ClientID:     "pub",
+		Props:        &packet.ConnectProperties{},
+	})
+	if connack.Props.TopicAliasMaximum != 2 {
+		t.Fatalf("CONNACK TopicAliasMaximum = %d, want 2", connack.Props.TopicAliasMaximum)
+	}
+
+	for _, topicName := range []string{"a/b", ""} {
+		pub := newTestPublish(topicName, "", 0)
+		pub.Version = packet.VERSION500
+		pub.Props = &packet.PublishProperties{TopicAlias: 1}
+		writeTestPacket(t, rw, pub)
+		got, ok := readTestPacket(t, sub, packet.VERSION311).(*packet.PUBLISH)
+		if !ok || got.Message.TopicName != "a/b" {
+			t.Fatalf("expected PUBLISH on a/b, got %v", got)
+		}
+	}
+
+	pub := newTestPublish("a/b", "", 0)
+	pub.Version = packet.VERSION500
+	pub.Props = &packet.PublishProperties{TopicAlias: 3}
+	writeTestPacket(t, rw, pub)
+	disconnect, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.DISCONNECT)
+	if !ok || disconnect.ReasonCode.Code != packet.ErrTopicAliasInvalid.Code {
+		t.Fatalf("expected DISCONNECT 0x94, got %v", disconnect)
+	}
+}
+
+func TestInboundTopicAliasUnknown(t *testing.T) {
+	s := NewServer(context.Background())
+	s.TopicAliasMaximum = 2
+	rw := connectTestServer5(t, s, &packet.CONNECT{ClientID: "pub"})
+
+	pub := newTestPublish("", "", 0)
+	pub.Version = packet.VERSION500
+	pub.Props = &packet.PublishProperties{TopicAlias: 1}
+	writeTestPacket(t, rw, pub)
+	disconnect, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.DISCONNECT)
+	if !ok || disconnect.ReasonCode.Code != packet.ErrProtocolErr.Code {
+		t.Fatalf("expected DISCONNECT 0x82, got %v", disconnect)
+	}
+}
+
+func TestOutboundTopicAlias(t *testing.T) {
+	s := NewServer(context.Background())
+	rw := connectTestServer5(t, s, &packet.CONNECT{ClientID: "sub", Props: &packet.ConnectProperties{TopicAliasMaximum: 1}},
+		packet.Subscription{TopicFilter: "a/b"})
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			_ = s.publish(&packet.PUBLISH{FixedHeader: &packet.FixedHeader{Kind: PUBLISH}, Message: &packet.Message{TopicName: "a/b"}})
+		}
+	}()
+	for _, want := range []string{"a/b", ""} {
+		got, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.PUBLISH)
+		if !ok || got.Message.TopicName != want || got.Props.TopicAlias != 1 {
+			t.Fatalf("expected PUBLISH %q with alias 1, got %v", want, got)
+		}
+	}
+}
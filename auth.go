@@ -0,0 +1,311 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/golang-io/mqtt/packet"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ConnInfo 认证时可用的网络连接信息
+type ConnInfo struct {
+	// RemoteAddr 客户端的网络地址
+	RemoteAddr string
+
+	// TLSState TLS连接状态, 非TLS连接时为nil.
+	// 可以通过 TLSState.PeerCertificates 实现基于客户端证书的认证.
+	TLSState *tls.ConnectionState
+}
+
+// Authenticator 客户端连接认证
+//
+// MQTT v3.1.1: 参考章节 3.1.3.4 User Name, 3.1.3.5 Password, 5.4.1 Authentication of Clients by the Server
+// MQTT v5.0: 参考章节 3.1.3.5 User Name, 3.1.3.6 Password, 5.4.1 Authentication of Clients by the Server
+//
+// Authenticate 返回 packet.CodeSuccess 表示认证通过, 否则返回v5.0的CONNACK原因码,
+// 例如 packet.ErrBadUsernameOrPassword(0x86), packet.ErrNotAuthorized(0x87), packet.ErrBanned(0x8A).
+// v3.1.1的客户端会收到对应的v3.1.1返回码, 见 connackReturnCode.
+type Authenticator interface {
+	Authenticate(connect *packet.CONNECT, info ConnInfo) packet.ReasonCode
+}
+
+// The AuthenticatorFunc type is an adapter to allow the use of
+// ordinary functions as authenticators.
+type AuthenticatorFunc func(connect *packet.CONNECT, info ConnInfo) packet.ReasonCode
+
+func (f AuthenticatorFunc) Authenticate(connect *packet.CONNECT, info ConnInfo) packet.ReasonCode {
+	return f(connect, info)
+}
+
+// AuthMechanism v5.0扩展认证机制, 类似SASL
+//
+// MQTT v5.0: 参考章节 4.12 Enhanced authentication
+// - CONNECT中的认证方法(AuthenticationMethod)选择认证机制
+// - 服务端和客户端通过AUTH报文(原因码0x18)交换认证数据, 直到服务端认证通过后发送CONNACK
+// - 连接建立后客户端可以发送原因码为0x19的AUTH报文重新认证, 必须使用相同的认证方法 [MQTT-4.12.1-1]
+type AuthMechanism interface {
+	// Method 认证方法名, 例如 "SCRAM-SHA-256"
+	Method() string
+
+	// Start 开始一次认证交换, 每次认证(包括重新认证)调用一次
+	Start(client ClientInfo) AuthExchange
+}
+
+// AuthExchange 一次扩展认证的交换过程
+type AuthExchange interface {
+	// Next 处理客户端发送的认证数据, 返回发送给客户端的认证数据以及认证是否完成.
+	// 返回error时认证失败; error为 packet.ReasonCode 时使用该原因码, 否则使用0x87(Not authorized).
+	Next(data []byte) (resp []byte, done bool, err error)
+
+	// Username 认证通过的用户名, 用于访问控制; 为空时使用CONNECT中的用户名
+	Username() string
+}
+
+// authFailureCode 扩展认证失败时使用的原因码
+func authFailureCode(err error) packet.ReasonCode {
+	var code packet.ReasonCode
+	if errors.As(err, &code) && code.Code >= 0x80 {
+		return code
+	}
+	return packet.ErrNotAuthorized
+}
+
+// StaticAuthenticator 基于内存中 用户名:明文密码 映射的认证
+type StaticAuthenticator map[string]string
+
+func (m StaticAuthenticator) Authenticate(connect *packet.CONNECT, _ ConnInfo) packet.ReasonCode {
+	password, ok := m[connect.Username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(connect.Password)) != 1 {
+		return packet.ErrBadUsernameOrPassword
+	}
+	return packet.CodeSuccess
+}
+
+// ChainAuthenticator 依次尝试多个认证器, 任意一个认证通过即认证通过;
+// 全部失败时返回最后一个认证器的原因码
+type ChainAuthenticator []Authenticator
+
+func (chain ChainAuthenticator) Authenticate(connect *packet.CONNECT, info ConnInfo) packet.ReasonCode {
+	code := packet.ErrBadUsernameOrPassword
+	for _, auth := range chain {
+		if code = auth.Authenticate(connect, info); code.Code == 0 {
+			return code
+		}
+	}
+	return code
+}
+
+// PasswordFile 基于密码文件的认证, 文件中保存的是密码的哈希值而不是明文
+//
+// 文件格式为每行一个 username:hash, 空行和以'#'开头的行会被忽略. 支持的哈希格式:
+//   - bcrypt: $2a$, $2b$, $2y$
+//   - argon2: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>, 同样支持 $argon2i$, salt和hash为不带填充的base64编码
+type PasswordFile struct {
+	users map[string]string // username: hash
+}
+
+// LoadPasswordFile 从文件加载密码
+func LoadPasswordFile(name string) (*PasswordFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePasswordFile(f)
+}
+
+// ParsePasswordFile 解析密码文件内容
+func ParsePasswordFile(r io.Reader) (*PasswordFile, error) {
+	p := &PasswordFile{users: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || hash == "" {
+			return nil, fmt.Errorf("password file: line %d: expected username:hash", line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$argon2") {
+			return nil, fmt.Errorf("password file: line %d: unsupported hash for user %q", line, username)
+		}
+		p.users[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PasswordFile) Authenticate(connect *packet.CONNECT, _ ConnInfo) packet.ReasonCode {
+	hash, ok := p.users[connect.Username]
+	if !ok || !comparePassword(hash, connect.Password) {
+		return packet.ErrBadUsernameOrPassword
+	}
+	return packet.CodeSuccess
+}
+
+// comparePassword 校验明文密码与哈希值是否匹配
+func comparePassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2") {
+		return compareArgon2(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// compareArgon2 校验PHC格式的argon2哈希: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func compareArgon2(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+	var got []byte
+	switch parts[1] {
+	case "argon2id":
+		got = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	case "argon2i":
+		got = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// connackReturnCode 将v5.0的CONNACK原因码转换为客户端协议版本对应的返回码
+//
+// MQTT v3.1.1: 参考章节 3.2.2.3 Connect Return code
+// MQTT v5.0: 参考章节 3.2.2.2 Connect Reason Code
+func connackReturnCode(version byte, code packet.ReasonCode) packet.ReasonCode {
+	if version == packet.VERSION500 || code.Code < 0x80 {
+		return code
+	}
+	switch code.Code {
+	case packet.ErrUnsupportedProtocolVersion.Code:
+		return packet.Err3UnsupportedProtocolVersion
+	case packet.ErrClientIdentifierNotValid.Code:
+		return packet.Err3ClientIdentifierNotValid
+	case packet.ErrServerUnavailable.Code, packet.ErrServerBusy.Code:
+		return packet.Err3ServerUnavailable
+	case packet.ErrBadUsernameOrPassword.Code:
+		return packet.ErrMalformedUsernameOrPassword
+	default:
+		return packet.Err3NotAuthorized
+	}
+}
+
+// startAuth 使用CONNECT中的认证方法开始扩展认证
+func (c *conn) startAuth(w ResponseWriter, connect *packet.CONNECT) {
+	method := string(connect.Props.AuthenticationMethod)
+	mech := c.server.authMechanism(method)
+	if mech == nil {
+		log.Printf("unsupported authentication method: clientId=%s, reomte=%s, method=%s", c.ID, c.remoteAddr, method)
+		c.finishConnect(w, connect, packet.ErrBadAuthenticationMethod, nil)
+		return
+	}
+	c.authMethod, c.authConnect = method, connect
+	c.authExchange = mech.Start(ClientInfo{ClientID: c.ID, Username: connect.Username, ConnInfo: ConnInfo{RemoteAddr: c.remoteAddr, TLSState: c.tlsState}})
+	c.stepAuth(w, connect.Props.AuthenticationData)
+}
+
+// continueAuth 处理客户端发送的AUTH报文
+//
+// MQTT v5.0: 参考章节 3.15 AUTH, 4.12 Enhanced authentication
+// - 0x18: 继续进行中的认证交换
+// - 0x19: 连接建立后发起重新认证 [MQTT-4.12.1-1]
+// - 认证方法必须与CONNECT中的认证方法相同, 否则是协议错误 [MQTT-4.12.0-5]
+func (c *conn) continueAuth(w ResponseWriter, auth *packet.AUTH) {
+	var method string
+	var data []byte
+	if auth.Props != nil {
+		method, data = string(auth.Props.AuthenticationMethod), auth.Props.AuthenticationData
+	}
+	valid := c.version == packet.VERSION500 && c.authMethod != "" && method == c.authMethod
+	switch auth.ReasonCode.Code {
+	case packet.CodeContinueAuthentication.Code:
+		valid = valid && c.authExchange != nil
+	case packet.CodeReAuthenticate.Code:
+		// 重新认证只能在CONNACK之后发起, 并且不能与进行中的认证交换重叠
+		valid = valid && c.authConnect == nil && c.authExchange == nil
+		if valid {
+			c.authExchange = c.server.authMechanism(method).Start(ClientInfo{ClientID: c.ID, Username: c.username, ConnInfo: ConnInfo{RemoteAddr: c.remoteAddr, TLSState: c.tlsState}})
+		}
+	default:
+		valid = false
+	}
+	if !valid {
+		c.failAuth(w, packet.ErrProtocolErr)
+		return
+	}
+	c.stepAuth(w, data)
+}
+
+// stepAuth 将客户端的认证数据交给认证机制处理, 根据结果继续交换认证数据或者结束认证
+func (c *conn) stepAuth(w ResponseWriter, data []byte) {
+	resp, done, err := c.authExchange.Next(data)
+	if err != nil {
+		log.Printf("enhanced auth failed: clientId=%s, reomte=%s, method=%s, err=%v", c.ID, c.remoteAddr, c.authMethod, err)
+		c.failAuth(w, authFailureCode(err))
+		return
+	}
+	if !done {
+		c.sendAuth(w, packet.CodeContinueAuthentication, resp)
+		return
+	}
+	if c.authConnect != nil {
+		c.finishConnect(w, c.authConnect, packet.CodeSuccess, resp)
+		return
+	}
+	// 重新认证成功: 服务端发送原因码为0x00的AUTH报文
+	if username := c.authExchange.Username(); username != "" {
+		c.username = username
+	}
+	c.authExchange = nil
+	log.Printf("client re-auth ok: clientId=%s, username=%s, reomte=%s", c.ID, c.username, c.remoteAddr)
+	c.sendAuth(w, packet.CodeSuccess, resp)
+}
+
+// failAuth 认证失败: CONNACK之前回复带有原因码的CONNACK, 重新认证时发送DISCONNECT, 然后关闭网络连接 [MQTT-4.12.0-2] [MQTT-4.12.1-2]
+func (c *conn) failAuth(w ResponseWriter, code packet.ReasonCode) {
+	if c.authConnect != nil {
+		c.finishConnect(w, c.authConnect, code, nil)
+		return
+	}
+	c.abort(code)
+}
+
+func (c *conn) sendAuth(w ResponseWriter, code packet.ReasonCode, data []byte) {
+	auth := packet.NewAUTH(c.version, code)
+	auth.Props.AuthenticationMethod = packet.AuthenticationMethod(c.authMethod)
+	auth.Props.AuthenticationData = data
+	if err := w.OnSend(auth); err != nil {
+		log.Printf("mqtt-onSend: err=%v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang-io/mqtt/packet"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestStaticAuthenticator(t *testing.T) {
+	auth := StaticAuthenticator{"root": "admin"}
+	if code := auth.Authenticate(&packet.CONNECT{Username: "root", Password: "admin"}, ConnInfo{}); code.Code != 0 {
+		t.Errorf("valid credentials: code = %v", code)
+	}
+	if code := auth.Authenticate(&packet.CONNECT{Username: "root", Password: "wrong"}, ConnInfo{}); code != packet.ErrBadUsernameOrPassword {
+		t.Errorf("wrong password: code = %v", code)
+	}
+	if code := auth.Authenticate(&packet.CONNECT{Username: "nobody"}, ConnInfo{}); code != packet.ErrBadUsernameOrPassword {
+		t.Errorf("unknown user: code = %v", code)
+	}
+}
+
+func TestChainAuthenticator(t *testing.T) {
+	banned := AuthenticatorFunc(func(connect *packet.CONNECT, _ ConnInfo) packet.ReasonCode {
+		return packet.ErrBanned
+	})
+	chain := ChainAuthenticator{StaticAuthenticator{"a": "1"}, StaticAuthenticator{"b": "2"}, banned}
+	if code := chain.Authenticate(&packet.CONNECT{Username: "b", Password: "2"}, ConnInfo{}); code.Code != 0 {
+		t.Errorf("second authenticator should accept, code = %v", code)
+	}
+	if code := chain.Authenticate(&packet.CONNECT{Username: "c"}, ConnInfo{}); code != packet.ErrBanned {
+		t.Errorf("code = %v, want the last failure", code)
+	}
+	if code := (ChainAuthenticator{}).Authenticate(&packet.CONNECT{}, ConnInfo{}); code.Code == 0 {
+		t.Error("empty chain should reject")
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("secret2"), salt, 1, 64, 1, 32)
+	argon2Hash := fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	file := strings.Join([]string{
+		"# users",
+		"",
+		"alice:" + string(bcryptHash),
+		"bob:" + argon2Hash,
+	}, "\n")
+	passwords, err := ParsePasswordFile(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "secret1", true},
+		{"alice", "secret2", false},
+		{"bob", "secret2", true},
+		{"bob", "secret1", false},
+		{"carol", "", false},
+	}
+	for _, tc := range testCases {
+		code := passwords.Authenticate(&packet.CONNECT{Username: tc.username, Password: tc.password}, ConnInfo{})
+		if (code.Code == 0) != tc.ok {
+			t.Errorf("%s/%s: code = %v, want ok=%v", tc.username, tc.password, code, tc.ok)
+		}
+	}
+
+	for _, bad := range []string{"alice", "alice:plaintext"} {
+		if _, err := ParsePasswordFile(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParsePasswordFile(%q) should fail", bad)
+		}
+	}
+}
+
+func TestConnackReturnCode(t *testing.T) {
+	testCases := []struct {
+		version byte
+		code    packet.ReasonCode
+		want    byte
+	}{
+		{packet.VERSION500, packet.ErrBadUsernameOrPassword, 0x86},
+		{packet.VERSION311, packet.CodeSuccess, 0x00},
+		{packet.VERSION311, packet.ErrBadUsernameOrPassword, 0x04},
+		{packet.VERSION311, packet.ErrNotAuthorized, 0x05},
+		{packet.VERSION311, packet.ErrBanned, 0x05},
+		{packet.VERSION311, packet.ErrClientIdentifierNotValid, 0x02},
+		{packet.VERSION311, packet.ErrServerBusy, 0x03},
+	}
+	for _, tc := range testCases {
+		if got := connackReturnCode(tc.version, tc.code); got.Code != tc.want {
+			t.Errorf("connackReturnCode(%d, %v) = 0x%02X, want 0x%02X", tc.version, tc.code, got.Code, tc.want)
+		}
+	}
+}
+
+func TestServerAuthenticator(t *testing.T) {
+	s := NewServer(context.Background())
+	var info ConnInfo
+	s.Authenticator = AuthenticatorFunc(func(connect *packet.CONNECT, ci ConnInfo) packet.ReasonCode {
+		info = ci
+		return StaticAuthenticator{"user": "pass"}.Authenticate(connect, ci)
+	})
+
+	_, connack := connectTestServer(t, s, &packet.CONNECT{ClientID: "ok", Username: "user", Password: "pass"})
+	if connack.ReturnCode.Code != 0 {
+		t.Fatalf("ReturnCode = %v, want success", connack.ReturnCode)
+	}
+	if info.RemoteAddr != "pipe" || info.TLSState != nil {
+		t.Errorf("ConnInfo = %+v", info)
+	}
+
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{ClientID: "bad", Username: "user", Password: "wrong"})
+	if connack.ReturnCode.Code != packet.ErrMalformedUsernameOrPassword.Code {
+		t.Fatalf("ReturnCode = %v, want 0x04", connack.ReturnCode)
+	}
+	if connack.SessionPresent != 0 {
+		t.Error("SessionPresent must be 0 when the connection is refused")
+	}
+	// 拒绝连接后服务端关闭网络连接
+	if _, err := rw.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection should be closed, err = %v", err)
+	}
+}
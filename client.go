@@ -1,13 +1,16 @@
 package mqtt
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/url"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-io/mqtt/packet"
@@ -78,6 +81,7 @@ type Client struct {
 	options Options
 	recv    [0xF + 1]chan packet.Packet
 	version byte
+	inbound atomic.Int32 // 已收到但还没有确认的QoS1, QoS2消息数量
 	// cancel  context.CancelFunc
 
 	onMessage func(*packet.Message)
@@ -108,6 +112,7 @@ func (c *Client) roundTrip(req packet.Packet) (packet.Packet, error) {
 			return nil, err
 		}
 		c.conn = &conn{rwc: con, remoteAddr: con.RemoteAddr().String()}
+		c.conn.bw = bufio.NewWriter(c.conn)
 	}
 	err := req.Pack(c.conn.rwc)
 	if err != nil {
@@ -179,10 +184,12 @@ func New(opts ...Option) *Client {
 	var err error
 	client := &Client{
 		options: options,
-		conn:    &conn{inFight: newInFight()},
+		conn:    &conn{session: newSession(options.ClientID)},
 		recv:    [0xF + 1]chan packet.Packet{},
-		version: packet.VERSION311,
+		version: options.Version,
 	}
+	// 收到确认后发送等待队列中的消息使用 response.OnSend, 写入时才读取rwc, 连接之后设置rwc即可
+	client.conn.bw = bufio.NewWriter(client.conn)
 
 	for i := 1; i <= 0xF; i++ {
 		client.recv[i] = make(chan packet.Packet, 1)
@@ -223,10 +230,35 @@ func (c *Client) unpack(ctx context.Context) error {
 			log.Printf("[UNPACK_ERROR] Client packet unpack error - ClientID: %s, Error: %v", c.conn.ID, err)
 			return err
 		}
+		if pub, ok := pkt.(*packet.PUBLISH); ok && pub.QoS > 0 && !c.conn.session.inFight.Has(pub.PacketID) {
+			if err = c.receive(); err != nil {
+				return err
+			}
+		}
 		c.recv[pkt.Kind()] <- pkt
 	}
 }
 
+// receive 记录收到的QoS1, QoS2消息, 服务端发送的未确认消息超过客户端的接收最大值时断开连接
+//
+// MQTT v5.0: 参考章节 3.1.2.11.3 Receive Maximum, 4.9 Flow Control
+func (c *Client) receive() error {
+	receiveMaximum := int32(c.options.ReceiveMaximum)
+	if receiveMaximum == 0 {
+		receiveMaximum = math.MaxUint16
+	}
+	if c.inbound.Add(1) <= receiveMaximum || c.version != packet.VERSION500 {
+		return nil
+	}
+	log.Printf("client receive maximum exceeded: client_id=%s, receive_maximum=%d", c.options.ClientID, receiveMaximum)
+	disconnect := packet.NewDISCONNECT(c.version, packet.ErrReceiveMaximum)
+	if err := disconnect.Pack(c.conn.rwc); err != nil {
+		log.Printf("client disconnect send failed: client_id=%s, error=%v", c.options.ClientID, err)
+	}
+	_ = c.conn.rwc.Close()
+	return packet.ErrReceiveMaximum
+}
+
 func (c *Client) Connect(ctx context.Context) error {
 	// 记录连接尝试日志
 	log.Printf("client attempting to connect: client_id=%s, server=%s", c.options.ClientID, c.URL.Host)
@@ -234,7 +266,13 @@ func (c *Client) Connect(ctx context.Context) error {
 	connect := packet.CONNECT{FixedHeader: &packet.FixedHeader{
 		Version: c.version,
 		Kind:    CONNECT,
-	}, ClientID: c.options.ClientID}
+	}, ConnectFlags: packet.ConnectFlags(0x02), ClientID: c.options.ClientID} // CleanStart=1, 客户端不保存会话状态
+	if c.version == packet.VERSION500 {
+		connect.Props = &packet.ConnectProperties{ReceiveMaximum: packet.ReceiveMaximum(c.options.ReceiveMaximum)}
+	}
+	// CleanStart=1: 丢弃上一个网络连接未完成的消息
+	c.conn.session.outFlight.clear()
+	c.inbound.Store(0)
 	if err := connect.Pack(c.conn.rwc); err != nil {
 		log.Printf("client connect packet send failed: client_id=%s, error=%v", c.options.ClientID, err)
 		return err
@@ -259,6 +297,19 @@ func (c *Client) Connect(ctx context.Context) error {
 			log.Printf("client connect failed: client_id=%s, return_code=%v", c.options.ClientID, connack.ReturnCode)
 			return errors.New("mqtt: connect returned non-zero return code")
 		}
+		// 未确认的QoS1, QoS2消息数量不能超过服务端的接收最大值
+		// 主题别名的数量不能超过服务端的主题别名最大值 [MQTT-3.2.2-17]
+		c.conn.outAliases.reset(0, nil)
+		if connack.Props != nil {
+			c.conn.session.outFlight.setReceiveMaximum(connack.Props.ReceiveMaximum.Uint16())
+			if len(c.options.TopicAliases) > 0 {
+				c.conn.outAliases.reset(connack.Props.TopicAliasMaximum.Uint16(), c.options.TopicAliases)
+			}
+			// ClientID为空时使用服务端分配的客户标识符
+			if connack.Props.AssignedClientID != "" {
+				c.conn.ID = string(connack.Props.AssignedClientID)
+			}
+		}
 		log.Printf("client connected successfully: client_id=%s, server=%s", c.options.ClientID, c.URL.Host)
 	}
 	return nil
@@ -331,19 +382,26 @@ func (c *Client) SubmitMessage(message *packet.Message) error {
 	// 记录发布消息日志
 	log.Printf("client publish: client_id=%s, topic=%s, size=%d", c.options.ClientID, message.TopicName, len(message.Content))
 	pub := packet.PUBLISH{
-		FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBLISH},
+		FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBLISH, QoS: c.options.QoS},
 		Message:     message,
 	}
 
-	if pub.QoS == 0 {
-
-	}
 	if pub.QoS == 1 || pub.QoS == 2 {
-		pub.PacketID = c.conn.PacketID + 1
-		c.conn.PacketID = pub.PacketID
+		// 报文标识符在收到PUBACK(QoS1)或者PUBCOMP(QoS2)后释放, 见 ServeMessage;
+		// 未确认的消息达到服务端的接收最大值时, 消息进入等待队列
+		sent, err := c.conn.session.outFlight.put(&pub, DefaultMaxOfflineMessages, QueueReject)
+		if err != nil {
+			log.Printf("client publish: client_id=%s, topic=%s, error=%v", c.options.ClientID, message.TopicName, err)
+			return err
+		}
+		if !sent {
+			log.Printf("client publish: client_id=%s, topic=%s, queued", c.options.ClientID, message.TopicName)
+			return nil
+		}
 	}
 
-	if err := pub.Pack(c.conn.rwc); err != nil {
+	write := func(pub *packet.PUBLISH) error { return pub.Pack(c.conn.rwc) }
+	if err := c.conn.outAliases.send(&pub, write); err != nil {
 		log.Printf("client publish: client_id=%s, topic=%s, error=%v", c.options.ClientID, message.TopicName, err)
 		return err
 	}
@@ -381,6 +439,7 @@ func (c *Client) ServeMessage(ctx context.Context) error {
 				return err
 			}
 			log.Printf("client puback sent: client_id=%s, packet_id=%d", c.options.ClientID, pub.PacketID)
+			c.inbound.Add(-1)
 		case 2:
 			pubrec := packet.PUBREC{
 				FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBREC},
@@ -391,7 +450,7 @@ func (c *Client) ServeMessage(ctx context.Context) error {
 				return err
 			}
 			log.Printf("client pubrec sent: client_id=%s, packet_id=%d", c.options.ClientID, pub.PacketID)
-			c.conn.inFight.Put(pub)
+			c.conn.session.inFight.Put(pub)
 			return nil
 		}
 
@@ -403,7 +462,7 @@ func (c *Client) ServeMessage(ctx context.Context) error {
 		if !ok {
 			return errors.New("mqtt: invalid packet received")
 		}
-		pub, ok = c.conn.inFight.Get(pubrel.PacketID)
+		pub, ok = c.conn.session.inFight.Get(pubrel.PacketID)
 		if !ok {
 			return errors.New("mqtt: invalid packet received")
 		}
@@ -416,6 +475,48 @@ func (c *Client) ServeMessage(ctx context.Context) error {
 			return err
 		}
 		log.Printf("client pubcomp sent: client_id=%s, packet_id=%d", c.options.ClientID, pubrel.PacketID)
+		c.inbound.Add(-1)
+	case pkt, ok := <-c.recv[PUBACK]:
+		if !ok {
+			return fmt.Errorf("mqtt: invalid packet received")
+		}
+		if puback, ok := pkt.(*packet.PUBACK); ok {
+			c.conn.session.outFlight.ack(puback.PacketID)
+			c.conn.flushOutFlight()
+		}
+		return nil
+	case pkt, ok := <-c.recv[PUBREC]:
+		if !ok {
+			return fmt.Errorf("mqtt: invalid packet received")
+		}
+		pubrec, ok := pkt.(*packet.PUBREC)
+		if !ok {
+			return errors.New("mqtt: invalid packet received")
+		}
+		if pubrec.ReasonCode.Code >= 0x80 { // 服务端拒绝了消息, QoS2流程结束
+			c.conn.session.outFlight.ack(pubrec.PacketID)
+			c.conn.flushOutFlight()
+			return nil
+		}
+		c.conn.session.outFlight.release(pubrec.PacketID)
+		pubrel := packet.PUBREL{
+			FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBREL, QoS: 1},
+			PacketID:    pubrec.PacketID,
+		}
+		if err := pubrel.Pack(c.conn.rwc); err != nil {
+			log.Printf("client pubrel send failed: client_id=%s, packet_id=%d, error=%v", c.options.ClientID, pubrec.PacketID, err)
+			return err
+		}
+		return nil
+	case pkt, ok := <-c.recv[PUBCOMP]:
+		if !ok {
+			return fmt.Errorf("mqtt: invalid packet received")
+		}
+		if pubcomp, ok := pkt.(*packet.PUBCOMP); ok {
+			c.conn.session.outFlight.ack(pubcomp.PacketID)
+			c.conn.flushOutFlight()
+		}
+		return nil
 	}
 	go c.onMessage(pub.Message)
 	return nil
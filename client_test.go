@@ -2,6 +2,7 @@ package mqtt
 
 import (
 	"context"
+	"errors"
 	"net"
 	"testing"
 	"time"
@@ -140,3 +141,95 @@ func TestClientRecvChannels(t *testing.T) {
 		t.Errorf("PUBLISH channel should have capacity 10000, got %d", cap(client.recv[PUBLISH]))
 	}
 }
+
+func TestClientReceiveMaximum(t *testing.T) {
+	client := New(Version(packet.VERSION500), ReceiveMaximum(1))
+	server, rwc := net.Pipe()
+	defer server.Close()
+	client.conn.rwc = rwc
+
+	errc := make(chan error, 1)
+	go func() { errc <- client.unpack(context.Background()) }()
+
+	for id := uint16(1); id <= 2; id++ {
+		writeTestPacket(t, server, &packet.PUBLISH{
+			FixedHeader: &packet.FixedHeader{Version: packet.VERSION500, Kind: PUBLISH, QoS: 1},
+			PacketID:    id,
+			Message:     &packet.Message{TopicName: "a/b"},
+		})
+	}
+	disconnect, ok := readTestPacket(t, server, packet.VERSION500).(*packet.DISCONNECT)
+	if !ok || disconnect.ReasonCode.Code != packet.ErrReceiveMaximum.Code {
+		t.Fatalf("expected DISCONNECT 0x93, got %v", disconnect)
+	}
+	if err := <-errc; !errors.Is(err, packet.ErrReceiveMaximum) {
+		t.Errorf("unpack err = %v, want ErrReceiveMaximum", err)
+	}
+}
+
+func TestClientTopicAliases(t *testing.T) {
+	client := New(Version(packet.VERSION500), TopicAliases("hot"))
+	server, rwc := net.Pipe()
+	defer server.Close()
+	client.conn.rwc = rwc
+	go func() { _ = client.unpack(context.Background()) }()
+
+	errc := make(chan error, 1)
+	go func() { errc <- client.Connect(context.Background()) }()
+	if _, ok := readTestPacket(t, server, packet.VERSION500).(*packet.CONNECT); !ok {
+		t.Fatal("expected CONNECT")
+	}
+	writeTestPacket(t, server, &packet.CONNACK{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION500, Kind: CONNACK},
+		Props:       &packet.ConnackProps{TopicAliasMaximum: 5},
+	})
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for _, topicName := range []string{"hot", "hot", "cold"} {
+			_ = client.SubmitMessage(&packet.Message{TopicName: topicName})
+		}
+	}()
+	for _, want := range []struct {
+		topicName string
+		alias     packet.TopicAlias
+	}{{"hot", 1}, {"", 1}, {"cold", 0}} {
+		pub, ok := readTestPacket(t, server, packet.VERSION500).(*packet.PUBLISH)
+		if !ok || pub.Message.TopicName != want.topicName || pub.Props.TopicAlias != want.alias {
+			t.Fatalf("expected PUBLISH %q with alias %d, got %v", want.topicName, want.alias, pub)
+		}
+	}
+}
+
+func TestClientFlushQueued(t *testing.T) {
+	client := New(Version(packet.VERSION311), QoS(1))
+	server, rwc := net.Pipe()
+	defer server.Close()
+	client.conn.rwc = rwc
+	client.conn.session.outFlight.setReceiveMaximum(1)
+	go func() { _ = client.unpack(context.Background()) }()
+
+	go func() {
+		for _, content := range []string{"1", "2"} {
+			_ = client.SubmitMessage(&packet.Message{TopicName: "a/b", Content: []byte(content)})
+		}
+	}()
+	first, ok := readTestPacket(t, server, packet.VERSION311).(*packet.PUBLISH)
+	if !ok || string(first.Message.Content) != "1" {
+		t.Fatalf("expected PUBLISH 1, got %v", first)
+	}
+
+	// 收到PUBACK后, 等待队列中的消息通过 response.OnSend 发送
+	writeTestPacket(t, server, &packet.PUBACK{FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBACK}, PacketID: first.PacketID})
+	errc := make(chan error, 1)
+	go func() { errc <- client.ServeMessage(context.Background()) }()
+	second, ok := readTestPacket(t, server, packet.VERSION311).(*packet.PUBLISH)
+	if !ok || string(second.Message.Content) != "2" {
+		t.Fatalf("expected PUBLISH 2, got %v", second)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -27,6 +27,23 @@ func main() {
 
 	group, ctx := errgroup.WithContext(context.Background())
 	s := mqtt.NewServer(ctx)
+	s.MaxKeepAlive = mqtt.CONFIG.MaxKeepAlive
+	s.MaxPacketSize = mqtt.CONFIG.MaxPacketSize
+	s.TopicAliasMaximum = mqtt.CONFIG.TopicAliasMaximum
+	if mqtt.CONFIG.PasswordFile != "" {
+		passwords, err := mqtt.LoadPasswordFile(mqtt.CONFIG.PasswordFile)
+		if err != nil {
+			log.Fatalf("load password file: %v", err)
+		}
+		s.Authenticator = passwords
+	}
+	if mqtt.CONFIG.ACLFile != "" {
+		acl, err := mqtt.LoadACLFile(mqtt.CONFIG.ACLFile)
+		if err != nil {
+			log.Fatalf("load acl file: %v", err)
+		}
+		s.Authorizer = acl
+	}
 
 	group.Go(func() error {
 		if mqtt.CONFIG.MQTT.URL == "" {
@@ -1,6 +1,7 @@
 package mqtt
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -14,7 +15,6 @@ import (
 	"time"
 
 	"github.com/golang-io/mqtt/packet"
-	"github.com/golang-io/mqtt/topic"
 	"golang.org/x/net/websocket"
 )
 
@@ -38,21 +38,37 @@ type conn struct {
 	remoteAddr string
 
 	//rbuf bufio.Reader
-	//wbuf bufio.Writer
+
+	// bw 缓冲写入rwc, 由mu保护. 控制报文写入后立即刷新, 发送队列中的消息每批刷新一次
+	bw *bufio.Writer
+
+	outbound   *outboundQueue // 等待writer写入的应用消息
+	writerDone chan struct{}  // writer退出时关闭
 
 	// tlsState is the TLS connection state when using TLS. nil means not TLS.
 	tlsState *tls.ConnectionState
 
 	curState atomic.Uint64 // packed (unix time<<8|uint8(ConnState))
 
-	inFight         *InFight // 用这个字典来保存没有处理完QoS1，2的报文
-	ID              string
-	version         byte // mqtt version
-	subscribeTopics *topic.MemoryTrie
-	willTopic       string
-	willPayload     []byte
-	PacketID        uint16
-	mu              sync.Mutex
+	session  *session // 会话状态, CONNECT之后绑定到ClientID对应的会话
+	ID       string
+	username string
+
+	authMethod   string          // CONNECT中的扩展认证方法, 重新认证必须使用相同的方法
+	authExchange AuthExchange    // 进行中的扩展认证
+	authConnect  *packet.CONNECT // 等待扩展认证完成的CONNECT报文, 认证完成后为nil
+
+	connected      bool            // 已经发送了原因码为0的CONNACK, 只在读取报文的goroutine中访问
+	keepAlive      uint16          // 服务端实际使用的保持连接时间, 单位秒, 0表示不检测
+	maxPacketSize  uint32          // 客户端的最大报文长度, 0表示不限制
+	receiveMaximum uint16          // 客户端的接收最大值, 0表示使用默认值65535
+	version        byte            // mqtt version
+	will           *packet.PUBLISH // 遗嘱消息, nil表示没有遗嘱
+	willDelay      uint32          // 遗嘱延时间隔, 单位秒
+	mu             sync.Mutex
+
+	inAliases  map[uint16]string // 客户端发送的主题别名: 主题名
+	outAliases topicAliases      // 发送给客户端的主题别名
 }
 
 func (c *conn) setState(nc net.Conn, state ConnState, runHook bool) {
@@ -91,6 +107,119 @@ func (c *conn) getState() (state ConnState, unixSec int64) {
 	return ConnState(packedState & 0xFF), int64(packedState >> 8)
 }
 
+// authorize 检查客户端是否有权限发布或订阅主题, 未设置 Server.Authorizer 时允许所有访问
+func (c *conn) authorize(access Access, topicName string) bool {
+	authorizer := c.server.Authorizer
+	if authorizer == nil {
+		return true
+	}
+	return authorizer.Authorize(c.clientInfo(), access, topicName)
+}
+
+// clientInfo 返回已认证客户端的信息
+func (c *conn) clientInfo() ClientInfo {
+	return ClientInfo{ClientID: c.ID, Username: c.username, ConnInfo: ConnInfo{RemoteAddr: c.remoteAddr, TLSState: c.tlsState}}
+}
+
+// deliverWith 按订阅的转发选项将应用消息放入当前连接的发送队列, 不会被读取太慢的客户端阻塞
+//
+// MQTT v3.1.1: 参考章节 3.8.4 Response
+// MQTT v5.0: 参考章节 3.8.4 SUBSCRIBE Actions
+// - 转发消息的QoS为发布消息的QoS和订阅授权的最大QoS中较小的值 [MQTT-3.8.4-8]
+func (c *conn) deliverWith(pub *packet.PUBLISH, d delivery) error {
+	slow, err := c.outbound.push(outboundMessage{pub: pub, d: d})
+	if slow {
+		c.slowConsumer()
+	}
+	return err
+}
+
+// prepare 按订阅的转发选项生成发送给当前连接的PUBLISH报文, 消息已经过期时返回nil
+func (c *conn) prepare(pub *packet.PUBLISH, d delivery) *packet.PUBLISH {
+	if expired(pub, time.Now()) {
+		log.Printf("publish expired: clientId=%s, topic=%s", c.ID, pub.Message.TopicName)
+		stat.ExpiredDropped.Inc()
+		return nil
+	}
+	message, props := pub.Message, pub.Props
+	// 转发给已建立的订阅时, 除非订阅设置了Retain As Published, 否则RETAIN标志必须设置为0 [MQTT-3.3.1-9]
+	retain := uint8(0)
+	if pub.Retain == 1 && d.retainAsPublished {
+		retain = 1
+	}
+	// 转发的消息只包含匹配的订阅的订阅标识符 [MQTT-3.3.4-3]
+	if c.version == packet.VERSION500 && (props != nil || len(d.identifiers) > 0) {
+		props = withSubscriptionIdentifiers(props, d.identifiers)
+	}
+	out := &packet.PUBLISH{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBLISH, Dup: 0, QoS: min(pub.QoS, d.qos), Retain: retain}, Message: message, Props: props, ExpiresAt: pub.ExpiresAt}
+	log.Printf("publish: topic=%s, qos=%d, retain=%d, message=%s, props=%v", message.TopicName, out.QoS, out.Retain, message.Content, props)
+	return out
+}
+
+// withSubscriptionIdentifiers 返回设置了订阅标识符的属性副本, 不修改原报文的属性
+func withSubscriptionIdentifiers(props *packet.PublishProperties, identifiers []uint32) *packet.PublishProperties {
+	out := packet.PublishProperties{}
+	if props != nil {
+		out = *props
+	}
+	out.SubscriptionIdentifier = identifiers
+	return &out
+}
+
+// sendPublish 通过w发送PUBLISH报文, QoS>0时分配报文标识符并保存到会话状态中等待客户端确认;
+// 未确认的消息达到客户端的接收最大值时, 消息进入等待队列
+func (c *conn) sendPublish(w *response, pub *packet.PUBLISH) error {
+	// 报文超过客户端的最大报文长度时, 服务端必须丢弃该消息, 并且当作已经完成发送 [MQTT-3.1.2-25]
+	if c.maxPacketSize > 0 {
+		sized := *pub
+		sized.PacketID = 1 // 报文标识符在发送时才分配, 编码长度固定为2字节
+		if size, err := packet.Size(&sized); err != nil || size > int(c.maxPacketSize) {
+			log.Printf("publish dropped: clientId=%s, topic=%s, size=%d, maxPacketSize=%d", c.ID, pub.Message.TopicName, size, c.maxPacketSize)
+			stat.OversizedDropped.Inc()
+			return nil
+		}
+	}
+	if pub.QoS > 0 {
+		if sent, err := c.session.outFlight.put(pub, c.server.maxOfflineMessages(), c.server.OfflineOverflow); !sent {
+			return err
+		}
+	}
+	return c.outAliases.send(pub, w.onSendPublish)
+}
+
+// flushOutFlight 收到确认后, 发送等待发送窗口的消息
+func (c *conn) flushOutFlight() {
+	response := &response{conn: c}
+	for pub := c.session.outFlight.next(); pub != nil; pub = c.session.outFlight.next() {
+		if err := c.outAliases.send(pub, response.onSendPublish); err != nil {
+			log.Printf("flush outflight: clientId=%s, packetId=%d, err=%v", c.ID, pub.PacketID, err)
+			return
+		}
+	}
+}
+
+// bind 将会话绑定到网络连接, 调用时持有sessions.mu; 会话开始接收转发的消息之前完成
+//
+// 恢复会话时, 依次将未确认的消息、等待发送窗口的消息和离线期间积压的消息放入发送队列,
+// 它们在CONNACK之后、之后转发的消息之前发送
+func (c *conn) bind(sess *session, present bool) {
+	c.session = sess
+	sess.outFlight.setReceiveMaximum(c.receiveMaximum)
+	if !present {
+		return
+	}
+	c.retransmit(sess, c.version, time.Now())
+	var items []outboundMessage
+	for pub := sess.outFlight.next(); pub != nil; pub = sess.outFlight.next() {
+		items = append(items, outboundMessage{resend: pub})
+	}
+	c.outbound.preload(items)
+	if items = sess.queue.drain(); len(items) > 0 {
+		log.Printf("drain offline queue: clientId=%s, messages=%d", c.ID, len(items))
+		c.outbound.preload(items)
+	}
+}
+
 // Close the connection.
 func (c *conn) close() {
 	_ = c.rwc.Close()
@@ -115,6 +244,9 @@ func (c *conn) serve(ctx context.Context) {
 	// 记录客户端连接日志
 	log.Printf("connect connected: remote=%s", c.remoteAddr)
 
+	c.writerDone = make(chan struct{})
+	go c.writeLoop()
+
 	defer func() {
 		if err := recover(); err != nil && err != ErrAbortHandler {
 			buf := make([]byte, size)
@@ -126,13 +258,12 @@ func (c *conn) serve(ctx context.Context) {
 		// 记录客户端断开连接日志
 		log.Printf("connect disconnected: clientId=%s, remote=%s", c.ID, c.remoteAddr)
 
-		c.server.memorySubscribed.Unsubscribe(c)
 		c.close()
+		// 先让发送队列中剩余的消息回到会话, 再解除绑定, 之后转发的消息排在它们后面
+		c.stopWriter()
+		c.server.detachClient(c)
 		c.setState(c.rwc, StateClosed, true)
-		if c.willTopic == "" || c.willPayload == nil {
-			return
-		}
-		_ = c.server.memorySubscribed.Publish(&packet.Message{TopicName: c.willTopic, Content: c.willPayload}, nil)
+		c.server.scheduleWill(c)
 	}()
 	// TODO: TLS handle
 	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
@@ -173,6 +304,14 @@ func (c *conn) serve(ctx context.Context) {
 	for {
 		rw, err := c.readRequest(ctx)
 		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				c.keepAliveTimeout()
+				return
+			}
+			if errors.Is(err, packet.ErrPacketTooLarge) {
+				c.abort(packet.ErrPacketTooLarge)
+			}
 			log.Printf("readRequest: err=%v", err)
 			return
 		}
@@ -184,7 +323,11 @@ func (c *conn) serve(ctx context.Context) {
 // Read next request from connection.
 func (c *conn) readRequest(_ context.Context) (*response, error) {
 	w, err := &response{conn: c}, error(nil)
-	w.packet, err = packet.Unpack(c.version, c.rwc)
+	// 服务端在1.5倍保持连接时间内没有收到客户端的报文, 必须断开网络连接 [MQTT-3.1.2-24]
+	if c.keepAlive > 0 {
+		_ = c.rwc.SetReadDeadline(time.Now().Add(time.Duration(c.keepAlive) * time.Second * 3 / 2))
+	}
+	w.packet, err = packet.UnpackLimit(c.version, c.rwc, c.server.MaxPacketSize)
 	stat.PacketReceived.Inc()
 	if err != nil && !errors.Is(err, io.EOF) {
 		return nil, fmt.Errorf("makeRequest: version=%d, %s, err=%w", c.version, packet.Kind[w.packet.Kind()], err)
@@ -192,90 +335,346 @@ func (c *conn) readRequest(_ context.Context) (*response, error) {
 	return w, err
 }
 
+// finishConnect 根据认证结果回复CONNACK; 认证通过时绑定会话, 失败时关闭网络连接
+//
+// authData 为扩展认证最后一步返回给客户端的认证数据
+func (c *conn) finishConnect(w ResponseWriter, connect *packet.CONNECT, code packet.ReasonCode, authData []byte) {
+	c.authConnect = nil
+	connack := &packet.CONNACK{
+		FixedHeader: &packet.FixedHeader{Version: c.version, Kind: CONNACK},
+	}
+	if c.version == packet.VERSION500 {
+		// 未发送的属性由客户端使用默认值(支持), 这里只声明服务端不支持的特性
+		sharedAvailable := packet.SharedSubscriptionAvailable(1)
+		identifierAvailable := packet.SubscriptionIdentifierAvailable(1)
+		connack.Props = &packet.ConnackProps{
+			SharedSubscriptionAvailable:     &sharedAvailable,
+			SubscriptionIdentifierAvailable: &identifierAvailable,
+			AuthenticationMethod:            packet.AuthenticationMethod(c.authMethod),
+			AuthenticationData:              authData,
+		}
+		if c.server.RetainStore == nil {
+			connack.Props.RetainAvailable = new(packet.RetainAvailable)
+		}
+		if c.server.ReceiveMaximum > 0 {
+			connack.Props.ReceiveMaximum = packet.ReceiveMaximum(c.server.ReceiveMaximum)
+		}
+		connack.Props.MaximumPacketSize = packet.MaximumPacketSize(c.server.MaxPacketSize)
+		connack.Props.TopicAliasMaximum = packet.TopicAliasMaximum(c.server.TopicAliasMaximum)
+	}
+
+	// v3.1.1没有通知客户端的机制, 服务端只按调整后的时间检测连接
+	keepAlive, overridden := c.server.keepAlive(connect.KeepAlive)
+	if overridden && code.Code == 0 {
+		if c.version == packet.VERSION500 {
+			connack.Props.ServerKeepAlive = (*packet.ServerKeepAlive)(&keepAlive)
+		} else {
+			log.Printf("client keep alive overridden: clientId=%s, reomte=%s, keepAlive=%d, max=%d", c.ID, c.remoteAddr, connect.KeepAlive, c.server.MaxKeepAlive)
+		}
+	}
+	connack.ReturnCode = connackReturnCode(c.version, code)
+	// 记录客户端认证和连接成功日志
+	if connack.ReturnCode.Code == 0 {
+		c.username = connect.Username
+		c.will, c.willDelay = willMessage(connect)
+		if c.version == packet.VERSION500 && connect.ClientID == "" {
+			connack.Props.AssignedClientID = packet.AssignedClientID(c.ID)
+		}
+		c.keepAlive = keepAlive
+		if c.authExchange != nil && c.authExchange.Username() != "" {
+			c.username = c.authExchange.Username()
+		}
+		// 连接的状态在绑定会话之前设置, 绑定之后转发给会话的消息就会进入发送队列
+		if connect.Props != nil {
+			c.receiveMaximum = connect.Props.ReceiveMaximum.Uint16()
+			c.maxPacketSize = uint32(connect.Props.MaximumPacketSize)
+			c.outAliases.reset(connect.Props.TopicAliasMaximum.Uint16(), nil)
+		}
+		log.Printf("client auth ok: clientId=%s, username=%s, reomte=%s", c.ID, c.username, c.remoteAddr)
+		if c.will != nil {
+			log.Printf("client will: willTopic=%s, willPayload=%s, willQoS=%d, willRetain=%d, willDelay=%d, reomte=%s, version=%d",
+				c.will.Message.TopicName, c.will.Message.Content, c.will.QoS, c.will.Retain, c.willDelay, c.remoteAddr, c.version)
+		}
+		// 会话中还有上一个网络连接等待发布的遗嘱消息
+		if will := c.server.sessions.resumeWill(c.ID, connect.ConnectFlags.CleanStart()); will != nil {
+			_ = c.server.publishFrom(c.ID, will)
+		}
+		// 服务端发送包含非零原因码的CONNACK时, SessionPresent必须为0 [MQTT-3.2.2-6]
+		sess, present := c.server.attachClient(c, connect.ConnectFlags.CleanStart(), sessionExpiryInterval(connect))
+		if present {
+			connack.SessionPresent = 1
+		}
+		log.Printf("client session: clientId=%s, cleanStart=%v, present=%v, expiryInterval=%d", c.ID, connect.ConnectFlags.CleanStart(), present, sess.expiryInterval)
+	} else {
+		log.Printf("client auth failed: clientId=%s, username=%s, reomte=%s, reason=%v", c.ID, connect.Username, c.remoteAddr, connack.ReturnCode)
+	}
+	c.authExchange = nil
+
+	if err := w.OnSend(connack); err != nil {
+		log.Printf("mqtt-onSend: err=%v", err)
+		return
+	}
+	// 服务端发送了包含非零返回码的CONNACK后, 必须关闭网络连接 [MQTT-3.2.2-5]
+	if connack.ReturnCode.Code != 0 {
+		panic(ErrAbortHandler)
+	}
+	c.connected = true
+	// 服务端发送给客户端的第一个报文必须是CONNACK [MQTT-3.2.0-1], 之后writer才开始发送队列中的消息
+	c.outbound.start()
+	if d := c.server.RetryInterval; d > 0 && c.version != packet.VERSION500 {
+		go c.retryLoop(c.session, c.version, d)
+	}
+}
+
+// retransmit 重发在before之前发送且还没有被确认的消息: 未收到PUBREC的PUBLISH设置DUP=1重发, 已收到PUBREC的重发PUBREL
+//
+// MQTT v3.1.1: 参考章节 4.4 Message delivery retry
+// MQTT v5.0: 参考章节 4.4 Message delivery retry
+//
+// 定时重发在连接的读goroutine之外进行, 因此会话和协议版本由调用方传入
+func (c *conn) retransmit(sess *session, version byte, before time.Time) {
+	var items []outboundMessage
+	for _, msg := range sess.outFlight.retry(before) {
+		if msg.released {
+			items = append(items, outboundMessage{resend: &packet.PUBREL{FixedHeader: &packet.FixedHeader{Version: version, Kind: PUBREL, QoS: 1}, PacketID: msg.pub.PacketID}})
+			continue
+		}
+		pub, fixed := *msg.pub, *msg.pub.FixedHeader
+		fixed.Version, fixed.Dup = version, 1 // 重发PUBLISH报文时DUP标志必须设置为1 [MQTT-3.3.1-1]
+		pub.FixedHeader = &fixed
+		items = append(items, outboundMessage{resend: &pub})
+	}
+	c.outbound.preload(items)
+}
+
+// resend 由writer发送会话中已经分配了报文标识符的报文
+func (c *conn) resend(w *response, p packet.Packet) {
+	var err error
+	switch p := p.(type) {
+	case *packet.PUBLISH:
+		err = c.outAliases.send(p, w.onSendPublish)
+		if err == nil && p.Dup == 1 {
+			stat.Retransmitted.Inc()
+		}
+	case *packet.PUBREL:
+		if err = w.OnSend(p); err == nil {
+			stat.Retransmitted.Inc()
+		}
+	}
+	if err != nil {
+		log.Printf("retransmit: clientId=%s, kind=0x%x, err=%v", c.ID, p.Kind(), err)
+	}
+}
+
+// retryLoop 定时重发v3.1.1客户端超时未确认的消息, 网络连接关闭后退出
+func (c *conn) retryLoop(sess *session, version byte, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if state, _ := c.getState(); state == StateClosed || state == StateHijacked {
+			return
+		}
+		c.retransmit(sess, version, time.Now().Add(-interval))
+	}
+}
+
+// keepAliveTimeout 保持连接超时, v5.0客户端会收到原因码为0x8D的DISCONNECT报文
+//
+// MQTT v3.1.1: 参考章节 3.1.2.10 Keep Alive
+// MQTT v5.0: 参考章节 3.1.2.10 Keep Alive, 3.14.2.1 Disconnect Reason Code
+func (c *conn) keepAliveTimeout() {
+	log.Printf("client keep alive timeout: clientId=%s, reomte=%s, keepAlive=%d", c.ID, c.remoteAddr, c.keepAlive)
+	stat.KeepAliveTimeout.Inc()
+	if c.version != packet.VERSION500 {
+		return
+	}
+	// 对端可能已经不可达, 避免发送DISCONNECT时一直阻塞
+	_ = c.rwc.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := (&response{conn: c}).OnSend(packet.NewDISCONNECT(c.version, packet.ErrKeepAliveTimeout)); err != nil {
+		log.Printf("mqtt-onSend: err=%v", err)
+	}
+}
+
+// abort 向v5.0客户端发送带有原因码的DISCONNECT报文, 然后关闭网络连接
+//
+// MQTT v5.0: 参考章节 3.14 DISCONNECT, 4.13 Handling errors
+func (c *conn) abort(code packet.ReasonCode) {
+	log.Printf("connection aborted: clientId=%s, reomte=%s, reason=%v", c.ID, c.remoteAddr, code)
+	if c.version == packet.VERSION500 {
+		if err := (&response{conn: c}).OnSend(packet.NewDISCONNECT(c.version, code)); err != nil {
+			log.Printf("mqtt-onSend: err=%v", err)
+		}
+	}
+	panic(ErrAbortHandler)
+}
+
 type defaultHandler struct{}
 
 func (defaultHandler) ServeMQTT(w ResponseWriter, req packet.Packet) {
 	var spkt packet.Packet
 	c := w.(*response).conn
+	// 客户端建立网络连接后发送的第一个报文必须是CONNECT [MQTT-3.1.0-1]
+	if _, ok := req.(*packet.CONNECT); !ok && !c.connected && c.authConnect == nil {
+		log.Printf("packet before connect: reomte=%s, packet=%s", c.remoteAddr, packet.Kind[req.Kind()])
+		c.abort(packet.ErrProtocolErr)
+	}
+	// 扩展认证完成之前, 客户端只能发送AUTH和DISCONNECT报文, 参考章节 4.12 Enhanced authentication
+	if c.authConnect != nil {
+		switch req.(type) {
+		case *packet.AUTH, *packet.DISCONNECT:
+		default:
+			c.finishConnect(w, c.authConnect, packet.ErrProtocolErr, nil)
+			return
+		}
+	}
 	switch rpkt := req.(type) {
 	case *packet.RESERVED:
 		return
 	case *packet.CONNECT:
 		c.version, c.ID = rpkt.Version, rpkt.ClientID
-		connack := &packet.CONNACK{
-			FixedHeader: &packet.FixedHeader{Version: c.version, Kind: CONNACK},
+		// ClientID为空时由服务端分配唯一的ClientID, 参考章节 3.1.3.1 Client Identifier
+		// - v3.1.1: 客户端必须同时设置CleanSession=1 [MQTT-3.1.3-7], 否则服务端返回0x02并关闭网络连接 [MQTT-3.1.3-8]
+		// - v5.0: 服务端必须在CONNACK中返回分配的客户标识符 [MQTT-3.2.2-16]
+		if rpkt.ClientID == "" {
+			if c.version != packet.VERSION500 && !rpkt.ConnectFlags.CleanStart() {
+				c.finishConnect(w, rpkt, packet.ErrClientIdentifierNotValid, nil)
+				return
+			}
+			c.ID = c.server.generateClientID(ConnInfo{RemoteAddr: c.remoteAddr, TLSState: c.tlsState})
+			log.Printf("client id assigned: clientId=%s, reomte=%s", c.ID, c.remoteAddr)
+		}
+		// v5.0: CONNECT中包含认证方法时使用扩展认证, 参考章节 4.12 Enhanced authentication
+		if c.version == packet.VERSION500 && rpkt.Props != nil && rpkt.Props.AuthenticationMethod != "" {
+			c.startAuth(w, rpkt)
+			return
 		}
-
 		// 这里没有回CONNACK的话，客户端会重试, 如果CONNACK里面的Code!=0, 客户端直接会字节报错
-		// TODO: password rewrite
-		password, ok := CONFIG.GetAuth(rpkt.Username)
-		if !ok || password != rpkt.Password {
-			if rpkt.Version == packet.VERSION500 {
-				connack.ReturnCode = packet.ErrMalformedUsernameOrPassword
-			} else {
-				connack.ReturnCode = packet.ErrBadUsernameOrPassword
+		code := c.server.authenticator().Authenticate(rpkt, ConnInfo{RemoteAddr: c.remoteAddr, TLSState: c.tlsState})
+		c.finishConnect(w, rpkt, code, nil)
+		return
+	case *packet.PUBLISH:
+		if c.version == packet.VERSION500 {
+			if code := c.resolveTopicAlias(rpkt); code.Code != 0 {
+				c.abort(code)
 			}
 		}
-		c.ID, c.version, c.willTopic, c.willPayload = rpkt.ClientID, rpkt.Version, rpkt.WillTopic, rpkt.WillPayload
-		log.Printf("client will: willTopic=%s, willPayload=%s, reomte=%s, version=%d", c.willTopic, c.willPayload, c.remoteAddr, c.version)
-		// 记录客户端认证和连接成功日志
-		if connack.ReturnCode.Code == 0 {
-			log.Printf("client auth ok: clientId=%s, username=%s, reomte=%s", c.ID, rpkt.Username, c.remoteAddr)
-		} else {
-			log.Printf("client auth failed: clientId=%s, username=%s, reomte=%s, reason=%v", c.ID, rpkt.Username, c.remoteAddr, connack.ReturnCode)
+		stampExpiry(rpkt, time.Now())
+		// 未授权的发布: v5.0返回原因码0x87, v3.1.1正常确认但丢弃消息
+		authorized := c.authorize(AccessPublish, rpkt.Message.TopicName)
+		if !authorized {
+			log.Printf("publish not authorized: clientId=%s, reomte=%s, topic=%s", c.ID, c.remoteAddr, rpkt.Message.TopicName)
+		}
+		// 服务端未发送PUBACK/PUBCOMP的QoS1, QoS2消息数量超过了服务端的接收最大值 [MQTT-3.3.4-9]
+		if rpkt.QoS > 0 && c.version == packet.VERSION500 && !c.session.inFight.Has(rpkt.PacketID) &&
+			c.session.inFight.Len() >= int(c.server.receiveMaximum()) {
+			c.abort(packet.ErrReceiveMaximum)
 		}
-
-		spkt = connack
-	case *packet.PUBLISH:
 		switch rpkt.QoS {
 		case 0:
-			_ = c.server.memorySubscribed.Publish(rpkt.Message, rpkt.Props)
+			if authorized {
+				_ = c.server.publishFrom(c.ID, rpkt)
+			}
 			return
 		case 1:
-			_ = c.server.memorySubscribed.Publish(rpkt.Message, rpkt.Props)
-			spkt = &packet.PUBACK{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBACK}, PacketID: rpkt.PacketID}
+			puback := &packet.PUBACK{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBACK}, PacketID: rpkt.PacketID}
+			if !authorized {
+				if c.version == packet.VERSION500 {
+					puback.ReasonCode = packet.ErrNotAuthorized
+				}
+			} else if err := c.server.publishFrom(c.ID, rpkt); errors.Is(err, ErrQueueFull) && c.version == packet.VERSION500 {
+				puback.ReasonCode = packet.ErrQuotaExceeded
+			}
+			spkt = puback
 		case 2:
-			c.inFight.Put(rpkt)
-			spkt = &packet.PUBREC{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBREC}, PacketID: rpkt.PacketID}
+			pubrec := &packet.PUBREC{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBREC}, PacketID: rpkt.PacketID}
+			if authorized {
+				c.session.inFight.Put(rpkt)
+			} else if c.version == packet.VERSION500 {
+				pubrec.ReasonCode = packet.ErrNotAuthorized
+			}
+			spkt = pubrec
 		}
-	case *packet.PUBACK: // TODO:如果服务端作为client转发数据，也需要遵循qos的逻辑
+	case *packet.PUBACK:
+		c.session.outFlight.ack(rpkt.PacketID)
+		c.flushOutFlight()
 		return
 	case *packet.PUBREC:
-		spkt = &packet.PUBREL{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBREL, QoS: 1}, PacketID: rpkt.PacketID}
-	case *packet.PUBREL:
-		pub, ok := c.inFight.Get(rpkt.PacketID)
-		if !ok {
-			panic("inFight not found packetID")
+		// v5.0: PUBREC的原因码>=0x80时消息流程结束, 不再发送PUBREL [MQTT-4.3.3-4]
+		if rpkt.ReasonCode.Code >= 0x80 {
+			c.session.outFlight.ack(rpkt.PacketID)
+			c.flushOutFlight()
+			return
 		}
-		err := c.server.memorySubscribed.Publish(pub.Message, pub.Props)
-		if err != nil {
-			log.Printf("publish err: err=%v", err)
+		pubrel := &packet.PUBREL{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBREL, QoS: 1}, PacketID: rpkt.PacketID}
+		if !c.session.outFlight.release(rpkt.PacketID) && c.version == packet.VERSION500 {
+			pubrel.ReasonCode = packet.ErrPacketIdentifierNotFound
 		}
-		spkt = &packet.PUBCOMP{
+		spkt = pubrel
+	case *packet.PUBREL:
+		pubcomp := &packet.PUBCOMP{
 			FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBCOMP},
 			PacketID:    rpkt.PacketID,
 			ReasonCode:  packet.ReasonCode{Code: 0},
 		}
+		// 报文标识符不在会话状态中(例如会话已被清理), 仍然需要回复PUBCOMP以结束客户端的QoS2流程
+		if pub, ok := c.session.inFight.Get(rpkt.PacketID); ok {
+			if err := c.server.publishFrom(c.ID, pub); err != nil {
+				log.Printf("publish err: err=%v", err)
+			}
+		} else if c.version == packet.VERSION500 {
+			pubcomp.ReasonCode = packet.ErrPacketIdentifierNotFound
+		}
+		spkt = pubcomp
 	case *packet.PUBCOMP:
+		c.session.outFlight.ack(rpkt.PacketID)
+		c.flushOutFlight()
 		return
 	case *packet.SUBSCRIBE:
 		var reasons []packet.ReasonCode
 		var subscribedTopics []string
 		var failedTopics []string
+		var subscribed []packet.Subscription
+		var existed []bool
+		// 订阅标识符与该SUBSCRIBE报文中的所有订阅关联, 参考章节 3.8.2.1.2 Subscription Identifier
+		var identifier uint32
+		if c.version == packet.VERSION500 && rpkt.Props != nil {
+			identifier = rpkt.Props.SubscriptionIdentifier.Uint32()
+		}
 
 		for _, subscribe := range rpkt.Subscriptions {
-			if err := c.subscribeTopics.Subscribe(subscribe.TopicFilter); err != nil {
-				log.Printf("subscribeTopics.Subscribe: err=%v", err)
-				reasons = append(reasons, packet.ErrTopicNameInvalid)
+			// 共享订阅设置No Local选项是协议错误 [MQTT-3.8.3-4]
+			if _, _, shared, _ := parseShared(subscribe.TopicFilter); shared && subscribe.NoLocal == 1 {
+				c.abort(packet.ErrProtocolErr)
+			}
+			if !c.authorize(AccessSubscribe, subscribe.TopicFilter) {
+				log.Printf("subscribe not authorized: clientId=%s, reomte=%s, topic=%s", c.ID, c.remoteAddr, subscribe.TopicFilter)
+				if c.version == packet.VERSION500 {
+					reasons = append(reasons, packet.ErrNotAuthorized)
+				} else {
+					reasons = append(reasons, packet.ErrUnspecifiedError) // v3.1.1: 0x80 Failure
+				}
+				failedTopics = append(failedTopics, subscribe.TopicFilter)
+				continue
+			}
+			exist, err := c.session.subscribe(subscribe, identifier)
+			if err != nil {
+				log.Printf("session.subscribe: clientId=%s, topic=%s, err=%v", c.ID, subscribe.TopicFilter, err)
+				if c.version == packet.VERSION500 {
+					reasons = append(reasons, packet.ErrTopicFilterInvalid)
+				} else {
+					reasons = append(reasons, packet.ErrUnspecifiedError) // v3.1.1: 0x80 Failure
+				}
 				failedTopics = append(failedTopics, subscribe.TopicFilter)
 			} else {
 				reasons = append(reasons, packet.ReasonCode{Code: subscribe.MaximumQoS})
 				subscribedTopics = append(subscribedTopics, subscribe.TopicFilter)
+				subscribed, existed = append(subscribed, subscribe), append(existed, exist)
+				if err := c.server.memorySubscribed.Subscribe(c.session, subscription{Subscription: subscribe, identifier: identifier}); err != nil {
+					log.Printf("memorySubscribed.Subscribe: clientId=%s, topic=%s, err=%v", c.ID, subscribe.TopicFilter, err)
+				}
 			}
 		}
 
-		c.server.memorySubscribed.Subscribe(c)
-
 		// 记录订阅日志
 		if len(subscribedTopics) > 0 {
 			log.Printf("client subscribed: clientId=%s, reomte=%s, topics: %v", c.ID, c.remoteAddr, subscribedTopics)
@@ -284,21 +683,38 @@ func (defaultHandler) ServeMQTT(w ResponseWriter, req packet.Packet) {
 			log.Printf("client subscription failed: clientId=%s, reomte=%s, failed_topics: %v", c.ID, c.remoteAddr, failedTopics)
 		}
 
-		spkt = &packet.SUBACK{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: SUBACK}, PacketID: rpkt.PacketID, ReasonCode: reasons}
+		suback := &packet.SUBACK{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: SUBACK}, PacketID: rpkt.PacketID, ReasonCode: reasons}
+		if err := w.OnSend(suback); err != nil {
+			log.Printf("mqtt-onSend: err=%v", err)
+			return
+		}
+		// 保留消息在SUBACK之后发送
+		for i, sub := range subscribed {
+			c.sendRetained(sub, identifier, existed[i])
+		}
+		return
 	case *packet.UNSUBSCRIBE:
 		var unsubscribedTopics []string
+		var reasons []packet.ReasonCode
 		for _, subscribe := range rpkt.Subscriptions {
-			c.subscribeTopics.Unsubscribe(subscribe.TopicFilter)
+			c.session.unsubscribe(subscribe.TopicFilter)
+			existed := c.server.memorySubscribed.Unsubscribe(subscribe.TopicFilter, c.session)
 			unsubscribedTopics = append(unsubscribedTopics, subscribe.TopicFilter)
+			// MQTT v5.0: 参考章节 3.11.3 UNSUBACK Payload
+			// - 每个主题过滤器对应一个原因码, 全局订阅索引中没有该会话的订阅时使用0x11(No subscription existed)
+			if existed {
+				reasons = append(reasons, packet.CodeSuccess)
+			} else {
+				reasons = append(reasons, packet.CodeNoSubscriptionExisted)
+			}
 		}
-		c.server.memorySubscribed.Unsubscribe(c)
 
 		// 记录取消订阅日志
 		if len(unsubscribedTopics) > 0 {
 			log.Printf("client unsubscribed: clientId=%s, reomte=%s, topics: %v", c.ID, c.remoteAddr, unsubscribedTopics)
 		}
 
-		spkt = &packet.UNSUBACK{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: UNSUBACK, QoS: 1}, PacketID: rpkt.PacketID}
+		spkt = &packet.UNSUBACK{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: UNSUBACK}, PacketID: rpkt.PacketID, ReasonCode: reasons}
 	case *packet.PINGREQ:
 		// 服务端必须发送 PINGRESP报文响应客户端的PINGREQ报文 [MQTT-3.12.4-1]。
 		spkt = &packet.PINGRESP{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PINGRESP}}
@@ -306,9 +722,21 @@ func (defaultHandler) ServeMQTT(w ResponseWriter, req packet.Packet) {
 		// 记录客户端主动断开连接日志
 		log.Printf("client requested disconnect: clientId=%s, reomte=%s", c.ID, c.remoteAddr)
 
-		c.willTopic, c.willPayload = "", nil // 服务端在收到DISCONNECT报文时: 必须丢弃任何与当前连接关联的未发布的遗嘱消息，具体描述见 3.1.2.5节 [MQTT-3.14.4-3]。
-		panic(ErrAbortHandler)               // 服务端在收到DISCONNECT报文时: 应该关闭网络连接，如果客户端 还没有这么做。
+		// DISCONNECT中包含会话过期间隔时使用新的值, 包括显式设置的0; CONNECT中为0时不能设置为非0值, 参考章节 3.14.2.2.2
+		if c.version == packet.VERSION500 && rpkt.Props != nil && rpkt.Props.HasSessionExpiryInterval() {
+			if !c.server.sessions.setExpiryInterval(c.session, rpkt.Props.SessionExpiryInterval.Uint32()) {
+				c.abort(packet.ErrProtocolErr)
+			}
+		}
+		// 服务端在收到DISCONNECT报文时: 必须丢弃任何与当前连接关联的未发布的遗嘱消息，具体描述见 3.1.2.5节 [MQTT-3.14.4-3]。
+		// v5.0: 原因码0x04(Disconnect with Will Message)表示客户端希望服务端仍然发布遗嘱消息
+		if c.version != packet.VERSION500 || rpkt.ReasonCode.Code != 0x04 {
+			c.will = nil
+		}
+		panic(ErrAbortHandler) // 服务端在收到DISCONNECT报文时: 应该关闭网络连接，如果客户端 还没有这么做。
 	case *packet.AUTH:
+		c.continueAuth(w, rpkt)
+		return
 	default:
 		panic(fmt.Sprintf("unknown packet type: %T", rpkt))
 	}
@@ -0,0 +1,458 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+// subscribeTestServer 建立连接并订阅主题过滤器
+func subscribeTestServer(t *testing.T, s *Server, clientID string, subscriptions ...packet.Subscription) (net.Conn, *session) {
+	t.Helper()
+	rw, _ := connectTestServer(t, s, &packet.CONNECT{ClientID: clientID, ConnectFlags: packet.ConnectFlags(0x02)})
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION311, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: subscriptions,
+	})
+	if _, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.SUBACK); !ok {
+		t.Fatal("expected SUBACK")
+	}
+	s.sessions.mu.Lock()
+	defer s.sessions.mu.Unlock()
+	return rw, s.sessions.maps[clientID]
+}
+
+// waitOutFlight 等待服务端处理完客户端的确认报文
+func waitOutFlight(t *testing.T, sess *session, want int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if sess.outFlight.Len() == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("outFlight = %d, want %d", sess.outFlight.Len(), want)
+}
+
+func TestDeliverQoSDowngrade(t *testing.T) {
+	s := NewServer(context.Background())
+	rw, sess := subscribeTestServer(t, s, "sub",
+		packet.Subscription{TopicFilter: "qos/0", MaximumQoS: 0},
+		packet.Subscription{TopicFilter: "qos/1", MaximumQoS: 1},
+		packet.Subscription{TopicFilter: "qos/2", MaximumQoS: 2},
+	)
+
+	for _, tc := range []struct {
+		topic string
+		qos   uint8
+		want  uint8
+	}{
+		{"qos/0", 2, 0},
+		{"qos/1", 2, 1},
+		{"qos/2", 1, 1},
+		{"qos/2", 0, 0},
+	} {
+		go func() {
+			_ = s.publish(&packet.PUBLISH{FixedHeader: &packet.FixedHeader{Kind: PUBLISH, QoS: tc.qos}, Message: &packet.Message{TopicName: tc.topic}})
+		}()
+		pub, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+		if !ok {
+			t.Fatalf("%s: expected PUBLISH", tc.topic)
+		}
+		if pub.QoS != tc.want {
+			t.Errorf("%s: published with QoS %d, delivered with QoS %d, want %d", tc.topic, tc.qos, pub.QoS, tc.want)
+		}
+		if pub.QoS == 1 {
+			writeTestPacket(t, rw, &packet.PUBACK{FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBACK}, PacketID: pub.PacketID})
+		}
+		waitOutFlight(t, sess, 0)
+	}
+}
+
+func TestDeliverQoS2(t *testing.T) {
+	s := NewServer(context.Background())
+	rw, sess := subscribeTestServer(t, s, "sub", packet.Subscription{TopicFilter: "a/b", MaximumQoS: 2})
+
+	go func() {
+		_ = s.publish(&packet.PUBLISH{FixedHeader: &packet.FixedHeader{Kind: PUBLISH, QoS: 2}, Message: &packet.Message{TopicName: "a/b"}})
+	}()
+	pub, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+	if !ok || pub.QoS != 2 || pub.PacketID == 0 {
+		t.Fatalf("expected QoS2 PUBLISH, got %v", pub)
+	}
+	waitOutFlight(t, sess, 1)
+
+	writeTestPacket(t, rw, &packet.PUBREC{FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBREC}, PacketID: pub.PacketID})
+	pubrel, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBREL)
+	if !ok || pubrel.PacketID != pub.PacketID {
+		t.Fatalf("expected PUBREL %d, got %v", pub.PacketID, pubrel)
+	}
+	writeTestPacket(t, rw, &packet.PUBCOMP{FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBCOMP}, PacketID: pub.PacketID})
+	waitOutFlight(t, sess, 0)
+}
+
+func TestRetransmitOnReconnect(t *testing.T) {
+	s := NewServer(context.Background())
+	rw, _ := connectTestServer(t, s, &packet.CONNECT{ClientID: "retry"})
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION311, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{TopicFilter: "qos/1", MaximumQoS: 1}, {TopicFilter: "qos/2", MaximumQoS: 2}},
+	})
+	if _, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.SUBACK); !ok {
+		t.Fatal("expected SUBACK")
+	}
+
+	// QoS1消息不确认; QoS2消息只完成PUBREC/PUBREL
+	var ids []uint16
+	for _, topicName := range []string{"qos/1", "qos/2"} {
+		go func() {
+			_ = s.publish(&packet.PUBLISH{FixedHeader: &packet.FixedHeader{Kind: PUBLISH, QoS: 2}, Message: &packet.Message{TopicName: topicName}})
+		}()
+		pub := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+		ids = append(ids, pub.PacketID)
+	}
+	writeTestPacket(t, rw, &packet.PUBREC{FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBREC}, PacketID: ids[1]})
+	if _, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBREL); !ok {
+		t.Fatal("expected PUBREL")
+	}
+	_ = rw.Close()
+	waitOffline(t, s, "retry")
+
+	// 重连后按原来的顺序重发PUBLISH(DUP=1)和PUBREL
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{ClientID: "retry"})
+	if connack.SessionPresent != 1 {
+		t.Fatal("SessionPresent should be 1")
+	}
+	pub, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+	if !ok || pub.PacketID != ids[0] || pub.Dup != 1 || pub.QoS != 1 {
+		t.Fatalf("expected PUBLISH %d with DUP=1, got %v", ids[0], pub)
+	}
+	pubrel, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBREL)
+	if !ok || pubrel.PacketID != ids[1] {
+		t.Fatalf("expected PUBREL %d, got %v", ids[1], pubrel)
+	}
+
+	writeTestPacket(t, rw, &packet.PUBACK{FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBACK}, PacketID: ids[0]})
+	writeTestPacket(t, rw, &packet.PUBCOMP{FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBCOMP}, PacketID: ids[1]})
+	s.sessions.mu.Lock()
+	sess := s.sessions.maps["retry"]
+	s.sessions.mu.Unlock()
+	waitOutFlight(t, sess, 0)
+}
+
+func TestRetryInterval(t *testing.T) {
+	s := NewServer(context.Background())
+	s.RetryInterval = 50 * time.Millisecond
+	rw, sess := subscribeTestServer(t, s, "sub", packet.Subscription{TopicFilter: "a/b", MaximumQoS: 1})
+
+	go func() {
+		_ = s.publish(&packet.PUBLISH{FixedHeader: &packet.FixedHeader{Kind: PUBLISH, QoS: 1}, Message: &packet.Message{TopicName: "a/b"}})
+	}()
+	first := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+	if first.Dup != 0 {
+		t.Fatal("first delivery should have DUP=0")
+	}
+	retry, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+	if !ok || retry.PacketID != first.PacketID || retry.Dup != 1 {
+		t.Fatalf("expected retransmitted PUBLISH, got %v", retry)
+	}
+	writeTestPacket(t, rw, &packet.PUBACK{FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBACK}, PacketID: first.PacketID})
+	waitOutFlight(t, sess, 0)
+}
+
+// connectTestServer5 建立v5.0连接, 并按需订阅主题过滤器
+func connectTestServer5(t *testing.T, s *Server, connect *packet.CONNECT, subscriptions ...packet.Subscription) net.Conn {
+	t.Helper()
+	connect.FixedHeader = &packet.FixedHeader{Version: packet.VERSION500}
+	connect.ConnectFlags = packet.ConnectFlags(0x02)
+	if connect.Props == nil {
+		connect.Props = &packet.ConnectProperties{}
+	}
+	rw, connack := connectTestServer(t, s, connect)
+	if connack.ReturnCode.Code != 0 {
+		t.Fatalf("ReturnCode = %v", connack.ReturnCode)
+	}
+	if len(subscriptions) == 0 {
+		return rw
+	}
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION500, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: subscriptions,
+	})
+	if _, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.SUBACK); !ok {
+		t.Fatal("expected SUBACK")
+	}
+	return rw
+}
+
+func TestOutboundReceiveMaximum(t *testing.T) {
+	s := NewServer(context.Background())
+	rw := connectTestServer5(t, s, &packet.CONNECT{ClientID: "slow", Props: &packet.ConnectProperties{ReceiveMaximum: 1}},
+		packet.Subscription{TopicFilter: "a/b", MaximumQoS: 1})
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			_ = s.publish(&packet.PUBLISH{FixedHeader: &packet.FixedHeader{Kind: PUBLISH, QoS: 1}, Message: &packet.Message{TopicName: "a/b"}})
+		}
+	}()
+	first, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.PUBLISH)
+	if !ok {
+		t.Fatal("expected PUBLISH")
+	}
+	// 第一条消息确认之前不会收到第二条消息
+	_ = rw.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := packet.Unpack(packet.VERSION500, rw); err == nil {
+		t.Fatal("received a PUBLISH beyond the client's receive maximum")
+	}
+	writeTestPacket(t, rw, &packet.PUBACK{FixedHeader: &packet.FixedHeader{Version: packet.VERSION500, Kind: PUBACK}, PacketID: first.PacketID})
+	if _, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.PUBLISH); !ok {
+		t.Fatal("expected the queued PUBLISH after PUBACK")
+	}
+}
+
+func TestInboundReceiveMaximum(t *testing.T) {
+	s := NewServer(context.Background())
+	s.ReceiveMaximum = 1
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader:  &packet.FixedHeader{Version: packet.VERSION500},
+		ConnectFlags: packet.ConnectFlags(0x02),
+		ClientID:     "fast",
+		Props:        &packet.ConnectProperties{},
+	})
+	if connack.Props.ReceiveMaximum != 1 {
+		t.Fatalf("CONNACK ReceiveMaximum = %d, want 1", connack.Props.ReceiveMaximum)
+	}
+
+	publish := func(id uint16) {
+		writeTestPacket(t, rw, &packet.PUBLISH{
+			FixedHeader: &packet.FixedHeader{Version: packet.VERSION500, Kind: PUBLISH, QoS: 2},
+			PacketID:    id,
+			Message:     &packet.Message{TopicName: "a/b"},
+		})
+	}
+	publish(1)
+	if _, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.PUBREC); !ok {
+		t.Fatal("expected PUBREC")
+	}
+	// 第一条QoS2消息还没有收到PUBREL, 第二条消息超过了服务端的接收最大值
+	publish(2)
+	disconnect, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.DISCONNECT)
+	if !ok || disconnect.ReasonCode.Code != packet.ErrReceiveMaximum.Code {
+		t.Fatalf("expected DISCONNECT 0x93, got %v", disconnect)
+	}
+}
+
+func TestMaxPacketSizeInbound(t *testing.T) {
+	s := NewServer(context.Background())
+	s.MaxPacketSize = 128
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader:  &packet.FixedHeader{Version: packet.VERSION500},
+		ConnectFlags: packet.ConnectFlags(0x02),
+		ClientID:     "big",
+		Props:        &packet.ConnectProperties{},
+	})
+	if connack.Props.MaximumPacketSize != 128 {
+		t.Fatalf("CONNACK MaximumPacketSize = %d, want 128", connack.Props.MaximumPacketSize)
+	}
+	// 只发送固定报头, 剩余长度为200, 服务端不会等待剩余部分
+	_ = rw.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := rw.Write([]byte{0x30, 0xC8, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	disconnect, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.DISCONNECT)
+	if !ok || disconnect.ReasonCode.Code != packet.ErrPacketTooLarge.Code {
+		t.Fatalf("expected DISCONNECT 0x95, got %v", disconnect)
+	}
+}
+
+func TestMaxPacketSizeOutbound(t *testing.T) {
+	s := NewServer(context.Background())
+	rw := connectTestServer5(t, s, &packet.CONNECT{ClientID: "small", Props: &packet.ConnectProperties{MaximumPacketSize: 64}},
+		packet.Subscription{TopicFilter: "a/b", MaximumQoS: 1})
+
+	go func() {
+		for _, n := range []int{100, 10} {
+			_ = s.publish(&packet.PUBLISH{
+				FixedHeader: &packet.FixedHeader{Kind: PUBLISH, QoS: 1},
+				Message:     &packet.Message{TopicName: "a/b", Content: bytes.Repeat([]byte("x"), n)},
+			})
+		}
+	}()
+	// 超过客户端最大报文长度的消息被丢弃, 只收到第二条消息 [MQTT-3.1.2-25]
+	pub, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.PUBLISH)
+	if !ok || len(pub.Message.Content) != 10 {
+		t.Fatalf("expected the small PUBLISH, got %v", pub)
+	}
+}
+
+func TestSubscriptionIdentifiers(t *testing.T) {
+	s := NewServer(context.Background())
+	_ = s.publish(&packet.PUBLISH{
+		FixedHeader: &packet.FixedHeader{Kind: PUBLISH, Retain: 1},
+		Message:     &packet.Message{TopicName: "r/x", Content: []byte("retained")},
+	})
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader:  &packet.FixedHeader{Version: packet.VERSION500},
+		ConnectFlags: packet.ConnectFlags(0x02),
+		ClientID:     "sub",
+		Props:        &packet.ConnectProperties{},
+	})
+	if connack.Props.SubscriptionIdentifierAvailable == nil || *connack.Props.SubscriptionIdentifierAvailable != 1 {
+		t.Fatal("CONNACK should advertise SubscriptionIdentifierAvailable=1")
+	}
+	for i, filter := range []string{"a/+", "a/#", "r/#"} {
+		writeTestPacket(t, rw, &packet.SUBSCRIBE{
+			FixedHeader:   &packet.FixedHeader{Version: packet.VERSION500, Kind: SUBSCRIBE, QoS: 1},
+			PacketID:      uint16(i + 1),
+			Props:         &packet.SubscribeProperties{SubscriptionIdentifier: packet.SubscriptionIdentifier(i + 1)},
+			Subscriptions: []packet.Subscription{{TopicFilter: filter}},
+		})
+		if _, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.SUBACK); !ok {
+			t.Fatal("expected SUBACK")
+		}
+	}
+	// 建立订阅时发送的保留消息包含该订阅的订阅标识符
+	pub, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.PUBLISH)
+	if !ok || pub.Props == nil || !slices.Equal(pub.Props.SubscriptionIdentifier, []uint32{3}) {
+		t.Fatalf("retained message should carry subscription identifier 3, got %v", pub)
+	}
+
+	for _, tc := range []struct {
+		topicName string
+		want      []uint32
+	}{
+		{"a/b", []uint32{1, 2}},
+		{"a/b/c", []uint32{2}},
+	} {
+		go func() {
+			_ = s.publish(&packet.PUBLISH{FixedHeader: &packet.FixedHeader{Kind: PUBLISH}, Message: &packet.Message{TopicName: tc.topicName}})
+		}()
+		pub, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.PUBLISH)
+		if !ok || pub.Props == nil || !slices.Equal(pub.Props.SubscriptionIdentifier, tc.want) {
+			t.Fatalf("%s: SubscriptionIdentifier = %v, want %v", tc.topicName, pub.Props, tc.want)
+		}
+	}
+}
+
+func TestNoLocal(t *testing.T) {
+	s := NewServer(context.Background())
+	self := connectTestServer5(t, s, &packet.CONNECT{ClientID: "self"}, packet.Subscription{TopicFilter: "chat/#", NoLocal: 1})
+	other := connectTestServer5(t, s, &packet.CONNECT{ClientID: "other"}, packet.Subscription{TopicFilter: "chat/#", NoLocal: 1})
+	selfCount, otherCount := countTestPublish(self, packet.VERSION500), countTestPublish(other, packet.VERSION500)
+
+	writeTestPacket(t, self, &packet.PUBLISH{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION500, Kind: PUBLISH},
+		Message:     &packet.Message{TopicName: "chat/room", Content: []byte("hi")},
+		Props:       &packet.PublishProperties{},
+	})
+	// 设置了No Local的订阅不会收到自己发布的消息 [MQTT-3.8.3-3]
+	if n := <-selfCount; n != 0 {
+		t.Errorf("publisher received %d of its own messages, want 0", n)
+	}
+	if n := <-otherCount; n != 1 {
+		t.Errorf("other subscriber received %d messages, want 1", n)
+	}
+}
+
+func TestNoLocalSharedSubscription(t *testing.T) {
+	s := NewServer(context.Background())
+	rw := connectTestServer5(t, s, &packet.CONNECT{ClientID: "c"})
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION500, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{TopicFilter: "$share/g/a", NoLocal: 1}},
+	})
+	// 共享订阅设置No Local选项是协议错误 [MQTT-3.8.3-4]
+	disconnect, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.DISCONNECT)
+	if !ok || disconnect.ReasonCode.Code != packet.ErrProtocolErr.Code {
+		t.Fatalf("expected DISCONNECT with 0x82, got %v", disconnect)
+	}
+}
+
+func TestSubscribeInvalidFilter(t *testing.T) {
+	// 不符合协议规则的主题过滤器: v3.1.1返回0x80(Failure), v5.0返回0x8F(Topic Filter invalid)
+	for _, tc := range []struct {
+		version byte
+		want    uint8
+	}{
+		{packet.VERSION311, 0x80},
+		{packet.VERSION500, 0x8F},
+	} {
+		s := NewServer(context.Background())
+		var rw net.Conn
+		if tc.version == packet.VERSION500 {
+			rw = connectTestServer5(t, s, &packet.CONNECT{ClientID: "c"})
+		} else {
+			rw, _ = connectTestServer(t, s, &packet.CONNECT{ClientID: "c"})
+		}
+		writeTestPacket(t, rw, &packet.SUBSCRIBE{
+			FixedHeader:   &packet.FixedHeader{Version: tc.version, Kind: SUBSCRIBE, QoS: 1},
+			PacketID:      1,
+			Subscriptions: []packet.Subscription{{TopicFilter: "a/#/b"}, {TopicFilter: "a/b", MaximumQoS: 1}},
+		})
+		suback, ok := readTestPacket(t, rw, tc.version).(*packet.SUBACK)
+		if !ok {
+			t.Fatalf("v%d: expected SUBACK", tc.version)
+		}
+		var codes []uint8
+		for _, reason := range suback.ReasonCode {
+			codes = append(codes, reason.Code)
+		}
+		if want := []uint8{tc.want, 0x01}; !slices.Equal(codes, want) {
+			t.Errorf("v%d: SUBACK reason codes = %#v, want %#v", tc.version, codes, want)
+		}
+	}
+}
+
+func TestUnsubscribeNoSubscriptionExisted(t *testing.T) {
+	s := NewServer(context.Background())
+	rw := connectTestServer5(t, s, &packet.CONNECT{ClientID: "c"}, packet.Subscription{TopicFilter: "a/b/c"}, packet.Subscription{TopicFilter: "$share/g/a/b/c"})
+	writeTestPacket(t, rw, &packet.UNSUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION500, Kind: UNSUBSCRIBE, QoS: 1},
+		PacketID:      2,
+		Subscriptions: []packet.Subscription{{TopicFilter: "a/b/c"}, {TopicFilter: "a/b"}, {TopicFilter: "a/b/c"}, {TopicFilter: "$share/g/a/b/c"}, {TopicFilter: "$share/h/a/b/c"}},
+	})
+	// 每个主题过滤器对应一个原因码, 没有订阅的主题过滤器返回0x11
+	unsuback, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.UNSUBACK)
+	if !ok || unsuback.PacketID != 2 {
+		t.Fatalf("expected UNSUBACK, got %v", unsuback)
+	}
+	var codes []uint8
+	for _, reason := range unsuback.ReasonCode {
+		codes = append(codes, reason.Code)
+	}
+	if want := []uint8{0x00, 0x11, 0x11, 0x00, 0x11}; !slices.Equal(codes, want) {
+		t.Errorf("UNSUBACK reason codes = %#v, want %#v", codes, want)
+	}
+	if got := s.memorySubscribed.trie().Match("a/b/c"); len(got) != 0 {
+		t.Errorf("Match = %v, the subscription should be removed", got)
+	}
+}
+
+func TestPacketBeforeConnect(t *testing.T) {
+	s := NewServer(context.Background())
+	_, _ = subscribeTestServer(t, s, "sub", packet.Subscription{TopicFilter: "a/b"})
+
+	// 第一个报文不是CONNECT时服务端关闭网络连接, 不处理该报文 [MQTT-3.1.0-1]
+	rw := dialTestServer(t, s)
+	writeTestPacket(t, rw, &packet.PUBLISH{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBLISH, QoS: 1},
+		PacketID:    1,
+		Message:     &packet.Message{TopicName: "a/b"},
+	})
+	_ = rw.SetReadDeadline(time.Now().Add(time.Second))
+	if pkt, err := packet.Unpack(packet.VERSION311, rw); err == nil {
+		t.Fatalf("expected the connection to be closed, got %v", pkt)
+	}
+	if n := s.sessions.Len(); n != 1 {
+		t.Errorf("sessions = %d, want 1", n)
+	}
+}
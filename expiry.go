@@ -0,0 +1,38 @@
+package mqtt
+
+import (
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+// stampExpiry 服务端收到消息时, 根据消息过期间隔记录消息的过期时间
+//
+// MQTT v5.0: 参考章节 3.3.2.3.3 Message Expiry Interval
+// - 消息过期间隔不存在时, 消息不会过期
+// - 消息过期间隔已过, 服务端还没有开始向订阅者转发时, 必须删除该订阅者的消息副本 [MQTT-3.3.2-5]
+func stampExpiry(pub *packet.PUBLISH, now time.Time) {
+	if !pub.ExpiresAt.IsZero() || pub.Props == nil || pub.Props.MessageExpiryInterval == 0 {
+		return
+	}
+	pub.ExpiresAt = now.Add(time.Duration(pub.Props.MessageExpiryInterval.Uint32()) * time.Second)
+}
+
+// expired 判断消息是否已经过期
+func expired(pub *packet.PUBLISH, now time.Time) bool {
+	return !pub.ExpiresAt.IsZero() && !now.Before(pub.ExpiresAt)
+}
+
+// remainingExpiry 返回转发消息时使用的属性, 消息过期间隔为剩余的秒数; 不修改原报文的属性
+//
+// MQTT v5.0: 参考章节 3.3.2.3.3 Message Expiry Interval
+// - 服务端发送给客户端的消息过期间隔必须为收到的值减去消息在服务端等待的时间 [MQTT-3.3.2-6]
+func remainingExpiry(pub *packet.PUBLISH, now time.Time) *packet.PublishProperties {
+	if pub.ExpiresAt.IsZero() || pub.Props == nil {
+		return pub.Props
+	}
+	props := *pub.Props
+	// 向上取整, 避免剩余不足1秒时变成0(表示不会过期)
+	props.MessageExpiryInterval = packet.MessageExpiryInterval((pub.ExpiresAt.Sub(now) + time.Second - 1) / time.Second)
+	return &props
+}
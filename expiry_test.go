@@ -0,0 +1,84 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+func TestRemainingExpiry(t *testing.T) {
+	now := time.Now()
+	pub := newTestPublish("a/b", "x", 1)
+	pub.Props = &packet.PublishProperties{MessageExpiryInterval: 10}
+	stampExpiry(pub, now)
+	if !pub.ExpiresAt.Equal(now.Add(10 * time.Second)) {
+		t.Fatalf("ExpiresAt = %v, want now+10s", pub.ExpiresAt)
+	}
+
+	// 剩余6.5秒向上取整为7秒, 原报文的属性不变
+	props := remainingExpiry(pub, now.Add(3500*time.Millisecond))
+	if props.MessageExpiryInterval != 7 || pub.Props.MessageExpiryInterval != 10 {
+		t.Fatalf("remaining = %d, original = %d", props.MessageExpiryInterval, pub.Props.MessageExpiryInterval)
+	}
+	if expired(pub, now.Add(9*time.Second)) || !expired(pub, now.Add(10*time.Second)) {
+		t.Fatal("message should expire after 10 seconds")
+	}
+	if never := newTestPublish("a/b", "x", 1); expired(never, now.Add(time.Hour)) {
+		t.Fatal("message without expiry interval should never expire")
+	}
+}
+
+func TestExpiredOfflineMessage(t *testing.T) {
+	s := NewServer(context.Background())
+	connect := &packet.CONNECT{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION500},
+		ClientID:    "offline",
+		Props:       &packet.ConnectProperties{SessionExpiryInterval: SessionExpiryNever},
+	}
+	rw, _ := connectTestServer(t, s, connect)
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION500, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{TopicFilter: "a/b", MaximumQoS: 1}},
+	})
+	if _, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.SUBACK); !ok {
+		t.Fatal("expected SUBACK")
+	}
+	_ = rw.Close()
+	waitOffline(t, s, "offline")
+
+	stale := newTestPublish("a/b", "stale", 1)
+	stale.ExpiresAt = time.Now().Add(-time.Second)
+	fresh := newTestPublish("a/b", "fresh", 1)
+	fresh.Props = &packet.PublishProperties{MessageExpiryInterval: 60}
+	_ = s.publish(stale)
+	_ = s.publish(fresh)
+
+	// 离线期间过期的消息不再发送, 未过期的消息携带剩余的过期间隔
+	rw, connack := connectTestServer(t, s, connect)
+	if connack.SessionPresent != 1 {
+		t.Fatal("SessionPresent should be 1")
+	}
+	pub, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.PUBLISH)
+	if !ok || string(pub.Message.Content) != "fresh" {
+		t.Fatalf("expected the fresh message, got %v", pub)
+	}
+	if interval := pub.Props.MessageExpiryInterval; interval == 0 || interval > 60 {
+		t.Fatalf("MessageExpiryInterval = %d, want (0, 60]", interval)
+	}
+}
+
+func TestRetainedExpiry(t *testing.T) {
+	store := NewMemoryRetained()
+	pub := newTestPublish("a/b", "x", 0)
+	pub.ExpiresAt = time.Now().Add(-time.Second)
+	store.Store(pub)
+	if pubs := store.Match("a/b"); len(pubs) != 0 {
+		t.Fatalf("Match returned %d expired messages", len(pubs))
+	}
+	if _, ok := store.maps["a/b"]; ok {
+		t.Fatal("expired retained message should be deleted")
+	}
+}
@@ -5,6 +5,7 @@ go 1.23.0
 require (
 	github.com/golang-io/requests v0.0.0-20250808185721-b9686a6025a7
 	github.com/prometheus/client_golang v1.23.0
+	golang.org/x/crypto v0.41.0
 	golang.org/x/net v0.43.0
 	golang.org/x/sync v0.16.0
 )
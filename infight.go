@@ -1,8 +1,13 @@
 package mqtt
 
 import (
-	"github.com/golang-io/mqtt/packet"
+	"cmp"
+	"math"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
 )
 
 type InFight struct {
@@ -18,8 +23,8 @@ func newInFight() *InFight {
 }
 
 func (i *InFight) Get(id uint16) (*packet.PUBLISH, bool) {
-	i.mu.RLock()
-	defer i.mu.RUnlock()
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	pkt, ok := i.maps[id]
 	if ok {
 		delete(i.maps, id)
@@ -28,6 +33,20 @@ func (i *InFight) Get(id uint16) (*packet.PUBLISH, bool) {
 	return pkt, ok
 }
 
+// Has 判断报文标识符是否已经在会话状态中, 例如客户端重发DUP=1的QoS2消息
+func (i *InFight) Has(id uint16) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	_, ok := i.maps[id]
+	return ok
+}
+
+func (i *InFight) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return len(i.maps)
+}
+
 func (i *InFight) Put(pkt *packet.PUBLISH) bool {
 	i.mu.Lock()
 	defer i.mu.Unlock()
@@ -35,3 +54,163 @@ func (i *InFight) Put(pkt *packet.PUBLISH) bool {
 	i.maps[pkt.PacketID] = pkt
 	return true
 }
+
+// outFlight 服务端发送给客户端, 还没有完成确认的QoS1和QoS2消息
+//
+// MQTT v3.1.1: 参考章节 4.3 Quality of Service levels and protocol flows, 4.4 Message delivery retry
+// MQTT v5.0: 参考章节 4.3 Quality of Service levels and protocol flows, 4.4 Message delivery retry
+// - QoS1: PUBLISH -> PUBACK
+// - QoS2: PUBLISH -> PUBREC -> PUBREL -> PUBCOMP
+// - 客户端使用CleanStart=0重连时, 服务端必须按原来的顺序重发未确认的PUBLISH(DUP=1)和PUBREL [MQTT-4.4.0-1]
+//
+// MQTT v5.0: 参考章节 3.3.4 PUBLISH Actions, 4.9 Flow Control
+// - 未确认的QoS1, QoS2消息数量不能超过对端的接收最大值(Receive Maximum) [MQTT-3.3.4-7]
+// - 超过接收最大值的消息进入等待队列, 收到确认后按顺序发送
+type outFlight struct {
+	ids     packetIDs
+	mu      sync.Mutex
+	seq     uint64
+	window  int // 对端的接收最大值
+	maps    map[uint16]*outMessage
+	pending offlineQueue[*packet.PUBLISH] // 等待发送窗口的消息
+}
+
+type outMessage struct {
+	pub      *packet.PUBLISH
+	released bool      // QoS2: 已经收到PUBREC并发送了PUBREL, 等待PUBCOMP
+	seq      uint64    // 发送顺序, 重发时保持原来的顺序
+	sentAt   time.Time // 最近一次发送的时间
+}
+
+func newOutFlight() *outFlight {
+	return &outFlight{window: math.MaxUint16, maps: make(map[uint16]*outMessage)}
+}
+
+// setReceiveMaximum 设置对端的接收最大值, 0表示使用默认值65535
+func (o *outFlight) setReceiveMaximum(n uint16) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.window = int(n)
+	if n == 0 {
+		o.window = math.MaxUint16
+	}
+}
+
+// put 为消息分配报文标识符并保存, 直到收到确认. 返回false表示发送窗口已满, 消息进入等待队列,
+// 等待队列的长度和溢出策略由maxPending和overflow决定; 没有可用的报文标识符时返回false和 ErrPacketIDExhausted, 消息不能发送
+func (o *outFlight) put(pub *packet.PUBLISH, maxPending int, overflow QueueOverflow) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// 已有消息在等待时, 新的消息也必须排队, 保证发送顺序
+	if len(o.maps) >= o.window || o.pending.Len() > 0 {
+		_, err := o.pending.push(pub, maxPending, overflow)
+		return false, err
+	}
+	if err := o.store(pub); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// next 发送窗口有空闲时, 取出等待队列中的下一条消息并分配报文标识符; 没有可以发送的消息时返回nil
+func (o *outFlight) next() *packet.PUBLISH {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.maps) >= o.window {
+		return nil
+	}
+	pub, ok := o.pending.shift()
+	// 等待发送窗口期间过期的消息还没有开始转发, 直接丢弃 [MQTT-3.3.2-5]
+	for now := time.Now(); ok && expired(pub, now); pub, ok = o.pending.shift() {
+		stat.ExpiredDropped.Inc()
+	}
+	if !ok {
+		return nil
+	}
+	if err := o.store(pub); err != nil {
+		o.pending.requeue([]*packet.PUBLISH{pub})
+		return nil
+	}
+	return pub
+}
+
+// store 分配报文标识符并保存消息. 发送时会修改报文的固定报头, 因此这里保存一份副本
+func (o *outFlight) store(pub *packet.PUBLISH) error {
+	id, err := o.ids.next()
+	if err != nil {
+		return err
+	}
+	pub.PacketID = id
+	stored, fixed := *pub, *pub.FixedHeader
+	stored.FixedHeader = &fixed
+	stat.InFlight.Inc()
+	o.seq++
+	o.maps[pub.PacketID] = &outMessage{pub: &stored, seq: o.seq, sentAt: time.Now()}
+	return nil
+}
+
+// ack 收到PUBACK(QoS1)或者PUBCOMP(QoS2)后删除消息, 返回报文标识符是否存在
+func (o *outFlight) ack(id uint16) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, ok := o.maps[id]
+	if ok {
+		delete(o.maps, id)
+		o.ids.release(id)
+		stat.InFlight.Dec()
+	}
+	return ok
+}
+
+// release 收到QoS2消息的PUBREC, 之后只需要等待PUBCOMP; 返回报文标识符是否存在
+func (o *outFlight) release(id uint16) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	msg, ok := o.maps[id]
+	if ok {
+		msg.released, msg.sentAt = true, time.Now()
+	}
+	return ok
+}
+
+// retry 按发送顺序返回在before之前发送的消息, 并把它们的发送时间更新为当前时间.
+// 已经过期的QoS1消息不再重发; QoS2消息的接收方可能已经保存了该报文标识符, 仍然需要完成确认流程
+func (o *outFlight) retry(before time.Time) []outMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var msgs []outMessage
+	now := time.Now()
+	for id, msg := range o.maps {
+		if msg.pub.QoS == 1 && expired(msg.pub, now) {
+			delete(o.maps, id)
+			o.ids.release(id)
+			stat.InFlight.Dec()
+			stat.ExpiredDropped.Inc()
+			continue
+		}
+		if msg.sentAt.Before(before) {
+			msg.sentAt = now
+			msgs = append(msgs, *msg)
+		}
+	}
+	slices.SortFunc(msgs, func(a, b outMessage) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	return msgs
+}
+
+// clear 会话被丢弃时清空未确认的消息
+func (o *outFlight) clear() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stat.InFlight.Sub(float64(len(o.maps)))
+	clear(o.maps)
+	o.ids.reset()
+	o.pending.drain()
+}
+
+func (o *outFlight) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.maps)
+}
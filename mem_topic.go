@@ -1,151 +1,195 @@
 package mqtt
 
 import (
-	"context"
 	"log"
-	"strings"
+	"slices"
 	"sync"
-	"time"
 
 	"github.com/golang-io/mqtt/packet"
-	"golang.org/x/sync/errgroup"
+	"github.com/golang-io/mqtt/topic"
 )
 
-type MemorySubscribed struct {
-	maps map[string]*TopicSubscribed
-	mu   sync.RWMutex
-	s    *Server
+// subscriber 全局订阅索引中的订阅者: 非共享订阅为会话本身, 共享订阅为会话在共享组中的成员
+type subscriber struct {
+	sess  *session
+	group string // 共享组名, 非共享订阅为空
 }
 
-func (m *MemorySubscribed) Print() {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	for _, sub := range m.maps {
-		log.Printf("[%s], conn=%d", sub.TopicName, len(sub.activeConn))
-	}
-}
+// TopicTrie 全局订阅索引的实现, 见 topic.Trie
+type TopicTrie int
 
-func (m *MemorySubscribed) Subscribe(c *conn) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	for _, ts := range m.maps {
-		ts.Subscribe(c)
-	}
-}
+const (
+	// TopicTrieLocked 读写锁保护的订阅树, 订阅和取消订阅的开销小
+	TopicTrieLocked TopicTrie = iota
 
-func (m *MemorySubscribed) Unsubscribe(c *conn) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	for _, ts := range m.maps {
-		ts.Unsubscribe(c)
+	// TopicTrieCopyOnWrite 写时复制的订阅树, 匹配时不加锁, 适合发布远多于订阅变化的场景
+	TopicTrieCopyOnWrite
+)
+
+func (t TopicTrie) String() string {
+	switch t {
+	case TopicTrieLocked:
+		return "locked"
+	case TopicTrieCopyOnWrite:
+		return "copy-on-write"
+	default:
+		return "unknown"
 	}
 }
 
-// Publish 发布消息，如果是新topic需要额外处理存量connect订阅列表的构建
-func (m *MemorySubscribed) Publish(message *packet.Message, props *packet.PublishProperties) error {
-	m.mu.RLock()
-	sub, ok := m.maps[message.TopicName]
-	m.mu.RUnlock()
-	if !ok {
-		sub = NewTopicSubscribed(message.TopicName)
-		m.s.mu.RLock()
-		for c := range m.s.activeConn { // 如果是新的topic, 这里需要构建订阅列表!
-			sub.Subscribe(c)
-		}
-		m.s.mu.RUnlock()
-		m.mu.Lock()
-		m.maps[message.TopicName] = sub
-		m.mu.Unlock()
-	}
-	return sub.Exchange(message, props)
+// MemorySubscribed 服务端全局的订阅索引, 主题过滤器映射到订阅了它的会话和订阅选项.
+// 共享订阅 $share/{ShareName}/{filter} 按其中的主题过滤器保存在同一个索引中.
+// 会话的订阅在网络连接断开后仍然保留, 直到会话结束
+type MemorySubscribed struct {
+	once  sync.Once
+	index topic.Trie[subscriber, subscription] // 第一次使用时按 Server.TopicTrie 创建, 见 trie
+	s     *Server
 }
 
 func NewMemorySubscribed(s *Server) *MemorySubscribed {
-	m := &MemorySubscribed{
-		maps: make(map[string]*TopicSubscribed),
-		s:    s,
-	}
-	go m.CleanEmptyTopic()
-	return m
+	return &MemorySubscribed{s: s}
 }
 
-func (m *MemorySubscribed) CleanEmptyTopic() {
-	ticker := time.NewTicker(24 * time.Hour)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		m.mu.RLock()
-		var empty []string
-		for key, sub := range m.maps {
-			if sub.Len() == 0 {
-				empty = append(empty, key)
-			}
-		}
-		m.mu.RUnlock()
-
-		m.mu.Lock()
-		for _, key := range empty {
-			delete(m.maps, key)
+// trie 返回订阅索引; NewServer 之后才能设置 Server.TopicTrie, 因此在第一次使用时创建
+func (m *MemorySubscribed) trie() topic.Trie[subscriber, subscription] {
+	m.once.Do(func() {
+		if m.s.TopicTrie == TopicTrieCopyOnWrite {
+			m.index = topic.NewCopyOnWriteTrie[subscriber, subscription]()
+		} else {
+			m.index = topic.NewIndex[subscriber, subscription]()
 		}
-		m.mu.Unlock()
-	}
+	})
+	return m.index
 }
 
-// TopicSubscribed 用来存储当前topic有哪些客户端订阅了
-type TopicSubscribed struct {
-	TopicName  string
-	activeConn map[*conn]struct{}
-	// share      map[string]map[*conn]struct{} // 共享订阅, group: conn
-	mux sync.RWMutex
+// Subscribe 保存会话的订阅和订阅选项, 共享订阅同时加入共享组
+func (m *MemorySubscribed) Subscribe(sess *session, sub subscription) error {
+	group, filter, shared, err := parseShared(sub.TopicFilter)
+	if err != nil {
+		return err
+	}
+	existed, err := m.trie().Subscribe(filter, subscriber{sess: sess, group: group}, sub)
+	if err == nil && shared && !existed {
+		m.s.shared.join(sub.TopicFilter)
+	}
+	return err
 }
 
-func NewTopicSubscribed(topicName string) *TopicSubscribed {
-	if strings.Contains(topicName, "$share/") {
-
+// Unsubscribe 删除会话的订阅, 返回订阅之前是否存在
+func (m *MemorySubscribed) Unsubscribe(topicFilter string, sess *session) bool {
+	group, filter, shared, err := parseShared(topicFilter)
+	if err != nil {
+		return false
 	}
-	return &TopicSubscribed{
-		TopicName:  topicName,
-		activeConn: make(map[*conn]struct{}),
+	existed := m.trie().Unsubscribe(filter, subscriber{sess: sess, group: group})
+	if existed && shared {
+		m.s.shared.leave(topicFilter)
 	}
+	return existed
 }
 
-func (s *TopicSubscribed) Subscribe(c *conn) {
-	if _, ok := c.subscribeTopics.Find(s.TopicName); !ok {
-		return
+// remove 会话结束时删除会话的所有订阅
+func (m *MemorySubscribed) remove(sess *session) {
+	sess.subMu.RLock()
+	defer sess.subMu.RUnlock()
+	for topicFilter := range sess.subscriptions {
+		m.Unsubscribe(topicFilter, sess)
 	}
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	s.activeConn[c] = struct{}{}
 }
 
-func (s *TopicSubscribed) Len() int {
-	s.mux.RLock()
-	defer s.mux.RUnlock()
-	return len(s.activeConn)
+// target 消息需要转发的会话以及合并后的转发选项
+type target struct {
+	sess *session
+	d    delivery
 }
 
-func (s *TopicSubscribed) Unsubscribe(c *conn) int {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	delete(s.activeConn, c)
-	return len(s.activeConn)
+// match 按会话合并匹配主题名的非共享订阅, 并按共享组收集匹配的共享订阅
+//
+// MQTT v3.1.1: 参考章节 3.3.5 Server response to PUBLISH
+// MQTT v5.0: 参考章节 3.3.4 PUBLISH Actions
+// - 客户端的多个订阅匹配同一个主题名时, 服务端必须使用这些订阅中最大的QoS转发消息 [MQTT-3.3.5-1]
+// - 匹配的订阅中有订阅标识符时, 转发的消息必须包含这些订阅标识符 [MQTT-3.3.4-3]
+// - 订阅设置了No Local选项时, 应用消息不能转发给发布者自己 [MQTT-3.8.3-3]
+//
+// publisher 为发布者的ClientID, 服务端自己发布的消息为空
+func (m *MemorySubscribed) match(topicName, publisher string) ([]target, map[string][]shareCandidate) {
+	var targets []target
+	var groups map[string][]shareCandidate
+	seen := make(map[*session]int) // 会话在targets中的下标
+	for _, e := range m.trie().Match(topicName) {
+		sess, sub := e.Subscriber.sess, e.Value
+		if e.Subscriber.group != "" {
+			if groups == nil {
+				groups = make(map[string][]shareCandidate)
+			}
+			key := sharePrefix + e.Subscriber.group + "/" + e.Filter
+			groups[key] = append(groups[key], shareCandidate{sess: sess, sub: sub})
+			continue
+		}
+		if sub.NoLocal == 1 && publisher != "" && publisher == sess.clientID {
+			continue
+		}
+		i, ok := seen[sess]
+		if !ok {
+			i = len(targets)
+			seen[sess] = i
+			targets = append(targets, target{sess: sess})
+		}
+		targets[i].d.add(sub)
+	}
+	for i := range targets {
+		slices.Sort(targets[i].d.identifiers)
+	}
+	return targets, groups
 }
 
-func (s *TopicSubscribed) Exchange(message *packet.Message, props *packet.PublishProperties) error {
-	s.mux.RLock()
-	defer s.mux.RUnlock()
-	group, _ := errgroup.WithContext(context.Background())
-	for c := range s.activeConn {
-		response := &response{conn: c}
-		group.Go(func() error {
-			pub := &packet.PUBLISH{FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBLISH, Dup: 0, QoS: 1, Retain: 0}, Message: message, Props: props}
-			log.Printf("publish: topic=%s, qos=%d, retain=%d, message=%s, props=%v", message.TopicName, pub.QoS, pub.Retain, message.Content, props)
-			if pub.QoS > 0 {
-				pub.PacketID = c.PacketID + 1
-				c.PacketID = pub.PacketID
+// Publish 将消息放入所有匹配订阅的在线会话的发送队列, 离线会话的消息进入离线队列;
+// 每个匹配的共享订阅只选择一个会话
+//
+// 会话的绑定状态在 sessions.mu 内读取, 放入发送队列在释放锁之后进行, 不会因为某个会话阻塞其他发布者.
+// 只有所有匹配的会话都拒绝了消息时才返回错误: 发布者收到错误后可能重发, 已经接收消息的会话会收到重复的消息
+func (m *MemorySubscribed) Publish(pub *packet.PUBLISH, publisher string) error {
+	var err error
+	accepted := false
+	targets, groups := m.match(pub.Message.TopicName, publisher)
+	online := make([]*conn, len(targets))
+	sessions := m.s.sessions
+	sessions.mu.Lock()
+	for i, t := range targets {
+		if sessions.maps[t.sess.clientID] != t.sess { // 会话已经结束或者被新的会话替换
+			continue
+		}
+		if t.sess.conn != nil {
+			online[i] = t.sess.conn
+			continue
+		}
+		if qerr := m.s.enqueue(t.sess, pub, t.d); qerr == nil {
+			accepted = true
+		} else if err == nil {
+			err = qerr
+		}
+	}
+	sessions.mu.Unlock()
+
+	for i, c := range online {
+		if c == nil {
+			continue
+		}
+		if derr := m.s.deliverTo(targets[i].sess, c, pub, targets[i].d); derr != nil {
+			log.Printf("publish: clientId=%s, topic=%s, err=%v", targets[i].sess.clientID, pub.Message.TopicName, derr)
+			if err == nil {
+				err = derr
 			}
-			return response.OnSend(pub)
-		})
+			continue
+		}
+		accepted = true
+	}
+	shared, serr := m.s.publishShared(pub, publisher, groups)
+	if shared || accepted {
+		return nil
+	}
+	if err == nil {
+		err = serr
 	}
-	return group.Wait()
+	return err
 }
@@ -2,6 +2,10 @@ package mqtt
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
 	"testing"
 
 	"github.com/golang-io/mqtt/packet"
@@ -16,229 +20,240 @@ func TestNewMemorySubscribed(t *testing.T) {
 	if memorySub == nil {
 		t.Fatal("NewMemorySubscribed() should return a non-nil instance")
 	}
-	if memorySub.maps == nil {
-		t.Fatal("maps should be initialized")
-	}
 	if memorySub.s != server {
 		t.Error("should reference the server")
 	}
 }
 
+func TestMemorySubscribedTopicTrie(t *testing.T) {
+	for _, impl := range []TopicTrie{TopicTrieLocked, TopicTrieCopyOnWrite} {
+		t.Run(impl.String(), func(t *testing.T) {
+			s := NewServer(context.Background())
+			s.TopicTrie = impl
+			switch trie := s.memorySubscribed.trie().(type) {
+			case *topic.Index[subscriber, subscription]:
+				if impl != TopicTrieLocked {
+					t.Errorf("trie = %T, want copy-on-write", trie)
+				}
+			case *topic.CopyOnWriteTrie[subscriber, subscription]:
+				if impl != TopicTrieCopyOnWrite {
+					t.Errorf("trie = %T, want locked", trie)
+				}
+			}
+
+			sess := newSession("c")
+			subscribeTest(t, s, sess, packet.Subscription{TopicFilter: "a/+", MaximumQoS: 1})
+			subscribeTest(t, s, sess, packet.Subscription{TopicFilter: "$share/g/a/#"})
+			targets, groups := s.memorySubscribed.match("a/b", "")
+			if len(targets) != 1 || targets[0].d.qos != 1 || len(groups["$share/g/a/#"]) != 1 {
+				t.Errorf("match(a/b) = %+v, %v", targets, groups)
+			}
+			if !s.memorySubscribed.Unsubscribe("a/+", sess) || s.memorySubscribed.Unsubscribe("a/+", sess) {
+				t.Error("a/+ should be unsubscribed exactly once")
+			}
+		})
+	}
+}
+
 func TestMemorySubscribedPublish(t *testing.T) {
 	ctx := context.Background()
 	server := NewServer(ctx)
 	memorySub := NewMemorySubscribed(server)
 
-	// Test publishing to a new topic
+	// 没有订阅者的主题不会在索引中留下记录
 	message := &packet.Message{
 		TopicName: "test/topic",
 		Content:   []byte("test message"),
 	}
-
-	err := memorySub.Publish(message, nil)
+	err := memorySub.Publish(&packet.PUBLISH{FixedHeader: &packet.FixedHeader{Kind: PUBLISH}, Message: message}, "")
 	if err != nil {
 		t.Errorf("Publish should not return error, got %v", err)
 	}
+	if len(memorySub.trie().Match("test/topic")) != 0 {
+		t.Error("publish should not create subscribers")
+	}
+}
 
-	// Check that the topic was created
-	memorySub.mu.RLock()
-	_, exists := memorySub.maps["test/topic"]
-	memorySub.mu.RUnlock()
-
-	if !exists {
-		t.Error("topic should be created after publish")
+// subscribeTest 保存会话的订阅并加入全局订阅索引
+func subscribeTest(t *testing.T, s *Server, sess *session, sub packet.Subscription) {
+	t.Helper()
+	if _, err := sess.subscribe(sub, 0); err != nil {
+		t.Fatalf("subscribe(%q): %v", sub.TopicFilter, err)
+	}
+	if err := s.memorySubscribed.Subscribe(sess, subscription{Subscription: sub}); err != nil {
+		t.Fatalf("Subscribe(%q): %v", sub.TopicFilter, err)
 	}
 }
 
-func TestMemorySubscribedPublishExistingTopic(t *testing.T) {
+func TestMemorySubscribedSubscribeUnsubscribe(t *testing.T) {
 	ctx := context.Background()
 	server := NewServer(ctx)
-	memorySub := NewMemorySubscribed(server)
-
-	// Publish to create topic
-	message1 := &packet.Message{
-		TopicName: "test/topic",
-		Content:   []byte("test message 1"),
+	memorySub := server.memorySubscribed
+	sess := newSession("test")
+
+	subscribeTest(t, server, sess, packet.Subscription{TopicFilter: "test/+"})
+	subscribeTest(t, server, sess, packet.Subscription{TopicFilter: "test/#"})
+	// 同一个会话的多个主题过滤器匹配同一个主题名时合并为一个转发目标
+	if targets, _ := memorySub.match("test/topic", ""); len(targets) != 1 || targets[0].sess != sess {
+		t.Fatalf("match = %v, want [sess]", targets)
 	}
-	memorySub.Publish(message1, nil)
-
-	// Publish to same topic again
-	message2 := &packet.Message{
-		TopicName: "test/topic",
-		Content:   []byte("test message 2"),
+	// 共享订阅按其中的主题过滤器保存在同一个索引中
+	subscribeTest(t, server, sess, packet.Subscription{TopicFilter: "$share/g/test/topic"})
+	if _, groups := memorySub.match("test/topic", ""); len(groups["$share/g/test/topic"]) != 1 {
+		t.Errorf("shared groups = %v, want one member in $share/g/test/topic", groups)
 	}
-	err := memorySub.Publish(message2, nil)
-	if err != nil {
-		t.Errorf("Publish to existing topic should not return error, got %v", err)
+	if !memorySub.Unsubscribe("$share/g/test/topic", sess) {
+		t.Error("Unsubscribe should report the shared subscription")
+	}
+	if n := len(server.shared.groups); n != 0 {
+		t.Errorf("shared groups = %d, empty groups should be deleted", n)
 	}
-}
-
-func TestTopicSubscribedNew(t *testing.T) {
-	ts := NewTopicSubscribed("test/topic")
 
-	if ts == nil {
-		t.Fatal("NewTopicSubscribed() should return a non-nil instance")
+	if !memorySub.Unsubscribe("test/+", sess) {
+		t.Error("Unsubscribe should report the existing subscription")
+	}
+	if memorySub.Unsubscribe("test/+", sess) {
+		t.Error("Unsubscribe twice should report no subscription")
 	}
-	if ts.TopicName != "test/topic" {
-		t.Errorf("expected topic name 'test/topic', got %s", ts.TopicName)
+	if len(memorySub.trie().Match("test/topic")) != 1 {
+		t.Error("test/# should still match")
 	}
-	if ts.activeConn == nil {
-		t.Fatal("activeConn should be initialized")
+	if err := memorySub.Subscribe(sess, subscription{Subscription: packet.Subscription{TopicFilter: "test/#/x"}}); err == nil {
+		t.Error("invalid topic filter should be rejected")
 	}
 }
 
-func TestTopicSubscribedSubscribe(t *testing.T) {
-	ts := NewTopicSubscribed("test/topic")
-
-	// Create a mock connection
-	mockConn := &conn{
-		subscribeTopics: topic.NewMemoryTrie(),
+func TestMemorySubscribedMatch(t *testing.T) {
+	s := NewServer(context.Background())
+	sess := newSession("c")
+	subscribeTest(t, s, sess, packet.Subscription{TopicFilter: "a/+", MaximumQoS: 1, RetainAsPublished: 1})
+	subscribeTest(t, s, sess, packet.Subscription{TopicFilter: "b/#"})
+	match := func(topicName, publisher string) (delivery, bool) {
+		targets, _ := s.memorySubscribed.match(topicName, publisher)
+		if len(targets) == 0 {
+			return delivery{}, false
+		}
+		return targets[0].d, true
 	}
-	mockConn.subscribeTopics.Subscribe("test/topic")
-
-	// Subscribe the connection
-	ts.Subscribe(mockConn)
-
-	if len(ts.activeConn) != 1 {
-		t.Error("connection should be subscribed")
+	if d, ok := match("a/b", ""); !ok || d.qos != 1 || !d.retainAsPublished {
+		t.Errorf("match(a/b) = %+v, %v", d, ok)
 	}
-
-	// Test subscribing same connection again (should not duplicate)
-	ts.Subscribe(mockConn)
-	if len(ts.activeConn) != 1 {
-		t.Error("should not duplicate connection")
+	if d, ok := match("b/c", ""); !ok || d.qos != 0 || d.retainAsPublished {
+		t.Errorf("match(b/c) = %+v, %v", d, ok)
 	}
-}
-
-func TestTopicSubscribedUnsubscribe(t *testing.T) {
-	ts := NewTopicSubscribed("test/topic")
-
-	// Create a mock connection
-	mockConn := &conn{
-		subscribeTopics: topic.NewMemoryTrie(),
+	if _, ok := match("c", ""); ok {
+		t.Error("c should not match any subscription")
 	}
-	mockConn.subscribeTopics.Subscribe("test/topic")
 
-	// Subscribe then unsubscribe
-	ts.Subscribe(mockConn)
-	remaining := ts.Unsubscribe(mockConn)
-
-	if remaining != 0 {
-		t.Errorf("expected 0 remaining connections, got %d", remaining)
+	// 重叠的订阅使用最大的QoS
+	subscribeTest(t, s, sess, packet.Subscription{TopicFilter: "a/#", MaximumQoS: 2})
+	if d, _ := match("a/b", ""); d.qos != 2 {
+		t.Errorf("overlapping subscriptions: qos = %d, want 2", d.qos)
 	}
 
-	if len(ts.activeConn) != 0 {
-		t.Error("connection should be unsubscribed")
+	// 替换的订阅使用新的订阅选项
+	if existed, _ := sess.subscribe(packet.Subscription{TopicFilter: "a/+"}, 0); !existed {
+		t.Error("subscribe should report the existing subscription")
+	}
+	subscribeTest(t, s, sess, packet.Subscription{TopicFilter: "a/+"})
+	if d, _ := match("a/b", ""); d.retainAsPublished {
+		t.Error("the replaced subscription should not keep the retain flag")
 	}
 }
 
-func TestTopicSubscribedLen(t *testing.T) {
-	ts := NewTopicSubscribed("test/topic")
-
-	// Initially should be 0
-	if ts.Len() != 0 {
-		t.Errorf("expected length 0, got %d", ts.Len())
+func TestMemorySubscribedMatchNoLocal(t *testing.T) {
+	s := NewServer(context.Background())
+	sess := newSession("c")
+	subscribeTest(t, s, sess, packet.Subscription{TopicFilter: "a/#", NoLocal: 1})
+	if targets, _ := s.memorySubscribed.match("a/b", "c"); len(targets) != 0 {
+		t.Error("No Local subscription should not match the publisher's own message")
 	}
-
-	// Add a connection
-	mockConn := &conn{
-		subscribeTopics: topic.NewMemoryTrie(),
+	if targets, _ := s.memorySubscribed.match("a/b", "other"); len(targets) != 1 {
+		t.Error("No Local subscription should match messages from other clients")
 	}
-	mockConn.subscribeTopics.Subscribe("test/topic")
-	ts.Subscribe(mockConn)
 
-	if ts.Len() != 1 {
-		t.Errorf("expected length 1, got %d", ts.Len())
+	// 重叠的订阅中没有设置No Local的订阅仍然转发
+	subscribeTest(t, s, sess, packet.Subscription{TopicFilter: "a/+", MaximumQoS: 1})
+	if targets, _ := s.memorySubscribed.match("a/b", "c"); len(targets) != 1 || targets[0].d.qos != 1 {
+		t.Errorf("match(a/b) = %+v", targets)
 	}
 }
 
-func TestTopicSubscribedExchange(t *testing.T) {
-	ts := NewTopicSubscribed("test/topic")
-
-	// Create a mock connection
-	mockConn := &conn{
-		subscribeTopics: topic.NewMemoryTrie(),
-		version:         packet.VERSION311,
-		PacketID:        0,
+func TestMemorySubscribedSessionEnded(t *testing.T) {
+	s := NewServer(context.Background())
+	c := &conn{ID: "test"}
+	sess, _ := s.sessions.attach(c, false, 0)
+	for _, filter := range []string{"a/b", "a/#", "$share/g/a/b"} {
+		subscribeTest(t, s, sess, packet.Subscription{TopicFilter: filter})
 	}
-	mockConn.subscribeTopics.Subscribe("test/topic")
-	ts.Subscribe(mockConn)
 
-	// Exchange a message - this will start a goroutine that tries to send
-	// We'll just test that it doesn't panic
-	message := &packet.Message{
-		TopicName: "test/topic",
-		Content:   []byte("test message"),
+	// 会话结束后它的订阅从全局索引中删除
+	s.sessions.detach(c)
+	if got := s.memorySubscribed.trie().Match("a/b"); len(got) != 0 {
+		t.Errorf("Match = %v, want none after the session ended", got)
 	}
-
-	// This should not panic even though the connection is not fully initialized
-	defer func() {
-		if r := recover(); r != nil {
-			t.Logf("Exchange panicked (expected in test): %v", r)
-		}
-	}()
-
-	ts.Exchange(message, nil)
-}
-
-func TestMemorySubscribedCleanEmptyTopic(t *testing.T) {
-	ctx := context.Background()
-	server := NewServer(ctx)
-	memorySub := NewMemorySubscribed(server)
-
-	// Create a topic with no subscribers
-	message := &packet.Message{
-		TopicName: "empty/topic",
-		Content:   []byte("test message"),
+	if n := len(s.shared.groups); n != 0 {
+		t.Errorf("shared groups = %d, want none after the session ended", n)
 	}
-	memorySub.Publish(message, nil)
-
-	// Verify topic exists
-	memorySub.mu.RLock()
-	_, exists := memorySub.maps["empty/topic"]
-	memorySub.mu.RUnlock()
-
-	if !exists {
-		t.Error("topic should exist after publish")
-	}
-
-	// Note: The actual cleanup happens in a goroutine with a 24-hour ticker
-	// so we can't easily test it in a unit test without mocking time
-	// This test just verifies the structure is set up correctly
 }
 
-func TestMemorySubscribedSubscribeUnsubscribe(t *testing.T) {
-	ctx := context.Background()
-	server := NewServer(ctx)
-	memorySub := NewMemorySubscribed(server)
+func TestMemorySubscribedRouting(t *testing.T) {
+	s := NewServer(context.Background())
+	rw, _ := subscribeTestServer(t, s, "sub", packet.Subscription{TopicFilter: "a/+", MaximumQoS: 1})
 
-	// Create a mock connection
-	mockConn := &conn{
-		subscribeTopics: topic.NewMemoryTrie(),
+	go func() { _ = s.publish(newTestPublish("a/b", "x", 1)) }()
+	pub, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+	if !ok || pub.Message.TopicName != "a/b" || string(pub.Message.Content) != "x" {
+		t.Fatalf("expected PUBLISH a/b, got %v", pub)
 	}
-
-	// Subscribe all topics to the connection
-	memorySub.Subscribe(mockConn)
-
-	// Unsubscribe all topics from the connection
-	memorySub.Unsubscribe(mockConn)
-
-	// This should not cause any errors
 }
 
-func TestTopicSubscribedSubscribeWithoutMatchingTopic(t *testing.T) {
-	ts := NewTopicSubscribed("test/topic")
-
-	// Create a mock connection that doesn't subscribe to this topic
-	mockConn := &conn{
-		subscribeTopics: topic.NewMemoryTrie(),
-	}
-	mockConn.subscribeTopics.Subscribe("different/topic")
-
-	// Try to subscribe - should not add the connection
-	ts.Subscribe(mockConn)
-
-	if len(ts.activeConn) != 0 {
-		t.Error("should not subscribe connection to non-matching topic")
+// BenchmarkPublishChurn 在订阅持续变化的同时并发发布消息, 比较全局订阅索引的实现
+func BenchmarkPublishChurn(b *testing.B) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	for _, impl := range []TopicTrie{TopicTrieLocked, TopicTrieCopyOnWrite} {
+		b.Run(impl.String(), func(b *testing.B) {
+			s := NewServer(context.Background())
+			s.TopicTrie = impl
+			for i := 0; i < 1000; i++ {
+				// 在线的订阅者, 发送队列放不下的QoS0消息直接丢弃
+				c := &conn{ID: fmt.Sprint("sub-", i), server: s, outbound: newOutboundQueue(1, OutboundDropQoS0)}
+				sess, _ := s.sessions.attach(c, true, 0)
+				_ = s.memorySubscribed.Subscribe(sess, subscription{Subscription: packet.Subscription{TopicFilter: fmt.Sprintf("device/%d/+/status", i)}})
+				_ = s.memorySubscribed.Subscribe(sess, subscription{Subscription: packet.Subscription{TopicFilter: fmt.Sprintf("device/%d/#", i)}})
+			}
+			churn := newSession("churn")
+			var stop atomic.Bool
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; !stop.Load(); i++ {
+					filter := fmt.Sprintf("churn/%d/+", i%100)
+					_ = s.memorySubscribed.Subscribe(churn, subscription{Subscription: packet.Subscription{TopicFilter: filter}})
+					s.memorySubscribed.Unsubscribe(filter, churn)
+				}
+			}()
+
+			pubs := make([]*packet.PUBLISH, 1000)
+			for i := range pubs {
+				pubs[i] = &packet.PUBLISH{
+					FixedHeader: &packet.FixedHeader{Kind: PUBLISH},
+					Message:     &packet.Message{TopicName: fmt.Sprintf("device/%d/sensor/status", i)},
+				}
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					_ = s.publishFrom("", pubs[i%len(pubs)])
+					i++
+				}
+			})
+			b.StopTimer()
+			stop.Store(true)
+			<-done
+		})
 	}
 }
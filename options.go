@@ -20,6 +20,21 @@ type config struct {
 	WebSocket  Listen            `json:"Websocket"`
 	WebSockets Listen            `json:"Websockets"`
 	Auth       map[string]string `json:"Auth"`
+
+	// PasswordFile 密码文件路径, 设置后使用 PasswordFile 认证代替Auth中的明文密码
+	PasswordFile string `json:"PasswordFile"`
+
+	// ACLFile 访问控制列表文件路径, 格式见 ACL
+	ACLFile string `json:"ACLFile"`
+
+	// MaxKeepAlive 服务端允许的最大保持连接时间, 单位秒, 见 Server.MaxKeepAlive
+	MaxKeepAlive uint16 `json:"MaxKeepAlive"`
+
+	// MaxPacketSize 服务端接收的最大报文长度, 单位字节, 见 Server.MaxPacketSize
+	MaxPacketSize uint32 `json:"MaxPacketSize"`
+
+	// TopicAliasMaximum 服务端接受的客户端主题别名最大值, 见 Server.TopicAliasMaximum
+	TopicAliasMaximum uint16 `json:"TopicAliasMaximum"`
 }
 
 func (c *config) GetAuth(username string) (string, bool) {
@@ -39,6 +54,15 @@ type Options struct {
 	ClientID      string
 	Version       byte
 	Subscriptions []packet.Subscription
+
+	// QoS SubmitMessage 发布消息使用的QoS
+	QoS uint8
+
+	// ReceiveMaximum v5.0客户端愿意同时处理的QoS1, QoS2消息的最大数量, 0表示使用默认值65535
+	ReceiveMaximum uint16
+
+	// TopicAliases v5.0客户端发布消息时使用主题别名的主题名, 数量受服务端的主题别名最大值限制
+	TopicAliases []string
 }
 
 type Option func(*Options)
@@ -67,6 +91,27 @@ func Subscription(subscription ...packet.Subscription) Option {
 	}
 }
 
+// QoS 设置 SubmitMessage 发布消息使用的QoS
+func QoS(qos uint8) Option {
+	return func(o *Options) {
+		o.QoS = qos
+	}
+}
+
+// ReceiveMaximum 设置v5.0客户端的接收最大值, 在CONNECT中通知服务端
+func ReceiveMaximum(n uint16) Option {
+	return func(o *Options) {
+		o.ReceiveMaximum = n
+	}
+}
+
+// TopicAliases 设置v5.0客户端为频繁发布的主题使用主题别名, 减少重复发送的主题名
+func TopicAliases(topics ...string) Option {
+	return func(o *Options) {
+		o.TopicAliases = append(o.TopicAliases, topics...)
+	}
+}
+
 func Version[T ~string | ~byte](version T) Option {
 	return func(o *Options) {
 		switch v := any(version).(type) {
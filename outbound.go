@@ -0,0 +1,246 @@
+package mqtt
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+// DefaultMaxOutboundMessages 每个网络连接发送队列的默认最大长度
+const DefaultMaxOutboundMessages = 1000
+
+// errOutboundClosed 网络连接已经关闭, 发送队列不再接收消息
+var errOutboundClosed = errors.New("mqtt: outbound queue closed")
+
+// OutboundOverflow 网络连接的发送队列已满时的处理策略
+//
+// 发送队列保存已经匹配订阅、等待写入网络连接的消息. 客户端读取得太慢时队列会被填满,
+// 被断开的连接队列中剩余的消息回到会话, 会话保留时在客户端重连后发送
+type OutboundOverflow int
+
+const (
+	// OutboundDropQoS0 丢弃新到达的QoS0消息; QoS1, QoS2消息放不下时断开连接
+	OutboundDropQoS0 OutboundOverflow = iota
+
+	// OutboundDisconnect 任何消息放不下时断开连接
+	OutboundDisconnect
+)
+
+func (o OutboundOverflow) String() string {
+	switch o {
+	case OutboundDropQoS0:
+		return "drop-qos0"
+	case OutboundDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// outboundMessage 等待写入网络连接的消息
+type outboundMessage struct {
+	pub *packet.PUBLISH // 服务端收到的原始消息, 连接关闭后按会话的订阅重新转发
+	d   delivery
+
+	// resend 会话中已经分配了报文标识符的PUBLISH或者PUBREL报文, 原样发送; 连接关闭后仍然保存在会话中, 不需要转发
+	resend packet.Packet
+}
+
+// outboundQueue 网络连接的发送队列, 由单独的writer goroutine写入网络连接, 发布者不会被慢的客户端阻塞
+type outboundQueue struct {
+	mu         sync.Mutex
+	items      []outboundMessage
+	max        int
+	overflow   OutboundOverflow
+	overflowed bool          // 已经因为队列溢出断开连接, writer不再写入
+	started    bool          // 已经发送了CONNACK, writer可以开始写入
+	closed     bool          // 网络连接已经关闭
+	ready      chan struct{} // 有新的消息或者队列关闭
+}
+
+func newOutboundQueue(max int, overflow OutboundOverflow) *outboundQueue {
+	return &outboundQueue{max: max, overflow: overflow, ready: make(chan struct{}, 1)}
+}
+
+// push 消息入队; 返回值slow表示队列已满并且需要断开连接
+//
+// 断开连接时消息仍然入队, 连接关闭后和队列中剩余的消息一起回到会话
+func (q *outboundQueue) push(m outboundMessage) (slow bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false, errOutboundClosed
+	}
+	if len(q.items) >= q.max && !q.overflowed {
+		if q.overflow == OutboundDropQoS0 && min(m.pub.QoS, m.d.qos) == 0 {
+			stat.OutboundDropped.Inc()
+			return false, nil
+		}
+		q.overflowed, slow = true, true
+	}
+	q.items = append(q.items, m)
+	stat.OutboundQueued.Inc()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return slow, nil
+}
+
+// preload 恢复会话时放入需要重发的报文和离线期间积压的消息, 排在之后转发的消息前面; 不受队列长度的限制
+func (q *outboundQueue) preload(items []outboundMessage) {
+	if len(items) == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.items = append(q.items, items...)
+	stat.OutboundQueued.Add(float64(len(items)))
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// start 发送CONNACK之后允许writer取出消息
+func (q *outboundQueue) start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.started = true
+	if q.closed {
+		return
+	}
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// wait 等待并取出队列中的全部消息, 队列关闭或者已经溢出时返回false; start 之前一直等待
+func (q *outboundQueue) wait() ([]outboundMessage, bool) {
+	for {
+		q.mu.Lock()
+		if q.closed || q.overflowed {
+			q.mu.Unlock()
+			return nil, false
+		}
+		if items := q.items; len(items) > 0 && q.started {
+			q.items = nil
+			q.mu.Unlock()
+			stat.OutboundQueued.Sub(float64(len(items)))
+			return items, true
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
+
+// close 关闭队列并返回还没有写入的消息
+func (q *outboundQueue) close() []outboundMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.ready)
+	}
+	items := q.items
+	q.items = nil
+	stat.OutboundQueued.Sub(float64(len(items)))
+	return items
+}
+
+func (q *outboundQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// writeLoop 将发送队列中的消息批量写入缓冲区, 每批消息之后刷新一次, 直到队列关闭
+func (c *conn) writeLoop() {
+	defer close(c.writerDone)
+	w := &response{conn: c, buffered: true}
+	for {
+		items, ok := c.outbound.wait()
+		if !ok {
+			return
+		}
+		for _, m := range items {
+			if m.resend != nil {
+				c.resend(w, m.resend)
+				continue
+			}
+			out := c.prepare(m.pub, m.d)
+			if out == nil {
+				continue
+			}
+			if err := c.sendPublish(w, out); err != nil {
+				log.Printf("write outbound: clientId=%s, topic=%s, err=%v", c.ID, out.Message.TopicName, err)
+			}
+		}
+		c.mu.Lock()
+		err := c.bw.Flush()
+		c.mu.Unlock()
+		if err != nil {
+			log.Printf("write outbound: clientId=%s, reomte=%s, err=%v", c.ID, c.remoteAddr, err)
+		}
+	}
+}
+
+// stopWriter 网络连接关闭后停止writer, 还没有写入的消息回到会话, 见 redeliver
+//
+// 关闭队列和转发剩余的消息在同一个锁内完成, 之后因为队列关闭而转发失败的消息排在它们后面.
+// 必须在解除会话绑定之前调用: 解除绑定之后转发的消息直接进入离线队列, 会排在队列中更早的消息前面
+func (c *conn) stopWriter() {
+	s := c.server
+	s.sessions.mu.Lock()
+	items := c.outbound.close()
+	if sess := c.session; sess != nil {
+		for _, m := range items {
+			if m.resend != nil { // 仍然保存在会话中, 重连后重发
+				continue
+			}
+			if err := s.redeliver(sess, c, m.pub, m.d); err != nil {
+				log.Printf("requeue outbound: clientId=%s, topic=%s, err=%v", c.ID, m.pub.Message.TopicName, err)
+			}
+		}
+	}
+	s.sessions.mu.Unlock()
+	<-c.writerDone
+}
+
+// deliverTo 将消息放入会话的网络连接c的发送队列; 读取会话状态之后c已经关闭时, 按会话当前的状态转发
+func (s *Server) deliverTo(sess *session, c *conn, pub *packet.PUBLISH, d delivery) error {
+	err := c.deliverWith(pub, d)
+	if !errors.Is(err, errOutboundClosed) {
+		return err
+	}
+	s.sessions.mu.Lock()
+	defer s.sessions.mu.Unlock()
+	return s.redeliver(sess, c, pub, d)
+}
+
+// redeliver 按会话当前的状态转发消息, 调用时持有sessions.mu
+//
+// 会话已经被新的连接接管时转发给新的连接; 会话离线时进入离线队列; 会话已经结束时丢弃.
+// prev为已经关闭的网络连接, 没有时为nil
+func (s *Server) redeliver(sess *session, prev *conn, pub *packet.PUBLISH, d delivery) error {
+	if s.sessions.maps[sess.clientID] != sess {
+		return nil
+	}
+	if next := sess.conn; next != nil && next != prev {
+		return next.deliverWith(pub, d)
+	}
+	return s.enqueue(sess, pub, d)
+}
+
+// slowConsumer 发送队列溢出时断开读取太慢的客户端
+func (c *conn) slowConsumer() {
+	log.Printf("slow consumer disconnected: clientId=%s, reomte=%s, overflow=%s, queued=%d", c.ID, c.remoteAddr, c.server.OutboundOverflow, c.outbound.Len())
+	stat.SlowConsumers.Inc()
+	c.close()
+}
@@ -0,0 +1,181 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+func TestOutboundQueueOverflow(t *testing.T) {
+	testCases := []struct {
+		overflow OutboundOverflow
+		qos      uint8
+		slow     bool
+		queued   int
+	}{
+		{OutboundDropQoS0, 0, false, 2},
+		{OutboundDropQoS0, 1, true, 3},
+		{OutboundDisconnect, 0, true, 3},
+		{OutboundDisconnect, 1, true, 3},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.overflow.String(), func(t *testing.T) {
+			q := newOutboundQueue(2, tc.overflow)
+			q.start()
+			for _, content := range []string{"1", "2"} {
+				if slow, err := q.push(outboundMessage{pub: newTestPublish("a/b", content, 1), d: delivery{qos: 1}}); slow || err != nil {
+					t.Fatalf("push() = %v, %v", slow, err)
+				}
+			}
+			slow, err := q.push(outboundMessage{pub: newTestPublish("a/b", "3", tc.qos), d: delivery{qos: 1}})
+			if slow != tc.slow || err != nil {
+				t.Errorf("push() = %v, %v, want slow=%v", slow, err, tc.slow)
+			}
+			if q.Len() != tc.queued {
+				t.Errorf("queue = %d, want %d", q.Len(), tc.queued)
+			}
+			// 断开连接后writer不再从队列中取消息, 剩余的消息在关闭时返回
+			if _, ok := q.wait(); ok == tc.slow {
+				t.Errorf("wait() ok = %v, want %v", ok, !tc.slow)
+			}
+		})
+	}
+}
+
+func TestOutboundQueueClose(t *testing.T) {
+	q := newOutboundQueue(10, OutboundDropQoS0)
+	q.start()
+	_, _ = q.push(outboundMessage{pub: newTestPublish("a/b", "1", 1), d: delivery{qos: 1}})
+	done := make(chan bool)
+	go func() {
+		_, _ = q.wait() // 取出已有的消息
+		_, ok := q.wait()
+		done <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if items := q.close(); len(items) != 0 {
+		t.Errorf("close() = %d messages, want 0", len(items))
+	}
+	if ok := <-done; ok {
+		t.Error("wait() should return false after close")
+	}
+	if _, err := q.push(outboundMessage{pub: newTestPublish("a/b", "2", 1)}); err != errOutboundClosed {
+		t.Errorf("push() after close = %v, want errOutboundClosed", err)
+	}
+}
+
+func TestOutboundQueueStart(t *testing.T) {
+	q := newOutboundQueue(10, OutboundDropQoS0)
+	_, _ = q.push(outboundMessage{pub: newTestPublish("a/b", "1", 1), d: delivery{qos: 1}})
+	done := make(chan int)
+	go func() {
+		items, _ := q.wait()
+		done <- len(items)
+	}()
+	// 发送CONNACK之前writer不取出消息
+	select {
+	case n := <-done:
+		t.Fatalf("wait() returned %d messages before start", n)
+	case <-time.After(10 * time.Millisecond):
+	}
+	q.start()
+	if n := <-done; n != 1 {
+		t.Errorf("wait() = %d messages, want 1", n)
+	}
+}
+
+func TestSlowConsumerDisconnected(t *testing.T) {
+	s := NewServer(context.Background())
+	s.MaxOutboundMessages = 1
+
+	rw, _ := connectTestServer(t, s, &packet.CONNECT{ClientID: "slow"})
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION311, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{TopicFilter: "a/b", MaximumQoS: 1}},
+	})
+	if _, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.SUBACK); !ok {
+		t.Fatal("expected SUBACK")
+	}
+
+	// 客户端不读取报文, 发布者不会被阻塞, 发送队列溢出后连接被断开
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for _, content := range []string{"1", "2", "3"} {
+			_ = s.publish(newTestPublish("a/b", content, 1))
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publish should not block on a slow consumer")
+	}
+	waitOffline(t, s, "slow")
+
+	// 未发送的消息回到会话, 重连后按顺序发送
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{ClientID: "slow"})
+	if connack.SessionPresent != 1 {
+		t.Fatal("SessionPresent should be 1")
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		pub, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+		if !ok || string(pub.Message.Content) != want {
+			t.Fatalf("message = %v, want %s", pub, want)
+		}
+	}
+}
+
+func TestDisconnectKeepsOrder(t *testing.T) {
+	s := NewServer(context.Background())
+	rw, _ := connectTestServer(t, s, &packet.CONNECT{ClientID: "order"})
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION311, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{TopicFilter: "a/b", MaximumQoS: 1}},
+	})
+	if _, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.SUBACK); !ok {
+		t.Fatal("expected SUBACK")
+	}
+	s.clientsMu.Lock()
+	c := s.clients["order"]
+	s.clientsMu.Unlock()
+
+	// 客户端不再读取, writer阻塞在第一条消息上, 之后的消息留在发送队列中
+	_ = s.publish(newTestPublish("a/b", "1", 1))
+	waitOutFlight(t, c.session, 1)
+	_ = s.publish(newTestPublish("a/b", "2", 1))
+	_ = s.publish(newTestPublish("a/b", "3", 1))
+
+	// 持有clientsMu, 连接关闭后停在解除会话绑定之前; 此时发布的消息排在发送队列中剩余的消息后面
+	s.clientsMu.Lock()
+	_ = rw.Close()
+	for i := 0; ; i++ {
+		c.outbound.mu.Lock()
+		closed := c.outbound.closed
+		c.outbound.mu.Unlock()
+		if closed {
+			break
+		}
+		if i == 100 {
+			s.clientsMu.Unlock()
+			t.Fatal("outbound queue should be closed before the session is detached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = s.publish(newTestPublish("a/b", "4", 1))
+	s.clientsMu.Unlock()
+	waitOffline(t, s, "order")
+	_ = s.publish(newTestPublish("a/b", "5", 1))
+
+	// 重连后先重发未确认的消息, 再发送离线期间积压的消息, 整体保持发布的顺序
+	rw, _ = connectTestServer(t, s, &packet.CONNECT{ClientID: "order"})
+	for _, want := range []string{"1", "2", "3", "4", "5"} {
+		pub, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+		if !ok || string(pub.Message.Content) != want {
+			t.Fatalf("expected PUBLISH %s, got %v", want, pub)
+		}
+	}
+}
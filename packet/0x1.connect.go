@@ -5,8 +5,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-
-	"github.com/golang-io/requests"
 )
 
 /*
@@ -358,15 +356,15 @@ func (pkt *CONNECT) Pack(w io.Writer) error {
 		wf = 1 // 设置遗嘱标志为1
 
 		// 设置遗嘱QoS和保留标志
-		if pkt.WillProperties != nil {
-			// 根据WillProperties设置QoS和保留标志
-			// 注意：v5.0中遗嘱QoS和保留标志仍然在Connect Flags中设置
-			// WillProperties主要用于其他遗嘱相关属性
-		}
-
-		// 如果有遗嘱主题但未指定QoS，设置遗嘱QoS为1（默认值）
-		// 注意: 这是实现细节，协议规范中没有默认QoS的要求
-		if wq == 0 {
+		// 注意：v5.0中遗嘱QoS和保留标志仍然在Connect Flags中设置, WillProperties用于其他遗嘱相关属性
+		if pkt.ConnectFlags.WillFlag() {
+			wq = pkt.ConnectFlags.WillQoS()
+			if pkt.ConnectFlags.WillRetain() {
+				wr = 1
+			}
+		} else if wq == 0 {
+			// 只设置了遗嘱主题而没有设置遗嘱标志时，设置遗嘱QoS为1（默认值）
+			// 注意: 这是实现细节，协议规范中没有默认QoS的要求
 			wq = 1
 		}
 	} else {
@@ -376,8 +374,10 @@ func (pkt *CONNECT) Pack(w io.Writer) error {
 		wr = 0 // 遗嘱保留标志为0
 	}
 
-	// 设置清理会话标志 (默认为true，表示清理会话)
-	cs = 1
+	// 设置清理会话标志, 由ConnectFlags决定是否清理会话
+	if pkt.ConnectFlags.CleanStart() {
+		cs = 1
+	}
 
 	// 组合标志位
 	flag := uf<<7 | pf<<6 | wr<<5 | wq<<3 | wf<<2 | cs<<1
@@ -396,6 +396,11 @@ func (pkt *CONNECT) Pack(w io.Writer) error {
 		if err != nil {
 			return err
 		}
+		propsLen, err := encodeLength(len(b))
+		if err != nil {
+			return err
+		}
+		buf.Write(propsLen)
 		buf.Write(b)
 	}
 
@@ -414,11 +419,19 @@ func (pkt *CONNECT) Pack(w io.Writer) error {
 	// 参考章节: 3.1.3.2 Will Properties, 3.1.3.3 Will Topic, 3.1.3.4 Will Payload
 	if pkt.ConnectFlags.WillFlag() {
 		// v5.0: 遗嘱属性
-		if pkt.Version == VERSION500 && pkt.WillProperties != nil {
+		if pkt.Version == VERSION500 {
+			if pkt.WillProperties == nil {
+				pkt.WillProperties = &WillProperties{}
+			}
 			b, err := pkt.WillProperties.Pack()
 			if err != nil {
 				return err
 			}
+			propsLen, err := encodeLength(len(b))
+			if err != nil {
+				return err
+			}
+			buf.Write(propsLen)
 			buf.Write(b)
 		}
 
@@ -514,10 +527,8 @@ func (pkt *CONNECT) Unpack(buf *bytes.Buffer) error {
 
 	}
 
+	// ClientID为空时由服务端分配, 参考章节 3.1.3.1 Client Identifier
 	pkt.ClientID, _ = decodeUTF8[string](buf)
-	if pkt.ClientID == "" {
-		pkt.ClientID = requests.GenId()
-	}
 
 	// 遗嘱标志验证和字段处理
 	// 参考章节: 3.1.2.2 Connect Flags, 3.1.3 CONNECT Payload
@@ -1074,6 +1085,10 @@ func (props *WillProperties) Unpack(buf *bytes.Buffer) error {
 			if uLen, err = props.WillDelayInterval.Unpack(buf); err != nil {
 				return fmt.Errorf("failed to unpack WillDelayInterval: %w", err)
 			}
+		case 0x26: // 用户属性 User Property
+			if uLen, err = props.UserProperty.Unpack(buf); err != nil {
+				return fmt.Errorf("failed to unpack UserProperty: %w", err)
+			}
 		default:
 			return fmt.Errorf("%w: propsId=%d", ErrMalformedWillProperties, propsId)
 		}
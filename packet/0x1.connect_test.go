@@ -652,3 +652,45 @@ func BenchmarkCONNECT_Unpack(b *testing.B) {
 		newConnect.Unpack(payloadBuf)
 	}
 }
+
+// TestCONNECT_WillRoundTrip 测试v5.0遗嘱QoS, 遗嘱保留标志和遗嘱属性的打包与解包
+// 参考MQTT v5.0章节 3.1.2.6 Will QoS, 3.1.2.7 Will Retain, 3.1.3.2 Will Properties
+func TestCONNECT_WillRoundTrip(t *testing.T) {
+	connect := &CONNECT{
+		FixedHeader:  &FixedHeader{Kind: 0x01, Version: VERSION500},
+		ConnectFlags: ConnectFlags(0x02 | 0x04 | 0x10 | 0x20), // CleanStart, WillFlag, WillQoS=2, WillRetain
+		ClientID:     "testclient",
+		KeepAlive:    60,
+		Props:        &ConnectProperties{},
+		WillProperties: &WillProperties{
+			WillDelayInterval: 30,
+			ContentType:       "text/plain",
+			ResponseTopic:     "test/reply",
+			UserProperty:      UserProperty{"k": {"v"}},
+		},
+		WillTopic:   "test/will",
+		WillPayload: []byte("will message"),
+	}
+	var buf bytes.Buffer
+	if err := connect.Pack(&buf); err != nil {
+		t.Fatalf("Pack() failed: %v", err)
+	}
+	pkt, err := Unpack(VERSION500, &buf)
+	if err != nil {
+		t.Fatalf("Unpack() failed: %v", err)
+	}
+	got := pkt.(*CONNECT)
+	if !got.ConnectFlags.WillFlag() || got.ConnectFlags.WillQoS() != 2 || !got.ConnectFlags.WillRetain() {
+		t.Errorf("ConnectFlags = %08b, want WillFlag, WillQoS=2 and WillRetain", got.ConnectFlags)
+	}
+	if got.WillTopic != "test/will" || string(got.WillPayload) != "will message" {
+		t.Errorf("Will = %s:%s, want test/will:will message", got.WillTopic, got.WillPayload)
+	}
+	props := got.WillProperties
+	if props == nil || props.WillDelayInterval != 30 || props.ContentType != "text/plain" || props.ResponseTopic != "test/reply" {
+		t.Fatalf("WillProperties = %+v", props)
+	}
+	if v := props.UserProperty["k"]; len(v) != 1 || v[0] != "v" {
+		t.Errorf("UserProperty = %v, want k=v", props.UserProperty)
+	}
+}
@@ -243,7 +243,8 @@ type ConnackProps struct {
 	// - 如果从服务端接收到了最大QoS等级，则客户端不能发送超过最大QoS等级所指定的QoS等级的PUBLISH报文 [MQTT-3.2.2-11]
 	// - 服务端接收到超过其指定的最大服务质量的PUBLISH报文将造成协议错误
 	// - 如果服务端收到包含遗嘱的QoS超过服务端处理能力的CONNECT报文，服务端必须拒绝此连接
-	MaximumQoS MaximumQoS
+	// - nil表示不发送此属性, 接收端使用默认值
+	MaximumQoS *MaximumQoS
 
 	// RetainAvailable 保留可用
 	// 属性标识符: 37 (0x25)
@@ -255,7 +256,8 @@ type ConnackProps struct {
 	// - 包含多个保留可用字段或保留可用字段值不为0也不为1将造成协议错误
 	// - 如果服务端收到一个包含保留标志位1的遗嘱消息的CONNECT报文且服务端不支持保留消息，服务端必须拒绝此连接请求
 	// - 从服务端接收到的保留可用标志为0时，客户端不能发送保留标志设置为1的PUBLISH报文 [MQTT-3.2.2-14]
-	RetainAvailable RetainAvailable
+	// - nil表示不发送此属性, 接收端使用默认值
+	RetainAvailable *RetainAvailable
 
 	// MaximumPacketSize 最大报文长度
 	// 属性标识符: 39 (0x27)
@@ -334,7 +336,8 @@ type ConnackProps struct {
 	// - 包含多个通配符订阅可用属性，或通配符订阅可用属性值不为0也不为1将造成协议错误
 	// - 如果服务端在不支持通配符订阅的情况下收到了包含通配符订阅的SUBSCRIBE报文，将造成协议错误
 	// - 服务端在支持通配符订阅的情况下仍然可以拒绝特定的包含通配符订阅的订阅请求
-	WildcardSubscriptionAvailable WildcardSubscriptionAvailable
+	// - nil表示不发送此属性, 接收端使用默认值
+	WildcardSubscriptionAvailable *WildcardSubscriptionAvailable
 
 	// SubscriptionIdentifierAvailable 订阅标识符可用
 	// 属性标识符: 41 (0x29)
@@ -345,7 +348,8 @@ type ConnackProps struct {
 	// 注意:
 	// - 包含多个订阅标识符可用属性，或订阅标识符可用属性值不为0也不为1将造成协议错误
 	// - 如果服务端在不支持订阅标识符的情况下收到了包含订阅标识符的SUBSCRIBE报文，将造成协议错误
-	SubscriptionIdentifierAvailable SubscriptionIdentifierAvailable
+	// - nil表示不发送此属性, 接收端使用默认值
+	SubscriptionIdentifierAvailable *SubscriptionIdentifierAvailable
 
 	// SharedSubscriptionAvailable 共享订阅可用
 	// 属性标识符: 42 (0x2A)
@@ -356,7 +360,8 @@ type ConnackProps struct {
 	// 注意:
 	// - 包含多个共享订阅可用，或共享订阅可用属性值不为0也不为1将造成协议错误
 	// - 如果服务端在不支持共享订阅的情况下收到了包含共享订阅的SUBSCRIBE报文，将造成协议错误
-	SharedSubscriptionAvailable SharedSubscriptionAvailable
+	// - nil表示不发送此属性, 接收端使用默认值
+	SharedSubscriptionAvailable *SharedSubscriptionAvailable
 
 	// ServerKeepAlive 服务端保持连接
 	// 属性标识符: 19 (0x13)
@@ -369,7 +374,8 @@ type ConnackProps struct {
 	// - 包含多个服务端保持连接属性将造成协议错误
 	// 非规范评注:
 	// - 服务端保持连接属性的主要作用是通知客户端它将会比客户端指定的保持连接更快的断开非活动的客户端
-	ServerKeepAlive ServerKeepAlive
+	// - nil表示不发送此属性, 接收端使用默认值
+	ServerKeepAlive *ServerKeepAlive
 
 	// ResponseInformation 响应信息
 	// 属性标识符: 26 (0x1A)
@@ -432,15 +438,22 @@ func (props *ConnackProps) Pack() ([]byte, error) {
 	if err := props.ReceiveMaximum.Pack(buf); err != nil {
 		return nil, err
 	}
-	if err := props.MaximumQoS.Pack(buf); err != nil {
-		return nil, err
+	if props.MaximumQoS != nil {
+		if err := props.MaximumQoS.Pack(buf); err != nil {
+			return nil, err
+		}
 	}
-	if err := props.RetainAvailable.Pack(buf); err != nil {
-		return nil, err
+	if props.RetainAvailable != nil {
+		if err := props.RetainAvailable.Pack(buf); err != nil {
+			return nil, err
+		}
 	}
 	if err := props.MaximumPacketSize.Pack(buf); err != nil {
 		return nil, err
 	}
+	if err := props.AssignedClientID.Pack(buf); err != nil {
+		return nil, err
+	}
 	if err := props.TopicAliasMaximum.Pack(buf); err != nil {
 		return nil, err
 	}
@@ -450,17 +463,25 @@ func (props *ConnackProps) Pack() ([]byte, error) {
 	if err := props.UserProperty.Pack(buf); err != nil {
 		return nil, err
 	}
-	if err := props.WildcardSubscriptionAvailable.Pack(buf); err != nil {
-		return nil, err
+	if props.WildcardSubscriptionAvailable != nil {
+		if err := props.WildcardSubscriptionAvailable.Pack(buf); err != nil {
+			return nil, err
+		}
 	}
-	if err := props.SubscriptionIdentifierAvailable.Pack(buf); err != nil {
-		return nil, err
+	if props.SubscriptionIdentifierAvailable != nil {
+		if err := props.SubscriptionIdentifierAvailable.Pack(buf); err != nil {
+			return nil, err
+		}
 	}
-	if err := props.SharedSubscriptionAvailable.Pack(buf); err != nil {
-		return nil, err
+	if props.SharedSubscriptionAvailable != nil {
+		if err := props.SharedSubscriptionAvailable.Pack(buf); err != nil {
+			return nil, err
+		}
 	}
-	if err := props.ServerKeepAlive.Pack(buf); err != nil {
-		return nil, err
+	if props.ServerKeepAlive != nil {
+		if err := props.ServerKeepAlive.Pack(buf); err != nil {
+			return nil, err
+		}
 	}
 	if err := props.ResponseInformation.Pack(buf); err != nil {
 		return nil, err
@@ -501,6 +522,7 @@ func (props *ConnackProps) Unpack(buf *bytes.Buffer) error {
 				return err
 			}
 		case 0x13: // 服务端保持连接 Server Keep Alive
+			props.ServerKeepAlive = new(ServerKeepAlive)
 			if uLen, err = props.ServerKeepAlive.Unpack(buf); err != nil {
 				return err
 			}
@@ -533,10 +555,12 @@ func (props *ConnackProps) Unpack(buf *bytes.Buffer) error {
 				return err
 			}
 		case 0x24: // 最大服务质量 Maximum QoS
+			props.MaximumQoS = new(MaximumQoS)
 			if uLen, err = props.MaximumQoS.Unpack(buf); err != nil {
 				return err
 			}
 		case 0x25: // 保留可用 Retain Available
+			props.RetainAvailable = new(RetainAvailable)
 			if uLen, err = props.RetainAvailable.Unpack(buf); err != nil {
 				return err
 			}
@@ -549,21 +573,23 @@ func (props *ConnackProps) Unpack(buf *bytes.Buffer) error {
 				return err
 			}
 		case 0x28: // 通配符订阅可用 Wildcard Subscription Available
+			props.WildcardSubscriptionAvailable = new(WildcardSubscriptionAvailable)
 			if uLen, err = props.WildcardSubscriptionAvailable.Unpack(buf); err != nil {
 				return err
 			}
 		case 0x29: // 订阅标识符可用 Subscription Identifier Available
+			props.SubscriptionIdentifierAvailable = new(SubscriptionIdentifierAvailable)
 			if uLen, err = props.SubscriptionIdentifierAvailable.Unpack(buf); err != nil {
 				return err
 			}
 		case 0x2A: // 共享订阅可用 Shared Subscription Available
+			props.SharedSubscriptionAvailable = new(SharedSubscriptionAvailable)
 			if uLen, err = props.SharedSubscriptionAvailable.Unpack(buf); err != nil {
 				return err
 			}
 		default:
 			return fmt.Errorf("unknown property id: %d", propsId)
 		}
-		i += uLen
 	}
 	return nil
 }
@@ -7,6 +7,7 @@ import (
 	"io"
 	"slices"
 	"strings"
+	"time"
 )
 
 /*
@@ -210,6 +211,10 @@ type PUBLISH struct {
 	// 位置: 可变报头，在报文标识符之后(QoS > 0时)
 	// 包含各种发布选项，如主题别名、消息过期、载荷格式等
 	Props *PublishProperties `json:"properties,omitempty"`
+
+	// ExpiresAt 服务端收到消息时根据消息过期间隔计算的过期时间, 不参与编解码; 零值表示消息不会过期
+	// 参考章节: 3.3.2.3.3 Message Expiry Interval
+	ExpiresAt time.Time `json:"-"`
 }
 
 func (pkt *PUBLISH) Kind() byte {
@@ -231,8 +236,8 @@ func (pkt *PUBLISH) Pack(w io.Writer) error {
 		return fmt.Errorf("invalid QoS value: %d, QoS bits 11 (0b11) are reserved and must not be used [MQTT-3.3.1-4]", pkt.FixedHeader.QoS)
 	}
 
-	// 验证主题名不能为空
-	if pkt.Message.TopicName == "" {
+	// 验证主题名不能为空, v5.0使用主题别名时主题名可以为空 [MQTT-3.3.2-1]
+	if pkt.Message.TopicName == "" && !pkt.hasTopicAlias() {
 		return fmt.Errorf("topic name cannot be empty [MQTT-3.3.2-1]")
 	}
 
@@ -296,8 +301,8 @@ func (pkt *PUBLISH) Unpack(buf *bytes.Buffer) error {
 	// 读取主题名长度
 	topicLength := int(binary.BigEndian.Uint16(buf.Next(2)))
 
-	// 验证主题名长度
-	if topicLength == 0 {
+	// 验证主题名长度, v5.0的主题名可以为空, 此时必须包含主题别名, 见下方属性解析之后的检查
+	if topicLength == 0 && pkt.Version != VERSION500 {
 		return fmt.Errorf("topic name cannot be empty [MQTT-3.3.2-1]")
 	}
 
@@ -330,6 +335,9 @@ func (pkt *PUBLISH) Unpack(buf *bytes.Buffer) error {
 		if err := pkt.Props.Unpack(buf); err != nil {
 			return fmt.Errorf("pkt.RemainingLength=%v err=%w", pkt.RemainingLength, err)
 		}
+		if topicLength == 0 && !pkt.hasTopicAlias() {
+			return fmt.Errorf("topic name cannot be empty without topic alias [MQTT-3.3.2-1]")
+		}
 	}
 
 	// 使用 append([]byte{}, buf.Bytes()...) 创建深度副本，避免内存共享问题
@@ -342,6 +350,14 @@ func (pkt *PUBLISH) Unpack(buf *bytes.Buffer) error {
 	return nil
 }
 
+// hasTopicAlias v5.0报文是否包含主题别名
+//
+// MQTT v5.0: 参考章节 3.3.2.3.4 Topic Alias
+// - 主题名长度为0且包含主题别名时, 接收方使用别名映射的主题名
+func (pkt *PUBLISH) hasTopicAlias() bool {
+	return pkt.Version == VERSION500 && pkt.Props != nil && pkt.Props.TopicAlias > 0
+}
+
 // Message 发布消息内容
 // 参考章节: 3.3.3 PUBLISH Payload
 // 包含主题名和消息内容
@@ -417,7 +433,7 @@ type PublishProperties struct {
 	// 类型: UTF-8编码字符串
 	// 含义: 表示响应消息的主题名
 	// 注意: 包含多个响应主题将造成协议错误
-	ResponseTopic ReasonString
+	ResponseTopic ResponseTopic
 
 	// CorrelationData 对比数据
 	// 属性标识符: 9 (0x09)
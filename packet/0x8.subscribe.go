@@ -79,7 +79,12 @@ func (pkt *SUBSCRIBE) Pack(w io.Writer) error {
 			return ErrProtocolViolationNoTopic
 		}
 		buf.Write(s2b(subscription.TopicFilter))
-		buf.WriteByte(subscription.MaximumQoS)
+		options := subscription.MaximumQoS
+		// v5.0: 订阅选项还包括No Local, Retain As Published和Retain Handling, 参考章节 3.8.3.1 Subscription Options
+		if pkt.Version == VERSION500 {
+			options |= subscription.NoLocal<<2 | subscription.RetainAsPublished<<3 | subscription.RetainHandling<<4
+		}
+		buf.WriteByte(options)
 	}
 	pkt.FixedHeader.RemainingLength = uint32(buf.Len())
 	if err := pkt.FixedHeader.Pack(w); err != nil {
@@ -96,6 +101,7 @@ func (pkt *SUBSCRIBE) Unpack(buf *bytes.Buffer) error {
 	}
 	pkt.PacketID = binary.BigEndian.Uint16(buf.Next(2))
 	if pkt.Version == VERSION500 {
+		pkt.Props = &SubscribeProperties{}
 		if err := pkt.Props.Unpack(buf); err != nil {
 			return fmt.Errorf("pkt.RemainingLength=%v err=%w", pkt.RemainingLength, err)
 		}
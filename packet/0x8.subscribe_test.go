@@ -651,3 +651,29 @@ func BenchmarkSUBSCRIBE_Unpack(b *testing.B) {
 		subscribe.Unpack(buf)
 	}
 }
+
+// TestSUBSCRIBE_SubscriptionIdentifier 测试v5.0订阅标识符的打包与解包
+// 参考MQTT v5.0章节 3.8.2.1.2 Subscription Identifier
+func TestSUBSCRIBE_SubscriptionIdentifier(t *testing.T) {
+	subscribe := &SUBSCRIBE{
+		FixedHeader:   &FixedHeader{Kind: 0x08, QoS: 1, Version: VERSION500},
+		PacketID:      1,
+		Props:         &SubscribeProperties{SubscriptionIdentifier: 16384},
+		Subscriptions: []Subscription{{TopicFilter: "a/+", MaximumQoS: 1}},
+	}
+	var buf bytes.Buffer
+	if err := subscribe.Pack(&buf); err != nil {
+		t.Fatalf("Pack() failed: %v", err)
+	}
+	pkt, err := Unpack(VERSION500, &buf)
+	if err != nil {
+		t.Fatalf("Unpack() failed: %v", err)
+	}
+	got := pkt.(*SUBSCRIBE)
+	if got.Props == nil || got.Props.SubscriptionIdentifier != 16384 {
+		t.Errorf("Props = %+v, want SubscriptionIdentifier=16384", got.Props)
+	}
+	if len(got.Subscriptions) != 1 || got.Subscriptions[0].TopicFilter != "a/+" {
+		t.Errorf("Subscriptions = %v", got.Subscriptions)
+	}
+}
@@ -111,10 +111,7 @@ func (pkt *SUBACK) Unpack(buf *bytes.Buffer) error {
 
 	for buf.Len() != 0 {
 		reason := ReasonCode{Code: buf.Next(1)[0]}
-		if reason.Code == 0x80 {
-			return ErrMalformedReasonCode
-		}
-		if reason.Code > 0x02 {
+		if !validSubackReasonCode(pkt.Version, reason.Code) {
 			return ErrMalformedReasonCode
 		}
 		pkt.ReasonCode = append(pkt.ReasonCode, reason)
@@ -122,6 +119,20 @@ func (pkt *SUBACK) Unpack(buf *bytes.Buffer) error {
 	return nil
 }
 
+// validSubackReasonCode 检查SUBACK返回码是否有效
+// - v3.1.1: 参考章节 3.9.3 Payload, 允许 0x00, 0x01, 0x02, 0x80
+// - v5.0: 参考章节 3.9.3 SUBACK Payload, 额外允许 0x83, 0x87, 0x8F, 0x91, 0x97, 0x9E, 0xA1, 0xA2
+func validSubackReasonCode(version byte, code byte) bool {
+	switch code {
+	case 0x00, 0x01, 0x02, 0x80:
+		return true
+	case 0x83, 0x87, 0x8F, 0x91, 0x97, 0x9E, 0xA1, 0xA2:
+		return version == VERSION500
+	default:
+		return false
+	}
+}
+
 // SubackProperties 订阅确认属性 (v5.0新增)
 // 参考章节: 3.9.2.2 SUBACK Properties
 // 包含各种订阅确认选项，用于扩展确认功能
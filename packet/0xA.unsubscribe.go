@@ -68,14 +68,11 @@ func (pkt *UNSUBSCRIBE) Pack(w io.Writer) error {
 	defer PutBuffer(buf)
 	buf.Write(i2b(pkt.PacketID))
 
-	// 写入主题过滤器
-	for _, subscription := range pkt.Subscriptions {
-		buf.Write(s2b(subscription.TopicFilter))
-	}
-
-	// 计算初始长度
-	pkt.FixedHeader.RemainingLength = uint32(buf.Len())
+	// v5.0的属性在可变报头中, 位于报文标识符之后、载荷之前
 	if pkt.Version == VERSION500 {
+		if pkt.Props == nil {
+			pkt.Props = &UnsubscribeProperties{}
+		}
 		b, err := pkt.Props.Pack()
 		if err != nil {
 			return err
@@ -87,6 +84,11 @@ func (pkt *UNSUBSCRIBE) Pack(w io.Writer) error {
 		buf.Write(propsLen)
 		buf.Write(b)
 	}
+
+	// 写入主题过滤器
+	for _, subscription := range pkt.Subscriptions {
+		buf.Write(s2b(subscription.TopicFilter))
+	}
 	pkt.FixedHeader.RemainingLength = uint32(buf.Len())
 
 	if err := pkt.FixedHeader.Pack(w); err != nil {
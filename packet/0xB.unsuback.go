@@ -14,11 +14,11 @@ import (
 // 报文结构:
 // 固定报头: 报文类型0x0B，标志位必须为0
 // 可变报头: 报文标识符、取消订阅确认属性(v5.0)
-// 载荷: 无载荷
+// 载荷: v3.1.1无载荷; v5.0为原因码列表，每个原因码对应一个取消订阅的主题过滤器
 //
 // 版本差异:
 // - v3.1.1: 基本的取消订阅确认功能，只包含报文标识符
-// - v5.0: 在v3.1.1基础上增加了属性系统，支持原因字符串、用户属性等
+// - v5.0: 在v3.1.1基础上增加了属性系统和原因码列表，支持原因字符串、用户属性等
 //
 // 用途:
 // - 用于确认UNSUBSCRIBE报文的处理结果
@@ -44,6 +44,16 @@ type UNSUBACK struct {
 	// 位置: 可变报头，在报文标识符之后
 	// 包含原因字符串、用户属性等
 	Props *UnsubackProperties
+
+	// ReasonCode 原因码列表 (v5.0新增)
+	// 参考章节: 3.11.3 UNSUBACK Payload
+	// 位置: 载荷部分
+	// 每个原因码对应UNSUBSCRIBE报文中的一个主题过滤器，顺序必须一致 [MQTT-3.11.3-1]
+	// 原因码值:
+	// - 0x00: 成功 - 订阅已删除
+	// - 0x11: 订阅不存在 - 服务端没有找到对应的订阅
+	// - 0x80, 0x83, 0x87, 0x8F, 0x91: 取消订阅失败
+	ReasonCode []ReasonCode `json:"ReasonCode,omitempty"`
 }
 
 func (pkt *UNSUBACK) Kind() byte {
@@ -70,6 +80,10 @@ func (pkt *UNSUBACK) Pack(w io.Writer) error {
 		}
 		buf.Write(propsLen)
 		buf.Write(b)
+
+		for _, reason := range pkt.ReasonCode {
+			buf.WriteByte(reason.Code)
+		}
 	}
 	pkt.FixedHeader.RemainingLength = uint32(buf.Len())
 
@@ -81,10 +95,10 @@ func (pkt *UNSUBACK) Pack(w io.Writer) error {
 
 }
 func (pkt *UNSUBACK) Unpack(buf *bytes.Buffer) error {
-	if pkt.FixedHeader.RemainingLength != 2 {
+	if pkt.FixedHeader.RemainingLength < 2 || pkt.Version != VERSION500 && pkt.FixedHeader.RemainingLength != 2 {
 		return ErrMalformedPacket
 	}
-	pkt.PacketID = binary.BigEndian.Uint16(buf.Bytes())
+	pkt.PacketID = binary.BigEndian.Uint16(buf.Next(2))
 
 	switch pkt.Version {
 	case VERSION500:
@@ -92,6 +106,13 @@ func (pkt *UNSUBACK) Unpack(buf *bytes.Buffer) error {
 		if err := pkt.Props.Unpack(buf); err != nil {
 			return err
 		}
+		for buf.Len() != 0 {
+			reason := ReasonCode{Code: buf.Next(1)[0]}
+			if !validUnsubackReasonCode(reason.Code) {
+				return ErrMalformedReasonCode
+			}
+			pkt.ReasonCode = append(pkt.ReasonCode, reason)
+		}
 	case VERSION311:
 	case VERSION310:
 		return ErrUnsupportedProtocolVersion
@@ -102,6 +123,17 @@ func (pkt *UNSUBACK) Unpack(buf *bytes.Buffer) error {
 	return nil
 }
 
+// validUnsubackReasonCode 检查UNSUBACK原因码是否有效
+// - v5.0: 参考章节 3.11.3 UNSUBACK Payload, 允许 0x00, 0x11, 0x80, 0x83, 0x87, 0x8F, 0x91
+func validUnsubackReasonCode(code byte) bool {
+	switch code {
+	case 0x00, 0x11, 0x80, 0x83, 0x87, 0x8F, 0x91:
+		return true
+	default:
+		return false
+	}
+}
+
 // UnsubackProperties 取消订阅确认属性 (v5.0新增)
 // 参考章节: 3.11.2.2 UNSUBACK Properties
 // 包含各种取消订阅确认选项，用于扩展确认功能
@@ -0,0 +1,72 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestUNSUBACK_RoundTrip 测试UNSUBACK报文的往返一致性
+func TestUNSUBACK_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     byte
+		reasonCodes []ReasonCode
+		wantLength  uint32
+	}{
+		{
+			name:       "MQTT v3.1.1 没有载荷",
+			version:    VERSION311,
+			wantLength: 2,
+		},
+		{
+			name:        "MQTT v5.0 原因码列表",
+			version:     VERSION500,
+			reasonCodes: []ReasonCode{CodeSuccess, CodeNoSubscriptionExisted},
+			wantLength:  5, // 报文标识符 + 属性长度 + 2个原因码
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := &UNSUBACK{
+				FixedHeader: &FixedHeader{Version: tt.version, Kind: 0xB},
+				PacketID:    10,
+				ReasonCode:  tt.reasonCodes,
+			}
+			var buf bytes.Buffer
+			if err := original.Pack(&buf); err != nil {
+				t.Fatalf("Pack() failed: %v", err)
+			}
+			if original.RemainingLength != tt.wantLength {
+				t.Errorf("RemainingLength = %d, want %d", original.RemainingLength, tt.wantLength)
+			}
+
+			pkt, err := Unpack(tt.version, &buf)
+			if err != nil {
+				t.Fatalf("Unpack() failed: %v", err)
+			}
+			unpacked, ok := pkt.(*UNSUBACK)
+			if !ok {
+				t.Fatalf("Unpack() = %T, want *UNSUBACK", pkt)
+			}
+			if unpacked.PacketID != original.PacketID {
+				t.Errorf("Packet ID mismatch: got %d, want %d", unpacked.PacketID, original.PacketID)
+			}
+			if len(unpacked.ReasonCode) != len(tt.reasonCodes) {
+				t.Fatalf("Reason code count mismatch: got %d, want %d", len(unpacked.ReasonCode), len(tt.reasonCodes))
+			}
+			for i, reason := range unpacked.ReasonCode {
+				if reason.Code != tt.reasonCodes[i].Code {
+					t.Errorf("Reason code[%d] mismatch: got 0x%02x, want 0x%02x", i, reason.Code, tt.reasonCodes[i].Code)
+				}
+			}
+		})
+	}
+}
+
+// TestUNSUBACK_Unpack_InvalidReasonCode 测试无效的UNSUBACK原因码
+func TestUNSUBACK_Unpack_InvalidReasonCode(t *testing.T) {
+	unsuback := &UNSUBACK{FixedHeader: &FixedHeader{Version: VERSION500, RemainingLength: 4}}
+	if err := unsuback.Unpack(bytes.NewBuffer([]byte{0x00, 0x01, 0x00, 0x01})); err != ErrMalformedReasonCode {
+		t.Errorf("Unpack() = %v, want ErrMalformedReasonCode", err)
+	}
+}
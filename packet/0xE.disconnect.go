@@ -75,7 +75,8 @@ func NewDISCONNECT(version byte, reasonCode ReasonCode) *DISCONNECT {
 // 参考章节: 3.14.2.1 Disconnect Reason Code
 func isValidDisconnectReasonCode(code uint8) bool {
 	switch code {
-	case 0x00, 0x04, 0x80, 0x81, 0x82, 0x8C, 0x8D, 0x9C, 0x9D:
+	case 0x00, 0x04, 0x80, 0x81, 0x82, 0x83, 0x87, 0x89, 0x8B, 0x8C, 0x8D, 0x8E, 0x8F, 0x90,
+		0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9A, 0x9B, 0x9C, 0x9D, 0x9E, 0x9F, 0xA0, 0xA1, 0xA2:
 		return true
 	default:
 		return false
@@ -186,6 +187,9 @@ type DisconnectProperties struct {
 	// [MQTT-3.14.2-2] 服务端不能在DISCONNECT中发送此属性
 	SessionExpiryInterval SessionExpiryInterval
 
+	// hasSessionExpiryInterval 解析的报文中是否包含会话过期间隔, 见 HasSessionExpiryInterval
+	hasSessionExpiryInterval bool
+
 	// ReasonString 原因字符串
 	// 属性标识符: 31 (0x1F)
 	// 参考章节: 3.14.2.2.3 Reason String
@@ -221,6 +225,11 @@ type DisconnectProperties struct {
 	ServerReference ServerReference
 }
 
+// HasSessionExpiryInterval 解析的DISCONNECT报文中是否包含会话过期间隔属性, 用于区分不存在和显式设置的0
+func (props *DisconnectProperties) HasSessionExpiryInterval() bool {
+	return props.hasSessionExpiryInterval
+}
+
 func (props *DisconnectProperties) Pack() ([]byte, error) {
 	buf := GetBuffer()
 	defer PutBuffer(buf)
@@ -249,7 +258,7 @@ func (props *DisconnectProperties) Unpack(buf *bytes.Buffer) error {
 	if err != nil {
 		return fmt.Errorf("failed to decode properties length: %w", err)
 	}
-	for i := uint32(0); i < propsLen; {
+	for i := uint32(0); i < propsLen; i++ {
 		propsId, err := decodeLength(buf)
 		if err != nil {
 			return err
@@ -260,6 +269,7 @@ func (props *DisconnectProperties) Unpack(buf *bytes.Buffer) error {
 			if uLen, err = props.SessionExpiryInterval.Unpack(buf); err != nil {
 				return err
 			}
+			props.hasSessionExpiryInterval = true
 		case 0x1C: // Server Reference
 			if uLen, err = props.ServerReference.Unpack(buf); err != nil {
 				return err
@@ -606,3 +606,21 @@ func TestDISCONNECT_Integration(t *testing.T) {
 			len(deserialized.Props.UserProperty), len(original.Props.UserProperty))
 	}
 }
+
+// TestDisconnectProperties_HasSessionExpiryInterval 区分不存在的会话过期间隔和显式设置的0
+func TestDisconnectProperties_HasSessionExpiryInterval(t *testing.T) {
+	props := &DisconnectProperties{}
+	if err := props.Unpack(bytes.NewBuffer([]byte{0x05, 0x11, 0x00, 0x00, 0x00, 0x00})); err != nil {
+		t.Fatalf("Unpack() failed: %v", err)
+	}
+	if !props.HasSessionExpiryInterval() || props.SessionExpiryInterval != 0 {
+		t.Errorf("explicit zero: has=%v, interval=%d", props.HasSessionExpiryInterval(), props.SessionExpiryInterval)
+	}
+	props = &DisconnectProperties{}
+	if err := props.Unpack(bytes.NewBuffer([]byte{0x00})); err != nil {
+		t.Fatalf("Unpack() failed: %v", err)
+	}
+	if props.HasSessionExpiryInterval() {
+		t.Error("absent session expiry interval should not be reported")
+	}
+}
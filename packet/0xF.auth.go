@@ -89,7 +89,7 @@ func (pkt *AUTH) Kind() byte {
 	return 0xF
 }
 
-func (pkt *AUTH) Packet(w io.Writer) error {
+func (pkt *AUTH) Pack(w io.Writer) error {
 	buf := GetBuffer()
 	defer PutBuffer(buf)
 
@@ -98,6 +98,9 @@ func (pkt *AUTH) Packet(w io.Writer) error {
 
 	// 写入属性 (仅MQTT v5.0)
 	if pkt.Version == VERSION500 {
+		if pkt.Props == nil {
+			pkt.Props = &AuthProperties{}
+		}
 		propsData, err := pkt.Props.Pack()
 		if err != nil {
 			return fmt.Errorf("failed to pack AUTH properties: %w", err)
@@ -129,6 +132,12 @@ func (pkt *AUTH) Packet(w io.Writer) error {
 
 func (pkt *AUTH) Unpack(buf *bytes.Buffer) error {
 
+	// 剩余长度为0时, 原因码为0x00(成功)且没有属性
+	if buf.Len() == 0 {
+		pkt.ReasonCode = CodeSuccess
+		return nil
+	}
+
 	// 解析认证原因码
 	reasonCodeByte := buf.Next(1)[0]
 	pkt.ReasonCode = ReasonCode{Code: reasonCodeByte}
@@ -235,7 +244,7 @@ func (props *AuthProperties) Unpack(buf *bytes.Buffer) error {
 	if err != nil {
 		return fmt.Errorf("failed to decode properties length: %w", err)
 	}
-	for i := uint32(0); i < propsLen; {
+	for i := uint32(0); i < propsLen; i++ {
 		propId, err := decodeLength(buf)
 		if err != nil {
 			return fmt.Errorf("failed to decode property ID: %w", err)
@@ -185,7 +185,7 @@ func TestAUTH_Validate(t *testing.T) {
 	}
 }
 
-func TestAUTH_Packet(t *testing.T) {
+func TestAUTH_Pack(t *testing.T) {
 	tests := []struct {
 		name    string
 		auth    *AUTH
@@ -231,9 +231,9 @@ func TestAUTH_Packet(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			var buf bytes.Buffer
-			err := tt.auth.Packet(&buf)
+			err := tt.auth.Pack(&buf)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("AUTH.Packet() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("AUTH.Pack() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 
@@ -241,17 +241,17 @@ func TestAUTH_Packet(t *testing.T) {
 				// 检查序列化后的数据
 				data := buf.Bytes()
 				if len(data) < 3 {
-					t.Errorf("AUTH.Packet() produced too short data: %d bytes", len(data))
+					t.Errorf("AUTH.Pack() produced too short data: %d bytes", len(data))
 				}
 
 				// 检查报文类型 (0x0F << 4 = 0xF0)
 				if data[0] != 0xF0 {
-					t.Errorf("AUTH.Packet() wrong packet type: 0x%02X, want 0xF0", data[0])
+					t.Errorf("AUTH.Pack() wrong packet type: 0x%02X, want 0xF0", data[0])
 				}
 
 				// 检查标志位
 				if data[0]&0x0F != 0x00 {
-					t.Errorf("AUTH.Packet() flags not zero: 0x%02X", data[0]&0x0F)
+					t.Errorf("AUTH.Pack() flags not zero: 0x%02X", data[0]&0x0F)
 				}
 			}
 		})
@@ -575,7 +575,7 @@ func TestAUTH_Integration(t *testing.T) {
 
 	// 序列化
 	var buf bytes.Buffer
-	if err := original.Packet(&buf); err != nil {
+	if err := original.Pack(&buf); err != nil {
 		t.Fatalf("Failed to pack AUTH: %v", err)
 	}
 
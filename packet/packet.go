@@ -69,10 +69,25 @@ type Packet interface {
 // 2. 根据报文类型创建对应的报文结构
 // 3. 解析可变报头和载荷内容
 func Unpack(version byte, r io.Reader) (Packet, error) {
+	return UnpackLimit(version, r, 0)
+}
+
+// UnpackLimit 与 Unpack 相同, 但报文的总长度(固定报头+剩余长度)超过maxSize时,
+// 在读取和分配剩余部分之前返回 ErrPacketTooLarge. maxSize为0表示不限制.
+//
+// MQTT v5.0: 参考章节 3.1.2.11.4 Maximum Packet Size, 3.2.2.3.6 Maximum Packet Size
+// - 接收到超过最大报文长度的报文是协议错误, 服务端使用原因码0x95断开连接 [MQTT-3.1.2-24] [MQTT-3.2.2-15]
+func UnpackLimit(version byte, r io.Reader, maxSize uint32) (Packet, error) {
 	pkt, fixed := Packet(nil), &FixedHeader{Version: version}
 	if err := fixed.Unpack(r); err != nil {
 		return &RESERVED{FixedHeader: fixed}, err
 	}
+	if maxSize > 0 {
+		lengthSize, err := encodeLength(fixed.RemainingLength)
+		if err != nil || 1+len(lengthSize)+int(fixed.RemainingLength) > int(maxSize) {
+			return &RESERVED{FixedHeader: fixed}, ErrPacketTooLarge
+		}
+	}
 
 	buf := GetBuffer()
 	defer PutBuffer(buf)
@@ -234,3 +249,19 @@ func Unpack(version byte, r io.Reader) (Packet, error) {
 	}
 	return pkt, pkt.Unpack(buf)
 }
+
+// Size 返回报文编码后的总长度, 用于检查是否超过对端的最大报文长度
+func Size(pkt Packet) (int, error) {
+	var w countWriter
+	if err := pkt.Pack(&w); err != nil {
+		return 0, err
+	}
+	return int(w), nil
+}
+
+type countWriter int
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	*w += countWriter(len(p))
+	return len(p), nil
+}
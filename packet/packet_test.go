@@ -132,3 +132,30 @@ func TestS2I(t *testing.T) {
 		t.Error("s2i should return 1 for non-empty string")
 	}
 }
+
+func TestUnpackLimit(t *testing.T) {
+	pub := &PUBLISH{
+		FixedHeader: &FixedHeader{Version: VERSION311, Kind: 0x3},
+		Message:     &Message{TopicName: "a/b", Content: bytes.Repeat([]byte("x"), 100)},
+	}
+	var buf bytes.Buffer
+	if err := pub.Pack(&buf); err != nil {
+		t.Fatal(err)
+	}
+	size, err := Size(pub)
+	if err != nil || size != buf.Len() {
+		t.Fatalf("Size = %d, %v, want %d", size, err, buf.Len())
+	}
+
+	if _, err := UnpackLimit(VERSION311, bytes.NewReader(buf.Bytes()), uint32(size)); err != nil {
+		t.Fatalf("UnpackLimit(size) err = %v", err)
+	}
+	r := bytes.NewReader(buf.Bytes())
+	if _, err := UnpackLimit(VERSION311, r, uint32(size-1)); err != ErrPacketTooLarge {
+		t.Fatalf("UnpackLimit(size-1) err = %v, want %v", err, ErrPacketTooLarge)
+	}
+	// 超过限制时不读取剩余部分
+	if r.Len() != size-2 {
+		t.Fatalf("remaining = %d, want %d", r.Len(), size-2)
+	}
+}
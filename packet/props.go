@@ -212,6 +212,9 @@ func (s AuthenticationMethod) String() string {
 type AuthenticationData []byte
 
 func (s AuthenticationData) Pack(buf *bytes.Buffer) error {
+	if len(s) == 0 {
+		return nil
+	}
 	buf.WriteByte(0x16)
 	buf.Write(encodeUTF8(s))
 	return nil
@@ -410,6 +413,9 @@ func (s ServerKeepAlive) Uint16() uint16 {
 type ResponseInformation string
 
 func (s ResponseInformation) Pack(buf *bytes.Buffer) error {
+	if s == "" {
+		return nil
+	}
 	buf.WriteByte(0x1A)
 	buf.Write(encodeUTF8(s))
 	return nil
@@ -430,6 +436,9 @@ func (s ResponseInformation) String() string {
 type ServerReference string
 
 func (s ServerReference) Pack(buf *bytes.Buffer) error {
+	if s == "" {
+		return nil
+	}
 	buf.WriteByte(0x1C)
 	buf.Write(encodeUTF8(s))
 	return nil
@@ -564,18 +573,24 @@ func (s SubscriptionIdentifier) Pack(buf *bytes.Buffer) error {
 	if s == 0 {
 		return nil
 	}
+	// 订阅标识符是变长字节整数
+	vb, err := encodeLength(s)
+	if err != nil {
+		return err
+	}
 	buf.WriteByte(0x0B)
-	buf.Write(i4b(uint32(s)))
+	buf.Write(vb)
 	return nil
 }
 
 func (s *SubscriptionIdentifier) Unpack(buf *bytes.Buffer) (uint32, error) {
+	n := buf.Len()
 	identifier, err := decodeLength(buf)
 	if err != nil {
 		return 0, err
 	}
 	*s = SubscriptionIdentifier(identifier)
-	return uint32(identifier), nil
+	return uint32(n - buf.Len()), nil // 返回变长字节整数占用的字节数
 }
 
 // 添加类型转换方法以保持兼容性
@@ -586,6 +601,9 @@ func (s SubscriptionIdentifier) Uint32() uint32 {
 type AssignedClientID string
 
 func (s AssignedClientID) Pack(buf *bytes.Buffer) error {
+	if s == "" {
+		return nil
+	}
 	buf.WriteByte(0x12)
 	buf.Write(encodeUTF8(s))
 	return nil
@@ -0,0 +1,59 @@
+package mqtt
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// ErrPacketIDExhausted 会话中所有的报文标识符都在等待确认, 无法发送新的QoS>0的报文
+var ErrPacketIDExhausted = errors.New("mqtt: packet identifiers exhausted")
+
+// packetIDs 会话内的报文标识符分配器, 可以被多个goroutine同时使用
+//
+// MQTT v3.1.1: 参考章节 2.3.1 Packet Identifier
+// MQTT v5.0: 参考章节 2.2.1 Packet Identifier
+// - QoS>0的PUBLISH, SUBSCRIBE, UNSUBSCRIBE报文必须包含非0的报文标识符 [MQTT-2.3.1-1]
+// - 每次发送新的报文时必须使用当前未使用的报文标识符 [MQTT-2.3.1-2]
+// - 收到对应的确认报文后, 报文标识符可以重新使用
+type packetIDs struct {
+	mu   sync.Mutex
+	last uint16
+	used map[uint16]struct{}
+}
+
+// next 分配一个未使用的报文标识符, 跳过0和正在使用的标识符; 全部在使用中时返回 ErrPacketIDExhausted
+func (p *packetIDs) next() (uint16, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.used) >= math.MaxUint16 {
+		return 0, ErrPacketIDExhausted
+	}
+	if p.used == nil {
+		p.used = make(map[uint16]struct{})
+	}
+	for {
+		p.last++
+		if p.last == 0 {
+			continue
+		}
+		if _, ok := p.used[p.last]; !ok {
+			p.used[p.last] = struct{}{}
+			return p.last, nil
+		}
+	}
+}
+
+// release 收到确认后释放报文标识符
+func (p *packetIDs) release(id uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, id)
+}
+
+// reset 释放所有报文标识符
+func (p *packetIDs) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clear(p.used)
+}
@@ -0,0 +1,101 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+func TestPacketIDsSkipZeroAndUsed(t *testing.T) {
+	var p packetIDs
+	p.last = math.MaxUint16 - 1
+	if id, _ := p.next(); id != math.MaxUint16 {
+		t.Fatalf("next() = %d, want %d", id, math.MaxUint16)
+	}
+	// 回绕时跳过0
+	if id, _ := p.next(); id != 1 {
+		t.Fatalf("next() = %d, want 1", id)
+	}
+	// 跳过正在使用的标识符
+	p.used[2] = struct{}{}
+	if id, _ := p.next(); id != 3 {
+		t.Fatalf("next() = %d, want 3", id)
+	}
+}
+
+func TestPacketIDsExhausted(t *testing.T) {
+	var p packetIDs
+	for i := 0; i < math.MaxUint16; i++ {
+		if _, err := p.next(); err != nil {
+			t.Fatalf("next() #%d: %v", i, err)
+		}
+	}
+	if _, err := p.next(); !errors.Is(err, ErrPacketIDExhausted) {
+		t.Fatalf("next() err = %v, want ErrPacketIDExhausted", err)
+	}
+	p.release(100)
+	if id, err := p.next(); err != nil || id != 100 {
+		t.Fatalf("next() after release = %d, %v, want 100", id, err)
+	}
+}
+
+func TestPacketIDsConcurrent(t *testing.T) {
+	var p packetIDs
+	var mu sync.Mutex
+	seen := make(map[uint16]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				id, err := p.next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("duplicate packet id %d", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestOutFlightPacketIDsExhausted(t *testing.T) {
+	o := newOutFlight()
+	for i := 0; i < math.MaxUint16; i++ {
+		if _, err := o.ids.next(); err != nil {
+			t.Fatalf("next() #%d: %v", i, err)
+		}
+	}
+	// 报文标识符用完时消息不能发送, 不能使用为0的报文标识符 [MQTT-2.3.1-1]
+	pub := &packet.PUBLISH{FixedHeader: &packet.FixedHeader{Kind: PUBLISH, QoS: 1}, Message: &packet.Message{TopicName: "a/b"}}
+	if sent, err := o.put(pub, 10, QueueDropOldest); sent || !errors.Is(err, ErrPacketIDExhausted) {
+		t.Fatalf("put() = %v, %v, want false, ErrPacketIDExhausted", sent, err)
+	}
+	if o.Len() != 0 || pub.PacketID != 0 {
+		t.Errorf("outFlight = %d, packetId = %d, the message should not be stored", o.Len(), pub.PacketID)
+	}
+
+	// 发送时返回错误, 不写入报文标识符为0的PUBLISH
+	var buf bytes.Buffer
+	c := &conn{ID: "c", server: NewServer(context.Background()), session: &session{outFlight: o}}
+	c.bw = bufio.NewWriter(&buf)
+	if err := c.sendPublish(&response{conn: c}, pub); !errors.Is(err, ErrPacketIDExhausted) {
+		t.Errorf("sendPublish() = %v, want ErrPacketIDExhausted", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("sendPublish() wrote %d bytes, want none", buf.Len())
+	}
+}
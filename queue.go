@@ -0,0 +1,125 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+// DefaultMaxOfflineMessages 离线队列的默认最大长度
+const DefaultMaxOfflineMessages = 1000
+
+// ErrQueueFull 离线队列已满且溢出策略为 QueueReject
+var ErrQueueFull = errors.New("mqtt: offline queue full")
+
+// QueueOverflow 离线队列已满时的处理策略
+type QueueOverflow int
+
+const (
+	// QueueDropOldest 丢弃队列中最早的消息, 保留最新的消息
+	QueueDropOldest QueueOverflow = iota
+
+	// QueueDropNewest 丢弃新到达的消息, 保留队列中已有的消息
+	QueueDropNewest
+
+	// QueueReject 拒绝新到达的消息, 并向发布者返回 ErrQueueFull;
+	// v5.0的QoS1发布者会在PUBACK中收到原因码0x97(Quota exceeded)
+	QueueReject
+)
+
+func (q QueueOverflow) String() string {
+	switch q {
+	case QueueDropOldest:
+		return "drop-oldest"
+	case QueueDropNewest:
+		return "drop-newest"
+	case QueueReject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+// offlineQueue 客户端离线期间需要发送给它的消息
+//
+// MQTT v3.1.1: 参考章节 3.1.2.4 Clean Session
+// MQTT v5.0: 参考章节 4.1 Storing state
+// - 会话状态包括: 已经匹配订阅但客户端断开时还未发送的QoS1/QoS2消息, 以及可选的QoS0消息
+//
+// 会话的离线队列保存消息和入队时匹配订阅得到的转发选项, 发送时不需要重新匹配会话的订阅;
+// outFlight 的等待队列保存已经生成的PUBLISH报文
+type offlineQueue[T any] struct {
+	mu    sync.Mutex
+	items []T
+}
+
+// push 消息入队, 队列已满时按溢出策略处理; 返回值表示消息是否入队
+func (q *offlineQueue[T]) push(item T, max int, overflow QueueOverflow) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) < max {
+		q.items = append(q.items, item)
+		return true, nil
+	}
+	switch overflow {
+	case QueueDropNewest:
+		return false, nil
+	case QueueReject:
+		return false, ErrQueueFull
+	default:
+		var zero T
+		q.items[0] = zero
+		q.items = append(q.items[1:], item)
+		return true, nil
+	}
+}
+
+// drain 按入队顺序取出全部消息并清空队列
+func (q *offlineQueue[T]) drain() []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := q.items
+	q.items = nil
+	return items
+}
+
+// shift 取出队列头部的消息, 队列为空时返回false
+func (q *offlineQueue[T]) shift() (T, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var zero T
+	if len(q.items) == 0 {
+		return zero, false
+	}
+	item := q.items[0]
+	q.items[0] = zero
+	q.items = q.items[1:]
+	return item, true
+}
+
+// requeue 将未能发送的消息放回队列头部, 保持原有顺序
+func (q *offlineQueue[T]) requeue(items []T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(items[:len(items):len(items)], q.items...)
+}
+
+func (q *offlineQueue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// enqueue 将消息放入离线会话的队列, d为消息匹配该会话的订阅后的转发选项
+func (s *Server) enqueue(sess *session, pub *packet.PUBLISH, d delivery) error {
+	// 按订阅降级后为QoS0的消息, 默认不缓存
+	if min(pub.QoS, d.qos) == 0 && !s.OfflineQueueQoS0 {
+		return nil
+	}
+	queued, err := sess.queue.push(outboundMessage{pub: pub, d: d}, s.maxOfflineMessages(), s.OfflineOverflow)
+	if !queued {
+		stat.OfflineDropped.Inc()
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+func TestOfflineQueueOverflow(t *testing.T) {
+	testCases := []struct {
+		overflow QueueOverflow
+		want     string
+		err      error
+	}{
+		{QueueDropOldest, "23", nil},
+		{QueueDropNewest, "12", nil},
+		{QueueReject, "12", ErrQueueFull},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.overflow.String(), func(t *testing.T) {
+			var q offlineQueue[outboundMessage]
+			var err error
+			for _, content := range []string{"1", "2", "3"} {
+				_, err = q.push(outboundMessage{pub: newTestPublish("a/b", content, 1)}, 2, tc.overflow)
+			}
+			if !errors.Is(err, tc.err) {
+				t.Errorf("push() err = %v, want %v", err, tc.err)
+			}
+			got := ""
+			for _, m := range q.drain() {
+				got += string(m.pub.Message.Content)
+			}
+			if got != tc.want {
+				t.Errorf("queue = %s, want %s", got, tc.want)
+			}
+			if q.Len() != 0 {
+				t.Error("drain should empty the queue")
+			}
+		})
+	}
+}
+
+func TestOfflineQueueRequeue(t *testing.T) {
+	var q offlineQueue[*packet.PUBLISH]
+	_, _ = q.push(newTestPublish("a/b", "3", 1), 10, QueueDropOldest)
+	q.requeue([]*packet.PUBLISH{newTestPublish("a/b", "1", 1), newTestPublish("a/b", "2", 1)})
+	got := ""
+	for _, pub := range q.drain() {
+		got += string(pub.Message.Content)
+	}
+	if got != "123" {
+		t.Errorf("queue = %s, want 123", got)
+	}
+}
+
+func TestServerEnqueue(t *testing.T) {
+	s := NewServer(context.Background())
+	c := &conn{ID: "offline"}
+	sess, _ := s.sessions.attach(c, false, SessionExpiryNever)
+	sub := subscription{Subscription: packet.Subscription{TopicFilter: "a/+", MaximumQoS: 1}}
+	_, _ = sess.subscribe(sub.Subscription, 0)
+	_ = s.memorySubscribed.Subscribe(sess, sub)
+	s.sessions.detach(c)
+
+	_ = s.memorySubscribed.Publish(newTestPublish("a/b", "qos1", 1), "")
+	_ = s.memorySubscribed.Publish(newTestPublish("a/b", "qos0", 0), "")
+	if sess.queue.Len() != 1 {
+		t.Fatalf("queue = %d, want 1 (QoS0 not queued by default)", sess.queue.Len())
+	}
+
+	s.OfflineQueueQoS0 = true
+	_ = s.memorySubscribed.Publish(newTestPublish("a/b", "qos0", 0), "")
+	if sess.queue.Len() != 2 {
+		t.Fatalf("queue = %d, want 2", sess.queue.Len())
+	}
+}
+
+func TestServerEnqueueReject(t *testing.T) {
+	s := NewServer(context.Background())
+	s.MaxOfflineMessages, s.OfflineOverflow = 1, QueueReject
+	var sessions []*session
+	for _, clientID := range []string{"full", "empty"} {
+		c := &conn{ID: clientID}
+		sess, _ := s.sessions.attach(c, false, SessionExpiryNever)
+		subscribeTest(t, s, sess, packet.Subscription{TopicFilter: "a/b", MaximumQoS: 1})
+		s.sessions.detach(c)
+		sessions = append(sessions, sess)
+	}
+	_, _ = sessions[0].queue.push(outboundMessage{pub: newTestPublish("a/b", "0", 1)}, 1, QueueReject)
+
+	// 有会话接收了消息时不返回错误, 避免发布者重发后接收的会话收到重复的消息
+	if err := s.memorySubscribed.Publish(newTestPublish("a/b", "1", 1), ""); err != nil {
+		t.Fatalf("Publish() = %v, want nil when a subscriber accepted", err)
+	}
+	if err := s.memorySubscribed.Publish(newTestPublish("a/b", "2", 1), ""); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Publish() = %v, want ErrQueueFull when all subscribers rejected", err)
+	}
+}
+
+func TestOfflineMessagesDeliveredOnReconnect(t *testing.T) {
+	s := NewServer(context.Background())
+	s.MaxOfflineMessages = 2
+
+	rw, _ := connectTestServer(t, s, &packet.CONNECT{ClientID: "offline"})
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION311, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{TopicFilter: "a/b", MaximumQoS: 1}},
+	})
+	if _, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.SUBACK); !ok {
+		t.Fatal("expected SUBACK")
+	}
+	_ = rw.Close()
+	waitOffline(t, s, "offline")
+
+	for i := 1; i <= 3; i++ {
+		_ = s.publish(newTestPublish("a/b", fmt.Sprint(i), 1))
+	}
+
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{ClientID: "offline"})
+	if connack.SessionPresent != 1 {
+		t.Fatal("SessionPresent should be 1")
+	}
+	for _, want := range []string{"2", "3"} {
+		pub, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+		if !ok || string(pub.Message.Content) != want {
+			t.Fatalf("offline message = %v, want %s", pub, want)
+		}
+	}
+}
+
+func TestReconnectDeliveryOrder(t *testing.T) {
+	s := NewServer(context.Background())
+	rw, _ := connectTestServer(t, s, &packet.CONNECT{ClientID: "order"})
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION311, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{TopicFilter: "a/b", MaximumQoS: 1}},
+	})
+	if _, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.SUBACK); !ok {
+		t.Fatal("expected SUBACK")
+	}
+	go func() { _ = s.publish(newTestPublish("a/b", "1", 1)) }()
+	if pub, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH); !ok || string(pub.Message.Content) != "1" {
+		t.Fatalf("expected PUBLISH 1, got %v", pub)
+	}
+	_ = rw.Close()
+	waitOffline(t, s, "order")
+	_ = s.publish(newTestPublish("a/b", "2", 1))
+
+	// 重连后依次发送未确认的消息、离线期间积压的消息和之后转发的消息
+	rw, _ = connectTestServer(t, s, &packet.CONNECT{ClientID: "order"})
+	go func() { _ = s.publish(newTestPublish("a/b", "3", 1)) }()
+	for _, want := range []struct {
+		content string
+		dup     uint8
+	}{{"1", 1}, {"2", 0}, {"3", 0}} {
+		pub, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+		if !ok || string(pub.Message.Content) != want.content || pub.Dup != want.dup {
+			t.Fatalf("expected PUBLISH %s with DUP=%d, got %v", want.content, want.dup, pub)
+		}
+	}
+}
+
+// waitOffline 等待服务端完成连接关闭后的会话解绑
+func waitOffline(t *testing.T, s *Server, clientID string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		s.sessions.mu.Lock()
+		sess, ok := s.sessions.maps[clientID]
+		offline := ok && sess.conn == nil
+		s.sessions.mu.Unlock()
+		if offline {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("session %s is still online", clientID)
+}
@@ -0,0 +1,134 @@
+package mqtt
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+	"github.com/golang-io/mqtt/topic"
+)
+
+// RetainStore 保留消息存储
+//
+// MQTT v3.1.1: 参考章节 3.3.1.3 RETAIN
+// MQTT v5.0: 参考章节 3.3.1.3 RETAIN
+// - RETAIN=1 的PUBLISH报文, 服务端必须存储该应用消息, 替换该主题已有的保留消息 [MQTT-3.3.1-5]
+// - 载荷为空的保留消息会清除该主题已有的保留消息 [MQTT-3.3.1-10] [MQTT-3.3.1-11]
+// - 建立新订阅时, 与主题过滤器匹配的保留消息必须发送给订阅者 [MQTT-3.3.1-6]
+type RetainStore interface {
+	// Store 保存主题的最新保留消息
+	Store(pub *packet.PUBLISH)
+
+	// Delete 删除主题的保留消息
+	Delete(topicName string)
+
+	// Match 返回所有与主题过滤器匹配的保留消息
+	Match(topicFilter string) []*packet.PUBLISH
+}
+
+// MemoryRetained 基于内存的保留消息存储, 服务重启后保留消息会丢失
+type MemoryRetained struct {
+	maps map[string]*packet.PUBLISH // topicName: PUBLISH
+	mu   sync.RWMutex
+}
+
+func NewMemoryRetained() *MemoryRetained {
+	return &MemoryRetained{maps: make(map[string]*packet.PUBLISH)}
+}
+
+func (m *MemoryRetained) Store(pub *packet.PUBLISH) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maps[pub.Message.TopicName] = pub
+}
+
+func (m *MemoryRetained) Delete(topicName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.maps, topicName)
+}
+
+// Match 返回匹配的保留消息, 同时删除已经过期的保留消息
+func (m *MemoryRetained) Match(topicFilter string) []*packet.PUBLISH {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var pubs []*packet.PUBLISH
+	now := time.Now()
+	for topicName, pub := range m.maps {
+		if !topic.Match(topicFilter, topicName) {
+			continue
+		}
+		if expired(pub, now) {
+			delete(m.maps, topicName)
+			continue
+		}
+		pubs = append(pubs, pub)
+	}
+	return pubs
+}
+
+// retain 按照RETAIN标志更新保留消息, 载荷为空时删除保留消息
+func (s *Server) retain(pub *packet.PUBLISH) {
+	if pub.Retain == 0 || s.RetainStore == nil {
+		return
+	}
+	if len(pub.Message.Content) == 0 {
+		s.RetainStore.Delete(pub.Message.TopicName)
+		return
+	}
+	// 保存副本, 避免后续对报文的修改影响保留消息
+	s.RetainStore.Store(&packet.PUBLISH{
+		FixedHeader: &packet.FixedHeader{Kind: PUBLISH, QoS: pub.QoS, Retain: 1},
+		Message:     pub.Message,
+		Props:       pub.Props,
+		ExpiresAt:   pub.ExpiresAt,
+	})
+}
+
+// sendRetained 在建立订阅时向客户端发送匹配的保留消息
+//
+// MQTT v5.0: 参考章节 3.8.3.1 Subscription Options
+// - Retain Handling=0: 建立订阅时发送保留消息
+// - Retain Handling=1: 仅当订阅之前不存在时发送保留消息
+// - Retain Handling=2: 建立订阅时不发送保留消息
+// 因建立订阅而发送的保留消息, RETAIN标志必须设置为1 [MQTT-3.3.1-8]
+func (c *conn) sendRetained(sub packet.Subscription, identifier uint32, existed bool) {
+	store := c.server.RetainStore
+	// 建立共享订阅时不发送保留消息, 参考章节 4.8.2 Shared Subscriptions
+	if store == nil || strings.HasPrefix(sub.TopicFilter, sharePrefix) {
+		return
+	}
+	switch sub.RetainHandling {
+	case 1:
+		if existed {
+			return
+		}
+	case 2:
+		return
+	}
+	now := time.Now()
+	for _, retained := range store.Match(sub.TopicFilter) {
+		if expired(retained, now) { // 过期的保留消息不再发送给新的订阅者
+			continue
+		}
+		pub := &packet.PUBLISH{
+			FixedHeader: &packet.FixedHeader{Version: c.version, Kind: PUBLISH, QoS: min(retained.QoS, sub.MaximumQoS), Retain: 1},
+			Message:     retained.Message,
+			ExpiresAt:   retained.ExpiresAt,
+		}
+		if retained.Props != nil {
+			props := *retained.Props
+			props.TopicAlias = 0 // 主题别名只在单个网络连接内有效
+			pub.Props = &props
+		}
+		if c.version == packet.VERSION500 && identifier != 0 {
+			pub.Props = withSubscriptionIdentifiers(pub.Props, []uint32{identifier})
+		}
+		if err := c.sendPublish(&response{conn: c}, pub); err != nil {
+			log.Printf("send retained: clientId=%s, topic=%s, err=%v", c.ID, pub.Message.TopicName, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+func TestMemoryRetained(t *testing.T) {
+	store := NewMemoryRetained()
+	store.Store(newTestPublish("a/b", "1", 0))
+	store.Store(newTestPublish("a/c", "2", 1))
+	store.Store(newTestPublish("b", "3", 0))
+
+	if got := len(store.Match("a/+")); got != 2 {
+		t.Errorf("Match(a/+) = %d messages, want 2", got)
+	}
+	if got := len(store.Match("#")); got != 3 {
+		t.Errorf("Match(#) = %d messages, want 3", got)
+	}
+
+	// 同一主题的保留消息会被替换
+	store.Store(newTestPublish("a/b", "4", 0))
+	pubs := store.Match("a/b")
+	if len(pubs) != 1 || string(pubs[0].Message.Content) != "4" {
+		t.Errorf("retained message should be replaced, got %v", pubs)
+	}
+
+	store.Delete("a/b")
+	if got := len(store.Match("a/b")); got != 0 {
+		t.Errorf("Match(a/b) after delete = %d messages, want 0", got)
+	}
+}
+
+func TestServerRetain(t *testing.T) {
+	s := NewServer(context.Background())
+
+	retained := newTestPublish("a/b", "1", 1)
+	retained.Retain = 1
+	s.retain(retained)
+	if got := len(s.RetainStore.Match("a/b")); got != 1 {
+		t.Fatalf("retained messages = %d, want 1", got)
+	}
+
+	// RETAIN=0 的消息不能替换或删除保留消息 [MQTT-3.3.1-12]
+	s.retain(&packet.PUBLISH{FixedHeader: &packet.FixedHeader{Kind: PUBLISH}, Message: &packet.Message{TopicName: "a/b"}})
+	if got := len(s.RetainStore.Match("a/b")); got != 1 {
+		t.Fatalf("retained messages = %d, want 1", got)
+	}
+
+	// 空载荷清除保留消息
+	empty := newTestPublish("a/b", "", 0)
+	empty.Retain = 1
+	s.retain(empty)
+	if got := len(s.RetainStore.Match("a/b")); got != 0 {
+		t.Fatalf("retained messages = %d, want 0", got)
+	}
+}
+
+func TestRetainedDeliveredOnSubscribe(t *testing.T) {
+	s := NewServer(context.Background())
+
+	pub, _ := connectTestServer(t, s, &packet.CONNECT{ClientID: "publisher"})
+	writeTestPacket(t, pub, &packet.PUBLISH{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBLISH, QoS: 1, Retain: 1},
+		PacketID:    1,
+		Message:     &packet.Message{TopicName: "sensor/temp", Content: []byte("21")},
+	})
+	if _, ok := readTestPacket(t, pub, packet.VERSION311).(*packet.PUBACK); !ok {
+		t.Fatal("expected PUBACK")
+	}
+
+	sub, _ := connectTestServer(t, s, &packet.CONNECT{ClientID: "subscriber"})
+	writeTestPacket(t, sub, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION311, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{TopicFilter: "sensor/#", MaximumQoS: 0}},
+	})
+	if _, ok := readTestPacket(t, sub, packet.VERSION311).(*packet.SUBACK); !ok {
+		t.Fatal("expected SUBACK")
+	}
+	retained, ok := readTestPacket(t, sub, packet.VERSION311).(*packet.PUBLISH)
+	if !ok {
+		t.Fatal("expected retained PUBLISH")
+	}
+	if retained.Retain != 1 {
+		t.Errorf("Retain = %d, want 1", retained.Retain)
+	}
+	if retained.QoS != 0 {
+		t.Errorf("QoS = %d, want min(1, 0)", retained.QoS)
+	}
+	if string(retained.Message.Content) != "21" {
+		t.Errorf("Content = %s, want 21", retained.Message.Content)
+	}
+}
+
+func TestSendRetainedRetainHandling(t *testing.T) {
+	s := NewServer(context.Background())
+	s.RetainStore.Store(newTestPublish("a/b", "1", 1))
+	c := s.newConn(&mockConn{})
+
+	// mockConn 不会阻塞写入, 通过未确认消息的数量是否变化判断是否发送了保留消息
+	for _, tc := range []struct {
+		sub     packet.Subscription
+		existed bool
+		sent    bool
+	}{
+		{packet.Subscription{TopicFilter: "a/b", MaximumQoS: 1, RetainHandling: 0}, true, true},
+		{packet.Subscription{TopicFilter: "a/b", MaximumQoS: 1, RetainHandling: 1}, false, true},
+		{packet.Subscription{TopicFilter: "a/b", MaximumQoS: 1, RetainHandling: 1}, true, false},
+		{packet.Subscription{TopicFilter: "a/b", MaximumQoS: 1, RetainHandling: 2}, false, false},
+	} {
+		before := c.session.outFlight.Len()
+		c.sendRetained(tc.sub, 0, tc.existed)
+		if sent := c.session.outFlight.Len() != before; sent != tc.sent {
+			t.Errorf("RetainHandling=%d existed=%v: sent=%v, want %v", tc.sub.RetainHandling, tc.existed, sent, tc.sent)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package mqtt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang-io/mqtt/packet"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SCRAMCredential 用户的SCRAM凭证, 服务端只保存派生后的密钥而不是明文密码
+//
+// 参考 RFC 5802 Section 3, RFC 7677
+type SCRAMCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte // H(HMAC(SaltedPassword, "Client Key"))
+	ServerKey  []byte // HMAC(SaltedPassword, "Server Key")
+}
+
+// NewSCRAMCredential 根据明文密码生成SCRAM-SHA-256凭证
+func NewSCRAMCredential(password string, salt []byte, iterations int) SCRAMCredential {
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return SCRAMCredential{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	}
+}
+
+// SCRAMSHA256 SCRAM-SHA-256认证机制, 认证方法名为 "SCRAM-SHA-256"
+//
+// 认证数据的交换过程:
+//
+//	CONNECT(AuthenticationData=client-first-message)
+//	AUTH 0x18(AuthenticationData=server-first-message)
+//	AUTH 0x18(AuthenticationData=client-final-message)
+//	CONNACK(AuthenticationData=server-final-message)
+//
+// 不支持通道绑定.
+type SCRAMSHA256 struct {
+	// Credential 返回用户名对应的凭证, 用户不存在时返回false
+	Credential func(username string) (SCRAMCredential, bool)
+}
+
+func (m *SCRAMSHA256) Method() string {
+	return "SCRAM-SHA-256"
+}
+
+func (m *SCRAMSHA256) Start(ClientInfo) AuthExchange {
+	return &scramExchange{mechanism: m}
+}
+
+type scramExchange struct {
+	mechanism *SCRAMSHA256
+	step      int
+
+	username        string
+	credential      SCRAMCredential
+	nonce           string // 客户端nonce + 服务端nonce
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+}
+
+var errSCRAMInvalidMessage = errors.New("scram: invalid message")
+
+func (e *scramExchange) Username() string {
+	return e.username
+}
+
+func (e *scramExchange) Next(data []byte) ([]byte, bool, error) {
+	e.step++
+	switch e.step {
+	case 1:
+		return e.serverFirstMessage(string(data))
+	case 2:
+		return e.serverFinalMessage(string(data))
+	default:
+		return nil, false, errSCRAMInvalidMessage
+	}
+}
+
+// serverFirstMessage 处理 client-first-message: gs2-header client-first-message-bare
+func (e *scramExchange) serverFirstMessage(clientFirst string) ([]byte, bool, error) {
+	// gs2-header = gs2-cbind-flag "," [ authzid ] ","
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		return nil, false, fmt.Errorf("%w: unsupported channel binding", errSCRAMInvalidMessage)
+	}
+	e.gs2Header = parts[0] + "," + parts[1] + ","
+	e.clientFirstBare = parts[2]
+	attrs := scramAttributes(e.clientFirstBare)
+	username, clientNonce := attrs["n"], attrs["r"]
+	if username == "" || clientNonce == "" {
+		return nil, false, errSCRAMInvalidMessage
+	}
+	e.username = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(username)
+
+	credential, ok := e.mechanism.Credential(e.username)
+	if !ok {
+		return nil, false, packet.ErrBadUsernameOrPassword
+	}
+	e.credential = credential
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, false, err
+	}
+	e.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	e.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", e.nonce, base64.StdEncoding.EncodeToString(credential.Salt), credential.Iterations)
+	return []byte(e.serverFirst), false, nil
+}
+
+// serverFinalMessage 校验 client-final-message 中的ClientProof, 返回包含ServerSignature的 server-final-message
+func (e *scramExchange) serverFinalMessage(clientFinal string) ([]byte, bool, error) {
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return nil, false, errSCRAMInvalidMessage
+	}
+	withoutProof := clientFinal[:i]
+	attrs := scramAttributes(withoutProof)
+	// channel-binding 必须是 client-first-message 中 gs2-header 的base64编码, 参考 RFC 5802 Section 5.1
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(e.gs2Header)) {
+		return nil, false, fmt.Errorf("%w: channel binding mismatch", errSCRAMInvalidMessage)
+	}
+	if attrs["r"] != e.nonce {
+		return nil, false, fmt.Errorf("%w: nonce mismatch", errSCRAMInvalidMessage)
+	}
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, false, errSCRAMInvalidMessage
+	}
+
+	authMessage := e.clientFirstBare + "," + e.serverFirst + "," + withoutProof
+	clientSignature := scramHMAC(e.credential.StoredKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	for j := range clientKey {
+		clientKey[j] = proof[j] ^ clientSignature[j]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], e.credential.StoredKey) != 1 {
+		return nil, false, packet.ErrBadUsernameOrPassword
+	}
+	serverSignature := scramHMAC(e.credential.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), true, nil
+}
+
+// scramAttributes 解析 a=value,b=value 格式的SCRAM消息
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(attr, "="); ok && len(k) == 1 {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
@@ -0,0 +1,216 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang-io/mqtt/packet"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// scramClient 测试用的SCRAM-SHA-256客户端
+type scramClient struct {
+	username, password string
+	channelBinding     string // client-final-message 中的c属性, 为空时使用 "n,," 的base64编码
+	nonce              string
+	clientFirstBare    string
+	serverSignature    []byte
+}
+
+func (c *scramClient) first() []byte {
+	c.nonce = "rOprNGfwEbeRWgbNEkqO"
+	c.clientFirstBare = "n=" + c.username + ",r=" + c.nonce
+	return []byte("n,," + c.clientFirstBare)
+}
+
+func (c *scramClient) final(t *testing.T, serverFirst []byte) []byte {
+	t.Helper()
+	attrs := scramAttributes(string(serverFirst))
+	if !strings.HasPrefix(attrs["r"], c.nonce) {
+		t.Fatalf("server nonce %q does not start with client nonce", attrs["r"])
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		t.Fatalf("decode salt: %v", err)
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil {
+		t.Fatalf("parse iterations: %v", err)
+	}
+	salted := pbkdf2.Key([]byte(c.password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	channelBinding := c.channelBinding
+	if channelBinding == "" {
+		channelBinding = "biws"
+	}
+	withoutProof := "c=" + channelBinding + ",r=" + attrs["r"]
+	authMessage := c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	signature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	c.serverSignature = scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof))
+}
+
+func (c *scramClient) verify(serverFinal []byte) bool {
+	return hmac.Equal(serverFinal, []byte("v="+base64.StdEncoding.EncodeToString(c.serverSignature)))
+}
+
+func testSCRAM() *SCRAMSHA256 {
+	credential := NewSCRAMCredential("pencil", []byte("salt"), 4096)
+	return &SCRAMSHA256{Credential: func(username string) (SCRAMCredential, bool) {
+		return credential, username == "user"
+	}}
+}
+
+func TestSCRAMSHA256(t *testing.T) {
+	mech := testSCRAM()
+	if mech.Method() != "SCRAM-SHA-256" {
+		t.Fatalf("Method() = %q", mech.Method())
+	}
+
+	client := &scramClient{username: "user", password: "pencil"}
+	exchange := mech.Start(ClientInfo{})
+	serverFirst, done, err := exchange.Next(client.first())
+	if err != nil || done {
+		t.Fatalf("first step: done=%v, err=%v", done, err)
+	}
+	serverFinal, done, err := exchange.Next(client.final(t, serverFirst))
+	if err != nil || !done {
+		t.Fatalf("final step: done=%v, err=%v", done, err)
+	}
+	if !client.verify(serverFinal) {
+		t.Errorf("server signature mismatch: %s", serverFinal)
+	}
+	if exchange.Username() != "user" {
+		t.Errorf("Username() = %q", exchange.Username())
+	}
+
+	// 密码错误
+	client = &scramClient{username: "user", password: "wrong"}
+	exchange = mech.Start(ClientInfo{})
+	serverFirst, _, _ = exchange.Next(client.first())
+	if _, _, err = exchange.Next(client.final(t, serverFirst)); !errors.Is(err, packet.ErrBadUsernameOrPassword) {
+		t.Errorf("wrong password: err = %v", err)
+	}
+
+	// 篡改的channel-binding, 即使ClientProof正确也要拒绝
+	client = &scramClient{username: "user", password: "pencil", channelBinding: base64.StdEncoding.EncodeToString([]byte("y,,"))}
+	exchange = mech.Start(ClientInfo{})
+	serverFirst, _, _ = exchange.Next(client.first())
+	if _, _, err = exchange.Next(client.final(t, serverFirst)); !errors.Is(err, errSCRAMInvalidMessage) {
+		t.Errorf("tampered channel binding: err = %v", err)
+	}
+
+	// 用户不存在
+	client = &scramClient{username: "nobody", password: "pencil"}
+	if _, _, err = mech.Start(ClientInfo{}).Next(client.first()); authFailureCode(err).Code != packet.ErrBadUsernameOrPassword.Code {
+		t.Errorf("unknown user: err = %v", err)
+	}
+
+	// 格式错误的消息
+	if _, _, err = mech.Start(ClientInfo{}).Next([]byte("p=tls-unique,,n=user,r=abc")); authFailureCode(err).Code != packet.ErrNotAuthorized.Code {
+		t.Errorf("channel binding: err = %v", err)
+	}
+}
+
+// scramConnect 使用SCRAM-SHA-256完成v5.0的扩展认证
+func scramConnect(t *testing.T, s *Server, client *scramClient) (net.Conn, *packet.CONNACK) {
+	t.Helper()
+	rw := dialTestServer(t, s)
+	writeTestPacket(t, rw, &packet.CONNECT{
+		FixedHeader:  &packet.FixedHeader{Version: packet.VERSION500, Kind: CONNECT},
+		ConnectFlags: packet.ConnectFlags(0x02),
+		ClientID:     "scram",
+		Props: &packet.ConnectProperties{
+			AuthenticationMethod: "SCRAM-SHA-256",
+			AuthenticationData:   client.first(),
+		},
+	})
+	auth, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.AUTH)
+	if !ok {
+		t.Fatalf("expected AUTH")
+	}
+	if auth.ReasonCode.Code != packet.CodeContinueAuthentication.Code || auth.Props.AuthenticationMethod != "SCRAM-SHA-256" {
+		t.Fatalf("AUTH = %v, method=%q", auth.ReasonCode, auth.Props.AuthenticationMethod)
+	}
+	writeTestPacket(t, rw, scramAuth(packet.CodeContinueAuthentication, client.final(t, auth.Props.AuthenticationData)))
+	connack, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.CONNACK)
+	if !ok {
+		t.Fatalf("expected CONNACK")
+	}
+	return rw, connack
+}
+
+func scramAuth(code packet.ReasonCode, data []byte) *packet.AUTH {
+	auth := packet.NewAUTH(packet.VERSION500, code)
+	auth.Props.AuthenticationMethod = "SCRAM-SHA-256"
+	auth.Props.AuthenticationData = data
+	return auth
+}
+
+func TestEnhancedAuthSCRAM(t *testing.T) {
+	s := NewServer(context.Background())
+	s.AuthMechanisms = []AuthMechanism{testSCRAM()}
+
+	client := &scramClient{username: "user", password: "pencil"}
+	rw, connack := scramConnect(t, s, client)
+	if connack.ReturnCode.Code != 0 {
+		t.Fatalf("ReturnCode = %v, want success", connack.ReturnCode)
+	}
+	if connack.Props.AuthenticationMethod != "SCRAM-SHA-256" || !client.verify(connack.Props.AuthenticationData) {
+		t.Errorf("CONNACK auth props: method=%q, data=%s", connack.Props.AuthenticationMethod, connack.Props.AuthenticationData)
+	}
+
+	// 重新认证
+	writeTestPacket(t, rw, scramAuth(packet.CodeReAuthenticate, client.first()))
+	auth := readTestPacket(t, rw, packet.VERSION500).(*packet.AUTH)
+	if auth.ReasonCode.Code != packet.CodeContinueAuthentication.Code {
+		t.Fatalf("re-auth step 1: %v", auth.ReasonCode)
+	}
+	writeTestPacket(t, rw, scramAuth(packet.CodeContinueAuthentication, client.final(t, auth.Props.AuthenticationData)))
+	auth = readTestPacket(t, rw, packet.VERSION500).(*packet.AUTH)
+	if auth.ReasonCode.Code != packet.CodeSuccess.Code || !client.verify(auth.Props.AuthenticationData) {
+		t.Fatalf("re-auth result: %v", auth.ReasonCode)
+	}
+
+	// 使用不同的认证方法重新认证是协议错误
+	bad := scramAuth(packet.CodeReAuthenticate, client.first())
+	bad.Props.AuthenticationMethod = "PLAIN"
+	writeTestPacket(t, rw, bad)
+	disconnect, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.DISCONNECT)
+	if !ok || disconnect.ReasonCode.Code != packet.ErrProtocolErr.Code {
+		t.Fatalf("expected DISCONNECT 0x82, got %v", disconnect)
+	}
+}
+
+func TestEnhancedAuthFailure(t *testing.T) {
+	s := NewServer(context.Background())
+	s.AuthMechanisms = []AuthMechanism{testSCRAM()}
+
+	_, connack := scramConnect(t, s, &scramClient{username: "user", password: "wrong"})
+	if connack.ReturnCode.Code != packet.ErrBadUsernameOrPassword.Code {
+		t.Errorf("ReturnCode = %v, want 0x86", connack.ReturnCode)
+	}
+
+	// 不支持的认证方法
+	_, connack = connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader:  &packet.FixedHeader{Version: packet.VERSION500},
+		ConnectFlags: packet.ConnectFlags(0x02),
+		ClientID:     "plain",
+		Props:        &packet.ConnectProperties{AuthenticationMethod: "PLAIN"},
+	})
+	if connack.ReturnCode.Code != packet.ErrBadAuthenticationMethod.Code {
+		t.Errorf("ReturnCode = %v, want 0x8C", connack.ReturnCode)
+	}
+}
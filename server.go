@@ -1,10 +1,12 @@
 package mqtt
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"errors"
 	"log"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -15,7 +17,7 @@ import (
 	"time"
 
 	"github.com/golang-io/mqtt/packet"
-	"github.com/golang-io/mqtt/topic"
+	"github.com/golang-io/requests"
 	"golang.org/x/net/websocket"
 )
 
@@ -58,15 +60,32 @@ type ResponseWriter interface {
 
 // response represents the server side of an HTTP response.
 type response struct {
-	conn   *conn
-	packet packet.Packet // request for this response
+	conn     *conn
+	packet   packet.Packet // request for this response
+	buffered bool          // 为true时只写入缓冲区, 由调用者刷新, 见 conn.writeLoop
 }
 
 func (w *response) OnSend(pkt packet.Packet) error {
 	stat.PacketSent.Inc()
 	w.conn.mu.Lock()
 	defer w.conn.mu.Unlock()
-	return pkt.Pack(w.conn)
+	if err := pkt.Pack(w.conn.bw); err != nil {
+		return err
+	}
+	if w.buffered {
+		return nil
+	}
+	return w.conn.bw.Flush()
+}
+
+// onSendPublish 发送PUBLISH报文, 消息过期间隔更新为剩余的时间 [MQTT-3.3.2-6]
+func (w *response) onSendPublish(pub *packet.PUBLISH) error {
+	if !pub.ExpiresAt.IsZero() {
+		out := *pub
+		out.Props = remainingExpiry(pub, time.Now())
+		pub = &out
+	}
+	return w.OnSend(pub)
 }
 
 const (
@@ -141,23 +160,103 @@ type Server struct {
 	// value.
 	ConnContext func(ctx context.Context, c net.Conn) context.Context
 
+	// RetainStore 保存RETAIN=1的应用消息, 在建立新订阅时发送给订阅者.
+	// NewServer 默认使用 MemoryRetained; 为nil时服务端不支持保留消息.
+	RetainStore RetainStore
+
+	// Authenticator 认证客户端的CONNECT报文.
+	// 为nil时使用 CONFIG.Auth 中配置的用户名和明文密码.
+	Authenticator Authenticator
+
+	// AuthMechanisms v5.0扩展认证支持的认证方法.
+	// CONNECT中包含认证方法时使用对应的机制认证, 代替 Authenticator; 不支持的认证方法返回原因码0x8C.
+	AuthMechanisms []AuthMechanism
+
+	// Authorizer 检查客户端发布和订阅主题的权限.
+	// 为nil时不做访问控制.
+	Authorizer Authorizer
+
+	// MaxOfflineMessages 每个离线会话最多缓存的消息数量.
+	// 为0时使用 DefaultMaxOfflineMessages.
+	MaxOfflineMessages int
+
+	// OfflineOverflow 离线队列已满时的处理策略, 默认丢弃最早的消息.
+	OfflineOverflow QueueOverflow
+
+	// MaxKeepAlive 服务端允许的最大保持连接时间, 单位秒. 为0时不限制.
+	// 客户端的KeepAlive为0或者超过该值时, 服务端按该值检测连接, v5.0客户端在CONNACK的ServerKeepAlive中收到该值;
+	// v3.1.1没有通知客户端的机制, 连接仍然被接受.
+	MaxKeepAlive uint16
+
+	// MaxPacketSize 服务端接收的最大报文长度, 单位字节. 为0时不限制.
+	// 在读取报文的剩余部分之前检查, v5.0客户端会在CONNACK的MaximumPacketSize中收到该值,
+	// 超过该值的连接会被关闭, v5.0客户端会先收到原因码为0x95的DISCONNECT.
+	MaxPacketSize uint32
+
+	// TopicAliasMaximum v5.0服务端接受的客户端主题别名最大值, 在CONNACK中通知客户端.
+	// 为0时客户端不能使用主题别名.
+	TopicAliasMaximum uint16
+
+	// ReceiveMaximum v5.0服务端愿意同时处理的客户端QoS1, QoS2消息的最大数量, 在CONNACK中通知客户端.
+	// 为0时使用默认值65535. 超过该值的客户端会收到原因码为0x93的DISCONNECT.
+	ReceiveMaximum uint16
+
+	// RetryInterval v3.1.1客户端未确认的QoS1, QoS2消息的重发间隔. 为0时只在客户端重连时重发.
+	// v5.0不允许在重连以外的时机重发消息 [MQTT-4.4.0-1], 该设置对v5.0客户端无效.
+	RetryInterval time.Duration
+
+	// OfflineQueueQoS0 为true时, 客户端离线期间的QoS0消息也会被缓存.
+	OfflineQueueQoS0 bool
+
+	// MaxOutboundMessages 每个网络连接的发送队列最多缓存的消息数量, 发送队列由单独的goroutine写入网络连接.
+	// 为0时使用 DefaultMaxOutboundMessages.
+	MaxOutboundMessages int
+
+	// OutboundOverflow 发送队列已满时的处理策略, 默认丢弃QoS0消息, QoS1, QoS2消息放不下时断开连接.
+	OutboundOverflow OutboundOverflow
+
+	// ShareStrategy 共享订阅 $share/{ShareName}/{filter} 选择订阅者的策略.
+	// 为nil时使用 ShareRoundRobin.
+	ShareStrategy ShareStrategy
+
+	// TopicTrie 全局订阅索引的实现, 默认使用读写锁保护的订阅树; 必须在服务端开始接收连接之前设置.
+	// 发布远多于订阅变化时可以使用 TopicTrieCopyOnWrite, 发布时匹配订阅不加锁.
+	TopicTrie TopicTrie
+
+	// OnTakeover 可选的回调函数, 新的网络连接使用已经连接的ClientID时调用, 可以用于审计.
+	// prev为被接管的连接, 调用之后会被断开(v5.0先收到原因码为0x8E的DISCONNECT); next为新的连接.
+	OnTakeover func(prev, next ClientInfo)
+
+	// ClientIDGenerator 为ClientID为空的客户端分配ClientID, 返回值必须在服务端内唯一.
+	// 为nil时使用 requests.GenId 生成. v5.0客户端会在CONNACK的AssignedClientIdentifier中收到分配的ClientID.
+	ClientIDGenerator func(info ConnInfo) string
+
 	inShutdown atomic.Bool // true when server is in shutdown
 
 	mu            sync.RWMutex
 	listeners     map[*net.Listener]struct{}
 	activeConn    map[*conn]struct{} // ClientID:conn
+	clientsMu     sync.Mutex
+	clients       map[string]*conn // ClientID:conn, 每个ClientID只保留最新的网络连接
 	onShutdown    []func()
 	listenerGroup sync.WaitGroup
 
 	memorySubscribed *MemorySubscribed // 订阅列表
+	sessions         *sessions         // 会话状态, ClientID:session
+	shared           *sharedSubscriptions
 }
 
 func NewServer(ctx context.Context) *Server {
 	s := &Server{
-		activeConn: make(map[*conn]struct{}),
-		listeners:  make(map[*net.Listener]struct{}),
+		activeConn:  make(map[*conn]struct{}),
+		clients:     make(map[string]*conn),
+		listeners:   make(map[*net.Listener]struct{}),
+		RetainStore: NewMemoryRetained(),
 	}
 	s.memorySubscribed = NewMemorySubscribed(s)
+	s.sessions = newSessions()
+	s.sessions.ended = s.memorySubscribed.remove
+	s.shared = newSharedSubscriptions()
 
 	go func() {
 		<-ctx.Done()
@@ -242,9 +341,86 @@ func (s *Server) closeListenersLocked() error {
 	return err
 }
 
+func (s *Server) authenticator() Authenticator {
+	if s.Authenticator != nil {
+		return s.Authenticator
+	}
+	return StaticAuthenticator(CONFIG.Auth)
+}
+
+// authMechanism 返回认证方法对应的扩展认证机制, 不支持时返回nil
+func (s *Server) authMechanism(method string) AuthMechanism {
+	for _, mech := range s.AuthMechanisms {
+		if mech.Method() == method {
+			return mech
+		}
+	}
+	return nil
+}
+
+// keepAlive 计算服务端实际使用的保持连接时间, 以及是否与客户端请求的值不同
+//
+// MQTT v5.0: 参考章节 3.2.2.3.14 Server Keep Alive
+// - 服务端发送了ServerKeepAlive时, 客户端必须使用该值代替CONNECT中的KeepAlive [MQTT-3.2.2-21]
+func (s *Server) keepAlive(requested uint16) (uint16, bool) {
+	if s.MaxKeepAlive > 0 && (requested == 0 || requested > s.MaxKeepAlive) {
+		return s.MaxKeepAlive, true
+	}
+	return requested, false
+}
+
+func (s *Server) receiveMaximum() uint16 {
+	if s.ReceiveMaximum > 0 {
+		return s.ReceiveMaximum
+	}
+	return math.MaxUint16
+}
+
+func (s *Server) maxOfflineMessages() int {
+	if s.MaxOfflineMessages > 0 {
+		return s.MaxOfflineMessages
+	}
+	return DefaultMaxOfflineMessages
+}
+
+func (s *Server) maxOutboundMessages() int {
+	if s.MaxOutboundMessages > 0 {
+		return s.MaxOutboundMessages
+	}
+	return DefaultMaxOutboundMessages
+}
+
+func (s *Server) shareStrategy() ShareStrategy {
+	if s.ShareStrategy == nil {
+		return ShareRoundRobin
+	}
+	return s.ShareStrategy
+}
+
+func (s *Server) generateClientID(info ConnInfo) string {
+	if s.ClientIDGenerator == nil {
+		return requests.GenId()
+	}
+	return s.ClientIDGenerator(info)
+}
+
+// publish 分发应用消息, 并按RETAIN标志维护保留消息; 离线会话的消息进入离线队列
+func (s *Server) publish(pub *packet.PUBLISH) error {
+	return s.publishFrom("", pub)
+}
+
+// publishFrom 转发客户端发布的消息, publisher为发布者的ClientID
+func (s *Server) publishFrom(publisher string, pub *packet.PUBLISH) error {
+	stampExpiry(pub, time.Now())
+	s.retain(pub)
+	return s.memorySubscribed.Publish(pub, publisher)
+}
+
 // Create new connection from rwc.
 func (s *Server) newConn(rwc net.Conn) *conn {
-	c := &conn{server: s, rwc: rwc, subscribeTopics: topic.NewMemoryTrie(), inFight: newInFight()}
+	c := &conn{server: s, rwc: rwc, session: newSession("")}
+	c.bw = bufio.NewWriter(c)
+	c.outbound = newOutboundQueue(s.maxOutboundMessages(), s.OutboundOverflow)
 	return c
 }
 
@@ -2,6 +2,8 @@ package mqtt
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -107,6 +109,192 @@ func TestServerShuttingDown(t *testing.T) {
 
 // TestServerHandler is removed due to panic issues with mock connections
 
+func TestServerKeepAlive(t *testing.T) {
+	s := &Server{}
+	if got, overridden := s.keepAlive(0); got != 0 || overridden {
+		t.Errorf("keepAlive(0) = %d, %v", got, overridden)
+	}
+	s.MaxKeepAlive = 60
+	for _, tc := range []struct {
+		requested  uint16
+		want       uint16
+		overridden bool
+	}{
+		{0, 60, true},
+		{30, 30, false},
+		{60, 60, false},
+		{120, 60, true},
+	} {
+		if got, overridden := s.keepAlive(tc.requested); got != tc.want || overridden != tc.overridden {
+			t.Errorf("keepAlive(%d) = %d, %v, want %d, %v", tc.requested, got, overridden, tc.want, tc.overridden)
+		}
+	}
+}
+
+func TestServerMaxKeepAlive(t *testing.T) {
+	s := NewServer(context.Background())
+	s.MaxKeepAlive = 30
+
+	// v5.0: 服务端在CONNACK中返回ServerKeepAlive
+	_, connack := connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader:  &packet.FixedHeader{Version: packet.VERSION500},
+		ConnectFlags: packet.ConnectFlags(0x02),
+		ClientID:     "v5",
+		KeepAlive:    120,
+		Props:        &packet.ConnectProperties{},
+	})
+	if connack.ReturnCode.Code != 0 {
+		t.Fatalf("ReturnCode = %v", connack.ReturnCode)
+	}
+	if connack.Props.ServerKeepAlive == nil || *connack.Props.ServerKeepAlive != 30 {
+		t.Errorf("ServerKeepAlive = %v, want 30", connack.Props.ServerKeepAlive)
+	}
+
+	// v3.1.1: 接受连接, 服务端按最大值检测连接; KeepAlive为0时同样使用最大值
+	for _, requested := range []uint16{120, 0} {
+		clientID := fmt.Sprintf("v3-%d", requested)
+		_, connack = connectTestServer(t, s, &packet.CONNECT{ConnectFlags: packet.ConnectFlags(0x02), ClientID: clientID, KeepAlive: requested})
+		if connack.ReturnCode.Code != 0 {
+			t.Fatalf("ReturnCode = %v, want 0", connack.ReturnCode)
+		}
+		s.clientsMu.Lock()
+		c := s.clients[clientID]
+		s.clientsMu.Unlock()
+		if c == nil {
+			t.Fatalf("client %s is not connected", clientID)
+		}
+		if c.keepAlive != 30 {
+			t.Errorf("keepAlive(%d): server uses %d, want 30", requested, c.keepAlive)
+		}
+	}
+}
+
+func TestAssignedClientID(t *testing.T) {
+	s := NewServer(context.Background())
+	n := 0
+	s.ClientIDGenerator = func(info ConnInfo) string {
+		n++
+		return fmt.Sprintf("auto-%d", n)
+	}
+
+	// v5.0: 服务端在CONNACK中返回分配的客户标识符 [MQTT-3.2.2-16]
+	for _, want := range []string{"auto-1", "auto-2"} {
+		_, connack := connectTestServer(t, s, &packet.CONNECT{
+			FixedHeader:  &packet.FixedHeader{Version: packet.VERSION500},
+			ConnectFlags: packet.ConnectFlags(0x02),
+			Props:        &packet.ConnectProperties{},
+		})
+		if connack.ReturnCode.Code != 0 || connack.Props.AssignedClientID != packet.AssignedClientID(want) {
+			t.Fatalf("ReturnCode = %v, AssignedClientID = %q, want %q", connack.ReturnCode, connack.Props.AssignedClientID, want)
+		}
+	}
+	// 匿名客户端使用各自的会话, 不会互相接管
+	if got := s.sessions.Len(); got != 2 {
+		t.Errorf("sessions = %d, want 2", got)
+	}
+
+	// v3.1.1: ClientID为空时必须设置CleanSession=1 [MQTT-3.1.3-7] [MQTT-3.1.3-8]
+	_, connack := connectTestServer(t, s, &packet.CONNECT{ConnectFlags: packet.ConnectFlags(0x00)})
+	if connack.ReturnCode.Code != packet.Err3ClientIdentifierNotValid.Code {
+		t.Errorf("ReturnCode = %v, want 0x02", connack.ReturnCode)
+	}
+	_, connack = connectTestServer(t, s, &packet.CONNECT{ConnectFlags: packet.ConnectFlags(0x02)})
+	if connack.ReturnCode.Code != 0 {
+		t.Errorf("ReturnCode = %v, want 0", connack.ReturnCode)
+	}
+	s.sessions.mu.Lock()
+	_, ok := s.sessions.maps["auto-3"]
+	s.sessions.mu.Unlock()
+	if !ok {
+		t.Error("v3.1.1 client should be assigned a ClientID")
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	s := NewServer(context.Background())
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader:  &packet.FixedHeader{Version: packet.VERSION500},
+		ConnectFlags: packet.ConnectFlags(0x02),
+		ClientID:     "idle",
+		KeepAlive:    1,
+		Props:        &packet.ConnectProperties{},
+	})
+	if connack.ReturnCode.Code != 0 {
+		t.Fatalf("ReturnCode = %v", connack.ReturnCode)
+	}
+
+	// 1.5倍保持连接时间内没有收到报文, 服务端发送DISCONNECT 0x8D并关闭连接
+	start := time.Now()
+	_ = rw.SetReadDeadline(start.Add(3 * time.Second))
+	pkt, err := packet.Unpack(packet.VERSION500, rw)
+	if err != nil {
+		t.Fatalf("read packet: %v", err)
+	}
+	disconnect, ok := pkt.(*packet.DISCONNECT)
+	if !ok || disconnect.ReasonCode.Code != packet.ErrKeepAliveTimeout.Code {
+		t.Fatalf("expected DISCONNECT 0x8D, got %v", pkt)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("disconnected after %v, want about 1.5s", elapsed)
+	}
+	if _, err := rw.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection should be closed, err = %v", err)
+	}
+}
+
+// dialTestServer 通过net.Pipe建立一个由服务端处理的连接, 返回客户端一侧
+func dialTestServer(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	c := s.newConn(server)
+	c.setState(c.rwc, StateNew, true)
+	go c.serve(context.Background())
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+// connectTestServer 建立连接并完成CONNECT/CONNACK交互
+func connectTestServer(t *testing.T, s *Server, connect *packet.CONNECT) (net.Conn, *packet.CONNACK) {
+	t.Helper()
+	rw := dialTestServer(t, s)
+	if connect.FixedHeader == nil {
+		connect.FixedHeader = &packet.FixedHeader{Version: packet.VERSION311}
+	}
+	connect.FixedHeader.Kind = CONNECT
+	writeTestPacket(t, rw, connect)
+	connack, ok := readTestPacket(t, rw, connect.Version).(*packet.CONNACK)
+	if !ok {
+		t.Fatalf("expected CONNACK")
+	}
+	return rw, connack
+}
+
+// newTestPublish 创建测试使用的PUBLISH报文, 其他固定报头字段由调用者按需设置
+func newTestPublish(topicName, content string, qos uint8) *packet.PUBLISH {
+	return &packet.PUBLISH{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION311, Kind: PUBLISH, QoS: qos},
+		Message:     &packet.Message{TopicName: topicName, Content: []byte(content)},
+	}
+}
+
+func writeTestPacket(t *testing.T, rw net.Conn, pkt packet.Packet) {
+	t.Helper()
+	_ = rw.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := pkt.Pack(rw); err != nil {
+		t.Fatalf("write %T: %v", pkt, err)
+	}
+}
+
+func readTestPacket(t *testing.T, rw net.Conn, version byte) packet.Packet {
+	t.Helper()
+	_ = rw.SetReadDeadline(time.Now().Add(time.Second))
+	pkt, err := packet.Unpack(version, rw)
+	if err != nil {
+		t.Fatalf("read packet: %v", err)
+	}
+	return pkt
+}
+
 // Mock implementations for testing
 type mockConn struct {
 	closed bool
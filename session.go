@@ -0,0 +1,221 @@
+package mqtt
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+	"github.com/golang-io/mqtt/topic"
+)
+
+// SessionExpiryNever 会话永不过期
+//
+// MQTT v5.0: 参考章节 3.1.2.11.2 Session Expiry Interval
+// - 会话过期间隔为0xFFFFFFFF表示会话永不过期
+const SessionExpiryNever = 0xFFFFFFFF
+
+// session 会话状态, 生命周期可以长于网络连接
+//
+// MQTT v3.1.1: 参考章节 3.1.2.4 Clean Session
+// MQTT v5.0: 参考章节 3.1.2.4 Clean Start, 4.1 Storing state
+// 服务端的会话状态包括:
+// - 客户端的订阅信息
+// - 已从客户端接收, 但还没有完成确认的QoS2消息
+// - 客户端离线期间匹配订阅, 等待发送的消息
+type session struct {
+	clientID      string
+	subscriptions map[string]subscription // 订阅选项, key为主题过滤器
+	subMu         sync.RWMutex
+	inFight       *InFight   // 用这个字典来保存没有处理完QoS1，2的报文
+	outFlight     *outFlight // 发送给客户端还没有完成确认的QoS1, QoS2消息
+	queue         offlineQueue[outboundMessage]
+
+	// 以下字段由sessions.mu保护
+	conn           *conn           // 当前绑定的网络连接, nil表示客户端离线
+	expiryInterval uint32          // 会话过期间隔, 单位秒
+	expiryTimer    *time.Timer     // 离线后的过期定时器
+	will           *packet.PUBLISH // 等待延时发布的遗嘱消息
+	willTimer      *time.Timer     // 遗嘱延时定时器
+}
+
+func newSession(clientID string) *session {
+	return &session{
+		clientID:      clientID,
+		subscriptions: make(map[string]subscription),
+		inFight:       newInFight(),
+		outFlight:     newOutFlight(),
+	}
+}
+
+// subscription 会话中保存的订阅
+type subscription struct {
+	packet.Subscription
+	identifier uint32 // 订阅标识符, 0表示没有
+}
+
+// subscribe 添加订阅并记录订阅选项和订阅标识符, 返回该主题过滤器的订阅之前是否已经存在
+//
+// MQTT v5.0: 参考章节 3.8.2.1.2 Subscription Identifier
+// - 订阅标识符与SUBSCRIBE报文创建或者修改的订阅关联, 替换订阅时使用新的订阅标识符
+func (s *session) subscribe(sub packet.Subscription, identifier uint32) (bool, error) {
+	_, filter, _, err := parseShared(sub.TopicFilter)
+	if err != nil {
+		return false, err
+	}
+	// 共享订阅 $share/{ShareName}/{filter} 检查其中的主题过滤器部分
+	if err := topic.ValidateFilter(filter); err != nil {
+		return false, err
+	}
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	_, existed := s.subscriptions[sub.TopicFilter]
+	s.subscriptions[sub.TopicFilter] = subscription{Subscription: sub, identifier: identifier} // 已存在的订阅必须被新的订阅替换 [MQTT-3.8.4-3]
+	return existed, nil
+}
+
+// unsubscribe 删除订阅, 返回该主题过滤器的订阅之前是否存在
+func (s *session) unsubscribe(topicFilter string) bool {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	_, existed := s.subscriptions[topicFilter]
+	delete(s.subscriptions, topicFilter)
+	return existed
+}
+
+// delivery 应用消息匹配会话中的订阅后, 转发给客户端时使用的选项
+type delivery struct {
+	qos               uint8    // 匹配的订阅中最大的授权QoS
+	retainAsPublished bool     // 匹配的订阅中是否有设置了Retain As Published选项的订阅
+	identifiers       []uint32 // 匹配的订阅的订阅标识符
+}
+
+func (d *delivery) add(sub subscription) {
+	d.qos = max(d.qos, sub.MaximumQoS)
+	d.retainAsPublished = d.retainAsPublished || sub.RetainAsPublished == 1
+	if sub.identifier != 0 {
+		d.identifiers = append(d.identifiers, sub.identifier)
+	}
+}
+
+// sessions 按ClientID保存会话状态
+type sessions struct {
+	maps  map[string]*session // ClientID: session
+	mu    sync.Mutex
+	ended func(*session) // 会话结束时调用, 用于清理全局订阅索引, 调用时持有mu
+}
+
+func newSessions() *sessions {
+	return &sessions{maps: make(map[string]*session)}
+}
+
+// Len 返回当前保存的会话数量, 包括离线会话
+func (m *sessions) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.maps)
+}
+
+// attach 将网络连接绑定到ClientID对应的会话, 返回会话以及会话是否已存在
+//
+// MQTT v3.1.1: 参考章节 3.1.2.4 Clean Session
+// - CleanSession=1: 丢弃之前的会话并开始一个新的会话 [MQTT-3.1.2-6]
+// - CleanSession=0: 基于已有的会话恢复通信, 没有会话时创建一个新的会话 [MQTT-3.1.2-4]
+// MQTT v5.0: 参考章节 3.1.2.4 Clean Start
+// - CleanStart=1: 丢弃已存在的会话并开始一个新的会话 [MQTT-3.1.2-4]
+// - CleanStart=0: 存在会话时必须基于该会话恢复通信 [MQTT-3.1.2-5]
+func (m *sessions) attach(c *conn, cleanStart bool, expiryInterval uint32) (*session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, present := m.maps[c.ID]
+	if present && sess.expiryTimer != nil {
+		sess.expiryTimer.Stop()
+		sess.expiryTimer = nil
+	}
+	if !present || cleanStart {
+		if present {
+			m.end(sess)
+		}
+		sess, present = newSession(c.ID), false
+		m.maps[c.ID] = sess
+	}
+	c.bind(sess, present)
+	sess.conn, sess.expiryInterval = c, expiryInterval
+	return sess, present
+}
+
+// detach 解除网络连接与会话的绑定, 按会话过期间隔决定会话的去留
+//
+// MQTT v5.0: 参考章节 3.1.2.11.2 Session Expiry Interval
+// - 0或者不存在: 网络连接关闭时会话结束
+// - 0xFFFFFFFF: 会话永不过期
+// - 其他值: 网络连接关闭后会话保留指定的秒数
+func (m *sessions) detach(c *conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.maps[c.ID]
+	if !ok || sess.conn != c { // 会话已经被新的连接接管
+		return
+	}
+	sess.conn = nil
+	switch sess.expiryInterval {
+	case 0:
+		delete(m.maps, c.ID)
+		m.end(sess)
+	case SessionExpiryNever:
+	default:
+		sess.expiryTimer = time.AfterFunc(time.Duration(sess.expiryInterval)*time.Second, func() {
+			m.expire(sess)
+		})
+	}
+}
+
+// expire 删除过期的离线会话
+func (m *sessions) expire(sess *session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.maps[sess.clientID] != sess || sess.conn != nil {
+		return
+	}
+	delete(m.maps, sess.clientID)
+	m.end(sess)
+	log.Printf("session expired: clientId=%s, expiryInterval=%d", sess.clientID, sess.expiryInterval)
+}
+
+// end 清理已经结束的会话, 调用时持有mu
+func (m *sessions) end(sess *session) {
+	sess.outFlight.clear()
+	if m.ended != nil {
+		m.ended(sess)
+	}
+}
+
+// setExpiryInterval 更新会话过期间隔, 客户端可以在DISCONNECT报文中修改
+//
+// MQTT v5.0: 参考章节 3.14.2.2.2 Session Expiry Interval
+// - CONNECT中的会话过期间隔为0时, 在DISCONNECT中设置非0的会话过期间隔是协议错误, 返回false
+func (m *sessions) setExpiryInterval(sess *session, expiryInterval uint32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sess.expiryInterval == 0 && expiryInterval != 0 {
+		return false
+	}
+	sess.expiryInterval = expiryInterval
+	return true
+}
+
+// sessionExpiryInterval 计算CONNECT报文对应的会话过期间隔
+//
+// MQTT v3.1.1的CleanSession=0会话在网络连接断开后一直保留, 等同于v5.0的0xFFFFFFFF
+func sessionExpiryInterval(connect *packet.CONNECT) uint32 {
+	if connect.Version != packet.VERSION500 {
+		if connect.ConnectFlags.CleanStart() {
+			return 0
+		}
+		return SessionExpiryNever
+	}
+	if connect.Props == nil {
+		return 0
+	}
+	return connect.Props.SessionExpiryInterval.Uint32()
+}
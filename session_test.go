@@ -0,0 +1,165 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+func TestSessionsAttachDetach(t *testing.T) {
+	m := newSessions()
+	c1 := &conn{ID: "c"}
+
+	sess, present := m.attach(c1, false, 0)
+	if present {
+		t.Fatal("new session should not be present")
+	}
+	if _, err := sess.subscribe(packet.Subscription{TopicFilter: "a/b"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// 会话过期间隔为0, 网络连接关闭时会话结束
+	m.detach(c1)
+	if m.Len() != 0 {
+		t.Fatalf("sessions = %d, want 0", m.Len())
+	}
+
+	sess, _ = m.attach(c1, false, SessionExpiryNever)
+	_, _ = sess.subscribe(packet.Subscription{TopicFilter: "a/b"}, 0)
+	m.detach(c1)
+
+	c2 := &conn{ID: "c"}
+	restored, present := m.attach(c2, false, SessionExpiryNever)
+	if !present || restored != sess {
+		t.Fatal("session should be restored when CleanStart=0")
+	}
+	if _, ok := restored.subscriptions["a/b"]; !ok {
+		t.Error("subscriptions should survive reconnect")
+	}
+
+	// 旧连接的detach不能影响已经被新连接接管的会话
+	m.detach(c1)
+	if restored.conn != c2 {
+		t.Error("detach of a stale connection should be ignored")
+	}
+
+	fresh, present := m.attach(c2, true, SessionExpiryNever)
+	if present || fresh == sess {
+		t.Error("CleanStart=1 should discard the existing session")
+	}
+}
+
+func TestSessionsExpire(t *testing.T) {
+	m := newSessions()
+	c := &conn{ID: "c"}
+	sess, _ := m.attach(c, false, 3600)
+	m.detach(c)
+	if sess.expiryTimer == nil {
+		t.Fatal("offline session should have an expiry timer")
+	}
+
+	// 重新连接后停止过期定时器
+	if _, present := m.attach(c, false, 3600); !present || sess.expiryTimer != nil {
+		t.Fatal("reconnect should cancel the expiry timer")
+	}
+	m.expire(sess)
+	if m.Len() != 1 {
+		t.Fatal("online session should not expire")
+	}
+
+	m.detach(c)
+	m.expire(sess)
+	if m.Len() != 0 {
+		t.Fatalf("sessions = %d, want 0", m.Len())
+	}
+}
+
+func TestSessionExpiryInterval(t *testing.T) {
+	testCases := []struct {
+		name    string
+		connect *packet.CONNECT
+		want    uint32
+	}{
+		{"V311_CleanSession", &packet.CONNECT{FixedHeader: &packet.FixedHeader{Version: packet.VERSION311}, ConnectFlags: 0x02}, 0},
+		{"V311_PersistentSession", &packet.CONNECT{FixedHeader: &packet.FixedHeader{Version: packet.VERSION311}}, SessionExpiryNever},
+		{"V500_NoProps", &packet.CONNECT{FixedHeader: &packet.FixedHeader{Version: packet.VERSION500}}, 0},
+		{"V500_Expiry", &packet.CONNECT{FixedHeader: &packet.FixedHeader{Version: packet.VERSION500}, Props: &packet.ConnectProperties{SessionExpiryInterval: 60}}, 60},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sessionExpiryInterval(tc.connect); got != tc.want {
+				t.Errorf("sessionExpiryInterval() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPersistentSessionRestored(t *testing.T) {
+	s := NewServer(context.Background())
+
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{ClientID: "persistent"})
+	if connack.SessionPresent != 0 {
+		t.Fatal("SessionPresent should be 0 for a new session")
+	}
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION311, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{TopicFilter: "a/+", MaximumQoS: 1}},
+	})
+	if _, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.SUBACK); !ok {
+		t.Fatal("expected SUBACK")
+	}
+	_ = rw.Close()
+
+	rw, connack = connectTestServer(t, s, &packet.CONNECT{ClientID: "persistent"})
+	if connack.SessionPresent != 1 {
+		t.Fatal("SessionPresent should be 1 when the session is restored")
+	}
+
+	go func() {
+		_ = s.publish(&packet.PUBLISH{FixedHeader: &packet.FixedHeader{Kind: PUBLISH}, Message: &packet.Message{TopicName: "a/b", Content: []byte("hello")}})
+	}()
+	pub, ok := readTestPacket(t, rw, packet.VERSION311).(*packet.PUBLISH)
+	if !ok || string(pub.Message.Content) != "hello" {
+		t.Fatalf("restored subscription should receive the message, got %v", pub)
+	}
+
+	// CleanSession=1 丢弃已有会话
+	_, connack = connectTestServer(t, s, &packet.CONNECT{ClientID: "persistent", ConnectFlags: 0x02})
+	if connack.SessionPresent != 0 {
+		t.Fatal("SessionPresent should be 0 when CleanSession=1")
+	}
+}
+
+func TestDisconnectSessionExpiry(t *testing.T) {
+	s := NewServer(context.Background())
+
+	// CONNECT中的会话过期间隔为0, DISCONNECT中设置非0的值是协议错误
+	rw, _ := connectTestServer(t, s, &packet.CONNECT{FixedHeader: &packet.FixedHeader{Version: packet.VERSION500}, ClientID: "zero"})
+	writeTestPacket(t, rw, &packet.DISCONNECT{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION500, Kind: DISCONNECT},
+		Props:       &packet.DisconnectProperties{SessionExpiryInterval: 60},
+	})
+	if disconnect, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.DISCONNECT); !ok || disconnect.ReasonCode.Code != 0x82 {
+		t.Fatalf("expected DISCONNECT 0x82, got %v", disconnect)
+	}
+
+	// 显式设置为0时会话在网络连接关闭时结束; 属性值为0时 Pack 不写入该属性, 这里直接写入报文
+	rw, _ = connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION500},
+		ClientID:    "expiry",
+		Props:       &packet.ConnectProperties{SessionExpiryInterval: 60},
+	})
+	_ = rw.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := rw.Write([]byte{0xE0, 0x07, 0x00, 0x05, 0x11, 0x00, 0x00, 0x00, 0x00}); err != nil {
+		t.Fatalf("write DISCONNECT: %v", err)
+	}
+	for i := 0; s.sessions.Len() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("sessions = %d, the session should end with a zero expiry interval", s.sessions.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
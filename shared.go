@@ -0,0 +1,234 @@
+package mqtt
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+// sharePrefix 共享订阅主题过滤器的前缀
+const sharePrefix = "$share/"
+
+var errInvalidShareFilter = errors.New("mqtt: invalid shared subscription topic filter")
+
+// parseShared 解析共享订阅的主题过滤器 $share/{ShareName}/{filter}, 不是共享订阅时shared返回false
+//
+// MQTT v5.0: 参考章节 4.8.2 Shared Subscriptions
+// - ShareName至少包含一个字符, 并且不能包含 "/", "+", "#" [MQTT-4.8.2-1] [MQTT-4.8.2-2]
+// - ShareName之后必须是 "/" 和一个主题过滤器
+func parseShared(topicFilter string) (group, filter string, shared bool, err error) {
+	rest, ok := strings.CutPrefix(topicFilter, sharePrefix)
+	if !ok {
+		return "", topicFilter, false, nil
+	}
+	group, filter, ok = strings.Cut(rest, "/")
+	if !ok || group == "" || filter == "" || strings.ContainsAny(group, "+#") {
+		return "", "", true, errInvalidShareFilter
+	}
+	return group, filter, true, nil
+}
+
+// ShareMember 共享组中可以接收消息的订阅者
+type ShareMember struct {
+	ClientID string
+	InFlight int // 已经发送给该订阅者, 还没有完成确认的QoS1, QoS2消息数量
+}
+
+// ShareMessage 需要在共享组中选择订阅者的消息
+type ShareMessage struct {
+	Group     string // 共享组名
+	TopicName string
+	Publisher string // 发布者的ClientID, 服务端自己发布的消息为空
+	Seq       uint64 // 该共享订阅收到的消息序号, 从0开始
+}
+
+// ShareStrategy 共享订阅选择订阅者的策略
+//
+// 每条消息只发送给共享组中的一个订阅者. 共享组中有在线的订阅者时members只包含在线的订阅者,
+// 否则包含所有离线的订阅者, 消息进入被选中的会话的离线队列. members按ClientID排序并且不为空,
+// 返回值为被选中的订阅者在members中的下标.
+type ShareStrategy interface {
+	Select(msg ShareMessage, members []ShareMember) int
+}
+
+// The ShareStrategyFunc type is an adapter to allow the use of
+// ordinary functions as share strategies.
+type ShareStrategyFunc func(msg ShareMessage, members []ShareMember) int
+
+func (f ShareStrategyFunc) Select(msg ShareMessage, members []ShareMember) int {
+	return f(msg, members)
+}
+
+var (
+	// ShareRoundRobin 按顺序轮流选择订阅者, 默认策略
+	ShareRoundRobin ShareStrategy = ShareStrategyFunc(func(msg ShareMessage, members []ShareMember) int {
+		return int(msg.Seq % uint64(len(members)))
+	})
+
+	// ShareRandom 随机选择订阅者
+	ShareRandom ShareStrategy = ShareStrategyFunc(func(_ ShareMessage, members []ShareMember) int {
+		return rand.IntN(len(members))
+	})
+
+	// ShareLeastInflight 选择未确认消息最少的订阅者, 数量相同时轮流选择
+	ShareLeastInflight ShareStrategy = ShareStrategyFunc(func(msg ShareMessage, members []ShareMember) int {
+		n := len(members)
+		best := int(msg.Seq % uint64(n))
+		for i := 1; i < n; i++ {
+			if j := (best + i) % n; members[j].InFlight < members[best].InFlight {
+				best = j
+			}
+		}
+		return best
+	})
+
+	// ShareStickyHash 按发布者ClientID的哈希选择订阅者, 共享组成员不变时同一个发布者的消息总是发送给同一个订阅者
+	ShareStickyHash ShareStrategy = ShareStrategyFunc(func(msg ShareMessage, members []ShareMember) int {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(msg.Publisher))
+		return int(h.Sum32() % uint32(len(members)))
+	})
+)
+
+// shareGroup 一个共享订阅, 由共享组名和主题过滤器确定; 共享组的成员和订阅选项保存在全局订阅索引中
+type shareGroup struct {
+	members int // 共享组中的会话数量
+	seq     atomic.Uint64
+}
+
+// sharedSubscriptions 服务端所有的共享订阅
+type sharedSubscriptions struct {
+	mu     sync.Mutex
+	groups map[string]*shareGroup // key为完整的主题过滤器 $share/{ShareName}/{filter}
+}
+
+func newSharedSubscriptions() *sharedSubscriptions {
+	return &sharedSubscriptions{groups: make(map[string]*shareGroup)}
+}
+
+// join 共享组增加一个会话
+func (m *sharedSubscriptions) join(topicFilter string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[topicFilter]
+	if !ok {
+		g = &shareGroup{}
+		m.groups[topicFilter] = g
+	}
+	g.members++
+}
+
+// leave 共享组减少一个会话, 共享组为空时删除
+func (m *sharedSubscriptions) leave(topicFilter string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[topicFilter]
+	if !ok {
+		return
+	}
+	if g.members--; g.members <= 0 {
+		delete(m.groups, topicFilter)
+	}
+}
+
+// next 返回共享订阅收到的消息序号
+func (m *sharedSubscriptions) next(topicFilter string) uint64 {
+	m.mu.Lock()
+	g, ok := m.groups[topicFilter]
+	m.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	return g.seq.Add(1) - 1
+}
+
+// shareCandidate 匹配消息的共享订阅中的一个会话
+type shareCandidate struct {
+	sess *session
+	sub  subscription
+}
+
+// pick 按策略在共享组中选择一个会话, 会话在线时同时返回当前的网络连接
+func (s *Server) pick(candidates []shareCandidate, msg ShareMessage) (shareCandidate, *conn, bool) {
+	slices.SortFunc(candidates, func(a, b shareCandidate) int { return strings.Compare(a.sess.clientID, b.sess.clientID) })
+
+	var online, offline []shareCandidate
+	var conns []*conn
+	s.sessions.mu.Lock()
+	for _, m := range candidates {
+		switch {
+		case s.sessions.maps[m.sess.clientID] != m.sess: // 会话已经结束或者被新的会话替换
+		case m.sess.conn != nil:
+			online, conns = append(online, m), append(conns, m.sess.conn)
+		default:
+			offline = append(offline, m)
+		}
+	}
+	s.sessions.mu.Unlock()
+
+	chosen := online
+	if len(chosen) == 0 {
+		chosen, conns = offline, nil
+	}
+	if len(chosen) == 0 {
+		return shareCandidate{}, nil, false
+	}
+	members := make([]ShareMember, len(chosen))
+	for i, m := range chosen {
+		members[i] = ShareMember{ClientID: m.sess.clientID, InFlight: m.sess.outFlight.Len()}
+	}
+	i := s.shareStrategy().Select(msg, members)
+	if i < 0 || i >= len(chosen) {
+		i = 0
+	}
+	if conns == nil {
+		return chosen[i], nil, true
+	}
+	return chosen[i], conns[i], true
+}
+
+// publishShared 将消息发送给每个匹配的共享订阅中的一个订阅者, groups为匹配的共享订阅及其会话
+//
+// MQTT v5.0: 参考章节 4.8.2 Shared Subscriptions
+// - 每条消息只发送给共享组中的一个会话
+// - 被选中的会话离线时, 消息保存在该会话的离线队列中
+//
+// 返回值accepted表示是否有会话接收了消息, err为第一个拒绝消息的错误
+func (s *Server) publishShared(pub *packet.PUBLISH, publisher string, groups map[string][]shareCandidate) (accepted bool, err error) {
+	for key, candidates := range groups {
+		group, _, _, _ := parseShared(key)
+		msg := ShareMessage{Group: group, TopicName: pub.Message.TopicName, Publisher: publisher, Seq: s.shared.next(key)}
+		m, c, ok := s.pick(candidates, msg)
+		if !ok {
+			continue
+		}
+		var d delivery
+		d.add(m.sub)
+		var qerr error
+		if c != nil {
+			// 选中的连接已经关闭时按会话当前的状态转发, 消息不会丢失
+			qerr = s.deliverTo(m.sess, c, pub, d)
+		} else {
+			// 选择订阅者时没有持有锁, 会话可能已经重新连接
+			s.sessions.mu.Lock()
+			qerr = s.redeliver(m.sess, nil, pub, d)
+			s.sessions.mu.Unlock()
+		}
+		if qerr != nil {
+			log.Printf("publish shared: clientId=%s, topic=%s, group=%s, err=%v", m.sess.clientID, pub.Message.TopicName, group, qerr)
+		}
+		if qerr == nil {
+			accepted = true
+		} else if err == nil {
+			err = qerr
+		}
+	}
+	return accepted, err
+}
@@ -0,0 +1,147 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+func TestParseShared(t *testing.T) {
+	testCases := []struct {
+		topicFilter   string
+		group, filter string
+		shared, err   bool
+	}{
+		{"a/b", "", "a/b", false, false},
+		{"$share/g/a/+", "g", "a/+", true, false},
+		{"$share/g/#", "g", "#", true, false},
+		{"$share/g", "", "", true, true},
+		{"$share//a", "", "", true, true},
+		{"$share/g/", "", "", true, true},
+		{"$share/g+/a", "", "", true, true},
+	}
+	for _, tc := range testCases {
+		group, filter, shared, err := parseShared(tc.topicFilter)
+		if group != tc.group || filter != tc.filter || shared != tc.shared || (err != nil) != tc.err {
+			t.Errorf("parseShared(%q) = %q, %q, %v, %v", tc.topicFilter, group, filter, shared, err)
+		}
+	}
+}
+
+func TestShareStrategies(t *testing.T) {
+	members := []ShareMember{{ClientID: "a", InFlight: 2}, {ClientID: "b", InFlight: 0}, {ClientID: "c", InFlight: 0}}
+	for seq, want := range []int{0, 1, 2, 0} {
+		if got := ShareRoundRobin.Select(ShareMessage{Seq: uint64(seq)}, members); got != want {
+			t.Errorf("ShareRoundRobin seq=%d = %d, want %d", seq, got, want)
+		}
+	}
+	// 未确认消息数量相同的订阅者轮流选择
+	for seq, want := range []int{1, 1, 2} {
+		if got := ShareLeastInflight.Select(ShareMessage{Seq: uint64(seq)}, members); got != want {
+			t.Errorf("ShareLeastInflight seq=%d = %d, want %d", seq, got, want)
+		}
+	}
+	first := ShareStickyHash.Select(ShareMessage{Publisher: "pub", Seq: 0}, members)
+	for seq := uint64(1); seq < 10; seq++ {
+		if got := ShareStickyHash.Select(ShareMessage{Publisher: "pub", Seq: seq}, members); got != first {
+			t.Fatalf("ShareStickyHash changed member from %d to %d", first, got)
+		}
+	}
+	if got := ShareRandom.Select(ShareMessage{}, members); got < 0 || got >= len(members) {
+		t.Errorf("ShareRandom = %d", got)
+	}
+}
+
+// countTestPublish 读取PUBLISH报文直到超时, 返回收到的数量
+func countTestPublish(rw net.Conn, version byte) chan int {
+	count := make(chan int, 1)
+	go func() {
+		n := 0
+		for {
+			_ = rw.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			pkt, err := packet.Unpack(version, rw)
+			if err != nil {
+				count <- n
+				return
+			}
+			if _, ok := pkt.(*packet.PUBLISH); ok {
+				n++
+			}
+		}
+	}()
+	return count
+}
+
+func TestSharedSubscription(t *testing.T) {
+	s := NewServer(context.Background())
+	s1, _ := subscribeTestServer(t, s, "s1", packet.Subscription{TopicFilter: "$share/g/a/+"})
+	s2, _ := subscribeTestServer(t, s, "s2", packet.Subscription{TopicFilter: "$share/g/a/+"})
+	normal, _ := subscribeTestServer(t, s, "normal", packet.Subscription{TopicFilter: "a/b"})
+
+	counts := []chan int{countTestPublish(s1, packet.VERSION311), countTestPublish(s2, packet.VERSION311), countTestPublish(normal, packet.VERSION311)}
+	for i := 0; i < 4; i++ {
+		_ = s.publish(newTestPublish("a/b", "x", 0))
+	}
+	// 每条消息只发送给共享组中的一个订阅者, 普通订阅不受影响
+	for i, want := range []int{2, 2, 4} {
+		if got := <-counts[i]; got != want {
+			t.Errorf("subscriber %d received %d messages, want %d", i, got, want)
+		}
+	}
+}
+
+func TestSharedSubscriptionOffline(t *testing.T) {
+	s := NewServer(context.Background())
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION500},
+		ClientID:    "member",
+		Props:       &packet.ConnectProperties{SessionExpiryInterval: SessionExpiryNever},
+	})
+	if connack.Props.SharedSubscriptionAvailable == nil || *connack.Props.SharedSubscriptionAvailable != 1 {
+		t.Fatal("CONNACK should advertise SharedSubscriptionAvailable=1")
+	}
+	writeTestPacket(t, rw, &packet.SUBSCRIBE{
+		FixedHeader:   &packet.FixedHeader{Version: packet.VERSION500, Kind: SUBSCRIBE, QoS: 1},
+		PacketID:      1,
+		Subscriptions: []packet.Subscription{{TopicFilter: "$share/g/a/b", MaximumQoS: 1}},
+	})
+	if _, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.SUBACK); !ok {
+		t.Fatal("expected SUBACK")
+	}
+	_ = rw.Close()
+	waitOffline(t, s, "member")
+
+	// 共享组中没有在线的订阅者时, 消息进入被选中的离线会话的队列
+	_ = s.publish(newTestPublish("a/b", "1", 1))
+	rw, connack = connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader: &packet.FixedHeader{Version: packet.VERSION500},
+		ClientID:    "member",
+		Props:       &packet.ConnectProperties{SessionExpiryInterval: SessionExpiryNever},
+	})
+	if connack.SessionPresent != 1 {
+		t.Fatal("SessionPresent should be 1")
+	}
+	pub, ok := readTestPacket(t, rw, packet.VERSION500).(*packet.PUBLISH)
+	if !ok || string(pub.Message.Content) != "1" {
+		t.Fatalf("expected the queued shared message, got %v", pub)
+	}
+}
+
+func TestSharedSubscriptionClosedConn(t *testing.T) {
+	s := NewServer(context.Background())
+	c := &conn{ID: "member", server: s, outbound: newOutboundQueue(DefaultMaxOutboundMessages, OutboundDropQoS0)}
+	sess, _ := s.sessions.attach(c, false, SessionExpiryNever)
+	subscribeTest(t, s, sess, packet.Subscription{TopicFilter: "$share/g/a/b", MaximumQoS: 1})
+
+	// 选中的连接已经关闭但还没有解除绑定时, 消息按会话当前的状态进入离线队列
+	c.outbound.close()
+	if err := s.memorySubscribed.Publish(newTestPublish("a/b", "1", 1), ""); err != nil {
+		t.Fatalf("Publish() = %v", err)
+	}
+	if n := sess.queue.Len(); n != 1 {
+		t.Errorf("queue = %d, want 1", n)
+	}
+}
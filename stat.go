@@ -19,6 +19,16 @@ type Stat struct {
 	ByteReceived      prometheus.Counter
 	PacketSent        prometheus.Counter
 	ByteSent          prometheus.Counter
+	OfflineDropped    prometheus.Counter
+	KeepAliveTimeout  prometheus.Counter
+	InFlight          prometheus.Gauge
+	Retransmitted     prometheus.Counter
+	OversizedDropped  prometheus.Counter
+	ExpiredDropped    prometheus.Counter
+	Takeovers         prometheus.Counter
+	OutboundQueued    prometheus.Gauge
+	OutboundDropped   prometheus.Counter
+	SlowConsumers     prometheus.Counter
 }
 
 var (
@@ -29,6 +39,16 @@ var (
 		ByteReceived:      prometheus.NewCounter(prometheus.CounterOpts{Name: "mqtt_received_bytes", Help: "The total number of received MQTT bytes"}),
 		PacketSent:        prometheus.NewCounter(prometheus.CounterOpts{Name: "mqtt_send_packets", Help: "The total number of send MQTT packets"}),
 		ByteSent:          prometheus.NewCounter(prometheus.CounterOpts{Name: "mqtt_send_bytes", Help: "The total number of send MQTT bytes"}),
+		OfflineDropped:    prometheus.NewCounter(prometheus.CounterOpts{Name: "mqtt_offline_dropped_messages", Help: "The total number of messages dropped because an offline queue was full"}),
+		KeepAliveTimeout:  prometheus.NewCounter(prometheus.CounterOpts{Name: "mqtt_keepalive_timeouts", Help: "The total number of connections closed because of keep alive timeout"}),
+		InFlight:          prometheus.NewGauge(prometheus.GaugeOpts{Name: "mqtt_inflight_messages", Help: "The number of outbound QoS 1 and QoS 2 messages waiting for acknowledgement"}),
+		Retransmitted:     prometheus.NewCounter(prometheus.CounterOpts{Name: "mqtt_retransmitted_packets", Help: "The total number of retransmitted PUBLISH and PUBREL packets"}),
+		OversizedDropped:  prometheus.NewCounter(prometheus.CounterOpts{Name: "mqtt_oversized_dropped_messages", Help: "The total number of messages dropped because they exceed the client's maximum packet size"}),
+		ExpiredDropped:    prometheus.NewCounter(prometheus.CounterOpts{Name: "mqtt_expired_dropped_messages", Help: "The total number of messages dropped because their message expiry interval has passed"}),
+		Takeovers:         prometheus.NewCounter(prometheus.CounterOpts{Name: "mqtt_session_takeovers", Help: "The total number of connections closed because a new connection used the same ClientID"}),
+		OutboundQueued:    prometheus.NewGauge(prometheus.GaugeOpts{Name: "mqtt_outbound_queued_messages", Help: "The number of messages waiting in connection outbound queues"}),
+		OutboundDropped:   prometheus.NewCounter(prometheus.CounterOpts{Name: "mqtt_outbound_dropped_messages", Help: "The total number of QoS 0 messages dropped because a connection outbound queue was full"}),
+		SlowConsumers:     prometheus.NewCounter(prometheus.CounterOpts{Name: "mqtt_slow_consumer_disconnects", Help: "The total number of connections closed because their outbound queue overflowed"}),
 	}
 )
 
@@ -83,4 +103,14 @@ func (s *Stat) Register() {
 	prometheus.MustRegister(stat.ByteReceived)
 	prometheus.MustRegister(stat.PacketSent)
 	prometheus.MustRegister(stat.ByteSent)
+	prometheus.MustRegister(stat.OfflineDropped)
+	prometheus.MustRegister(stat.KeepAliveTimeout)
+	prometheus.MustRegister(stat.InFlight)
+	prometheus.MustRegister(stat.Retransmitted)
+	prometheus.MustRegister(stat.OversizedDropped)
+	prometheus.MustRegister(stat.ExpiredDropped)
+	prometheus.MustRegister(stat.Takeovers)
+	prometheus.MustRegister(stat.OutboundQueued)
+	prometheus.MustRegister(stat.OutboundDropped)
+	prometheus.MustRegister(stat.SlowConsumers)
 }
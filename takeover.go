@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"log"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+// attachClient 将ClientID绑定到新的网络连接并恢复或者创建会话, 返回会话以及会话是否已存在.
+// 同一个ClientID已经有网络连接时, 旧的连接被断开, 会话转移到新的连接
+//
+// MQTT v3.1.1: 参考章节 3.1.4 Response
+// - ClientID对应的客户端已经连接到服务端时, 服务端必须断开已有的客户端 [MQTT-3.1.4-2]
+// MQTT v5.0: 参考章节 3.1.4 CONNECT Actions
+// - 服务端向已有的客户端发送原因码为0x8E(Session taken over)的DISCONNECT, 并且必须关闭它的网络连接 [MQTT-3.1.4-3]
+//
+// 更新ClientID索引和绑定会话在同一个锁内完成, 并发连接同一个ClientID时只有最后绑定的连接保留
+func (s *Server) attachClient(c *conn, cleanStart bool, expiryInterval uint32) (*session, bool) {
+	s.clientsMu.Lock()
+	prev := s.clients[c.ID]
+	s.clients[c.ID] = c
+	sess, present := s.sessions.attach(c, cleanStart, expiryInterval)
+	s.clientsMu.Unlock()
+	if prev != nil && prev != c {
+		s.takeover(prev, c)
+	}
+	return sess, present
+}
+
+// detachClient 网络连接关闭时解除ClientID索引和会话的绑定; 已经被接管的连接不影响新的连接
+func (s *Server) detachClient(c *conn) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if s.clients[c.ID] == c {
+		delete(s.clients, c.ID)
+	}
+	s.sessions.detach(c)
+}
+
+// takeover 断开被新连接接管的旧连接, 并调用 Server.OnTakeover
+func (s *Server) takeover(prev, next *conn) {
+	log.Printf("session taken over: clientId=%s, reomte=%s, prev=%s", next.ID, next.remoteAddr, prev.remoteAddr)
+	stat.Takeovers.Inc()
+	if hook := s.OnTakeover; hook != nil {
+		hook(prev.clientInfo(), next.clientInfo())
+	}
+	// 会话已经转移到新的连接, 在单独的goroutine中断开旧的连接, 避免阻塞新连接的CONNECT处理
+	go func() {
+		if prev.version == packet.VERSION500 {
+			_ = prev.rwc.SetWriteDeadline(time.Now().Add(time.Second)) // 旧的客户端可能已经不再读取报文
+			if err := (&response{conn: prev}).OnSend(packet.NewDISCONNECT(prev.version, packet.ErrSessionTakenOver)); err != nil {
+				log.Printf("mqtt-onSend: err=%v", err)
+			}
+		}
+		prev.close()
+	}()
+}
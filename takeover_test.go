@@ -0,0 +1,69 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+func TestTakeover(t *testing.T) {
+	s := NewServer(context.Background())
+	takeovers := make(chan [2]ClientInfo, 1)
+	s.OnTakeover = func(prev, next ClientInfo) { takeovers <- [2]ClientInfo{prev, next} }
+
+	prev := connectTestServer5(t, s, &packet.CONNECT{ClientID: "dup"}, packet.Subscription{TopicFilter: "a/b"})
+	next := connectTestServer5(t, s, &packet.CONNECT{ClientID: "dup"})
+
+	// 旧的连接收到原因码为0x8E的DISCONNECT并被关闭 [MQTT-3.1.4-3]
+	disconnect, ok := readTestPacket(t, prev, packet.VERSION500).(*packet.DISCONNECT)
+	if !ok || disconnect.ReasonCode.Code != packet.ErrSessionTakenOver.Code {
+		t.Fatalf("expected DISCONNECT with 0x8E, got %v", disconnect)
+	}
+	_ = prev.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := packet.Unpack(packet.VERSION500, prev); err == nil {
+		t.Error("the previous connection should be closed")
+	}
+	select {
+	case infos := <-takeovers:
+		if infos[0].ClientID != "dup" || infos[1].ClientID != "dup" {
+			t.Errorf("OnTakeover(%+v, %+v)", infos[0], infos[1])
+		}
+	default:
+		t.Error("OnTakeover should be called")
+	}
+
+	// 旧的连接关闭后, ClientID索引和会话仍然绑定在新的连接上
+	time.Sleep(50 * time.Millisecond)
+	s.clientsMu.Lock()
+	c := s.clients["dup"]
+	s.clientsMu.Unlock()
+	s.sessions.mu.Lock()
+	online := c != nil && s.sessions.maps["dup"].conn == c
+	s.sessions.mu.Unlock()
+	if !online {
+		t.Error("the session should stay attached to the new connection")
+	}
+	_ = next.Close()
+}
+
+func TestTakeoverSessionTransfer(t *testing.T) {
+	s := NewServer(context.Background())
+	prev, _ := subscribeTestServer(t, s, "dup", packet.Subscription{TopicFilter: "a/b", MaximumQoS: 1})
+	next, connack := connectTestServer(t, s, &packet.CONNECT{ClientID: "dup"})
+	if connack.SessionPresent != 1 {
+		t.Fatal("SessionPresent should be 1 when the session is taken over")
+	}
+	// v3.1.1没有服务端DISCONNECT, 旧的连接直接被关闭 [MQTT-3.1.4-2]
+	_ = prev.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := packet.Unpack(packet.VERSION311, prev); err == nil {
+		t.Error("the previous connection should be closed")
+	}
+
+	go func() { _ = s.publish(newTestPublish("a/b", "x", 1)) }()
+	pub, ok := readTestPacket(t, next, packet.VERSION311).(*packet.PUBLISH)
+	if !ok || string(pub.Message.Content) != "x" {
+		t.Fatalf("expected the message on the new connection, got %v", pub)
+	}
+}
@@ -0,0 +1,118 @@
+package topic
+
+import (
+	"maps"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Trie 订阅索引, 保存订阅者的主题过滤器和订阅选项, 并查找与主题名匹配的订阅
+//
+// 实现:
+// - Index: 读写锁保护整棵树, 订阅和取消订阅的开销小
+// - CopyOnWriteTrie: 匹配时不加锁, 适合发布远多于订阅变化的场景
+type Trie[K comparable, V any] interface {
+	// Subscribe 保存订阅者对主题过滤器的订阅, 返回该订阅之前是否已经存在; 不符合协议规则的主题过滤器返回 ErrInvalidFilter
+	Subscribe(filter string, subscriber K, value V) (bool, error)
+
+	// Unsubscribe 取消订阅者对主题过滤器的订阅, 返回订阅之前是否存在
+	Unsubscribe(filter string, subscriber K) bool
+
+	// Match 返回与主题名匹配的所有订阅
+	Match(topicName string) []Entry[K, V]
+}
+
+// clone 复制节点, 子节点和订阅者由调用者按需复制
+func (n *indexNode[K, V]) clone() *indexNode[K, V] {
+	return &indexNode[K, V]{filter: n.filter, children: maps.Clone(n.children), subscribers: n.subscribers}
+}
+
+// CopyOnWriteTrie 写时复制的订阅索引, 节点发布到树上之后不再修改
+//
+// 订阅和取消订阅复制从根节点到目标节点路径上的所有节点, 再用原子操作替换根节点;
+// 匹配读取当前的根节点后遍历一个不会再被修改的快照, 整个过程不加锁, 高并发发布时不会在锁上竞争
+type CopyOnWriteTrie[K comparable, V any] struct {
+	mu   sync.Mutex // 串行化订阅和取消订阅
+	root atomic.Pointer[indexNode[K, V]]
+}
+
+func NewCopyOnWriteTrie[K comparable, V any]() *CopyOnWriteTrie[K, V] {
+	t := &CopyOnWriteTrie[K, V]{}
+	t.root.Store(newIndexNode[K, V](""))
+	return t
+}
+
+func (t *CopyOnWriteTrie[K, V]) Subscribe(filter string, subscriber K, value V) (bool, error) {
+	if err := ValidateFilter(filter); err != nil {
+		return false, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	root := t.root.Load().clone()
+	current := root
+	for _, level := range strings.Split(filter, "/") {
+		next, ok := current.children[level]
+		switch {
+		case ok:
+			next = next.clone()
+		case current == root:
+			next = newIndexNode[K, V](level)
+		default:
+			next = newIndexNode[K, V](current.filter + "/" + level)
+		}
+		current.children[level] = next
+		current = next
+	}
+	subscribers := make(map[K]V, len(current.subscribers)+1)
+	maps.Copy(subscribers, current.subscribers)
+	_, existed := subscribers[subscriber]
+	subscribers[subscriber] = value
+	current.subscribers = subscribers
+	t.root.Store(root)
+	return existed, nil
+}
+
+func (t *CopyOnWriteTrie[K, V]) Unsubscribe(filter string, subscriber K) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	levels := strings.Split(filter, "/")
+	// 先在当前的快照上确认订阅存在, 不存在时不需要复制
+	current := t.root.Load()
+	for _, level := range levels {
+		next, ok := current.children[level]
+		if !ok {
+			return false
+		}
+		current = next
+	}
+	if _, ok := current.subscribers[subscriber]; !ok {
+		return false
+	}
+
+	path := make([]*indexNode[K, V], 0, len(levels)+1)
+	path = append(path, t.root.Load().clone())
+	for i, level := range levels {
+		next := path[i].children[level].clone()
+		path[i].children[level] = next
+		path = append(path, next)
+	}
+	last := path[len(path)-1]
+	last.subscribers = maps.Clone(last.subscribers)
+	delete(last.subscribers, subscriber)
+	// 从最深的层级开始向上删除既没有订阅者也没有子节点的节点
+	for i := len(levels) - 1; i >= 0; i-- {
+		node := path[i+1]
+		if len(node.subscribers) > 0 || len(node.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+	t.root.Store(path[0])
+	return true
+}
+
+// Match 返回与主题名匹配的所有订阅, 不加锁
+func (t *CopyOnWriteTrie[K, V]) Match(topicName string) []Entry[K, V] {
+	return t.root.Load().match(topicName)
+}
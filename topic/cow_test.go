@@ -0,0 +1,180 @@
+package topic
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// tries 需要满足相同行为的订阅索引实现
+var tries = []struct {
+	name string
+	new  func() Trie[string, int]
+}{
+	{"index", func() Trie[string, int] { return NewIndex[string, int]() }},
+	{"cow", func() Trie[string, int] { return NewCopyOnWriteTrie[string, int]() }},
+}
+
+// filters 返回订阅的主题过滤器, 按字典序排列
+func filters[V any](entries []Entry[string, V]) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Filter)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestTrieImplementations(t *testing.T) {
+	for _, impl := range tries {
+		t.Run(impl.name, func(t *testing.T) {
+			trie := impl.new()
+			for _, filter := range []string{"a/b", "a/+", "a/#", "#", "$SYS/#"} {
+				if _, err := trie.Subscribe(filter, "c1", 0); err != nil {
+					t.Fatalf("Subscribe(%q): %v", filter, err)
+				}
+			}
+			if existed, _ := trie.Subscribe("a/b", "c2", 1); existed {
+				t.Error("a/b is new for c2")
+			}
+			if existed, _ := trie.Subscribe("a/b", "c2", 2); !existed {
+				t.Error("Subscribe should report the existing subscription")
+			}
+			if _, err := trie.Subscribe("a/#/b", "c1", 0); err == nil {
+				t.Error("invalid topic filter should be rejected")
+			}
+			if got, want := filters(trie.Match("a/b")), []string{"#", "a/#", "a/+", "a/b", "a/b"}; !slices.Equal(got, want) {
+				t.Errorf("Match(a/b) = %v, want %v", got, want)
+			}
+			if got, want := filters(trie.Match("$SYS/x")), []string{"$SYS/#"}; !slices.Equal(got, want) {
+				t.Errorf("Match($SYS/x) = %v, want %v", got, want)
+			}
+			for _, e := range trie.Match("a/b") {
+				if e.Subscriber == "c2" && e.Value != 2 {
+					t.Errorf("c2 value = %d, want the replaced value 2", e.Value)
+				}
+			}
+
+			if !trie.Unsubscribe("a/b", "c1") || trie.Unsubscribe("a/b", "c1") {
+				t.Error("a/b should be unsubscribed exactly once for c1")
+			}
+			if trie.Unsubscribe("a", "c1") {
+				t.Error("a is not subscribed")
+			}
+			if got, want := subscribers(trie.Match("a/b")), []string{"c1", "c1", "c1", "c2"}; !slices.Equal(got, want) {
+				t.Errorf("Match(a/b) = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCopyOnWriteTrieSnapshot(t *testing.T) {
+	trie := NewCopyOnWriteTrie[string, int]()
+	_, _ = trie.Subscribe("a/b", "c1", 0)
+	snapshot := trie.root.Load()
+
+	// 订阅变化不影响已经读取的快照
+	_, _ = trie.Subscribe("a/c", "c1", 0)
+	trie.Unsubscribe("a/b", "c1")
+	if got := filters(snapshot.match("a/b")); !slices.Equal(got, []string{"a/b"}) {
+		t.Errorf("snapshot match = %v, want [a/b]", got)
+	}
+	if got := trie.Match("a/b"); len(got) != 0 {
+		t.Errorf("Match(a/b) = %v, want none after unsubscribe", got)
+	}
+	// 最后一个订阅取消后, 空分支被删除
+	trie.Unsubscribe("a/c", "c1")
+	if n := len(trie.root.Load().children); n != 0 {
+		t.Errorf("root has %d children, empty branches should be pruned", n)
+	}
+}
+
+func TestTrieConcurrentChurn(t *testing.T) {
+	for _, impl := range tries {
+		t.Run(impl.name, func(t *testing.T) {
+			trie := impl.new()
+			_, _ = trie.Subscribe("fixed/#", "fixed", 0)
+			var wg sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 200; i++ {
+						filter := fmt.Sprintf("fixed/%d/+", (w*200+i)%16)
+						subscriber := fmt.Sprint(w)
+						_, _ = trie.Subscribe(filter, subscriber, i)
+						if len(trie.Match("fixed/1/x")) == 0 {
+							t.Error("fixed/# should always match")
+							return
+						}
+						trie.Unsubscribe(filter, subscriber)
+					}
+				}()
+			}
+			wg.Wait()
+			if got := filters(trie.Match("fixed/1/x")); !slices.Equal(got, []string{"fixed/#"}) {
+				t.Errorf("Match = %v, want [fixed/#]", got)
+			}
+		})
+	}
+}
+
+// BenchmarkTrieMatchChurn 在订阅持续变化的同时并发匹配主题名
+func BenchmarkTrieMatchChurn(b *testing.B) {
+	for _, impl := range tries {
+		b.Run(impl.name, func(b *testing.B) {
+			trie := impl.new()
+			for i := 0; i < 1000; i++ {
+				subscriber := fmt.Sprint(i)
+				_, _ = trie.Subscribe(fmt.Sprintf("device/%d/+/status", i), subscriber, 1)
+				_, _ = trie.Subscribe(fmt.Sprintf("device/%d/#", i), subscriber, 0)
+			}
+			var stop atomic.Bool
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; !stop.Load(); i++ {
+					filter := fmt.Sprintf("churn/%d/+", i%100)
+					_, _ = trie.Subscribe(filter, "churn", 0)
+					trie.Unsubscribe(filter, "churn")
+				}
+			}()
+
+			topics := make([]string, 1000)
+			for i := range topics {
+				topics[i] = fmt.Sprintf("device/%d/sensor/status", i)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					trie.Match(topics[i%len(topics)])
+					i++
+				}
+			})
+			b.StopTimer()
+			stop.Store(true)
+			<-done
+		})
+	}
+}
+
+// BenchmarkTrieSubscribe 订阅和取消订阅的开销, 写时复制需要复制路径上的节点
+func BenchmarkTrieSubscribe(b *testing.B) {
+	for _, impl := range tries {
+		b.Run(impl.name, func(b *testing.B) {
+			trie := impl.new()
+			for i := 0; i < 1000; i++ {
+				_, _ = trie.Subscribe(fmt.Sprintf("device/%d/#", i), fmt.Sprint(i), 0)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = trie.Subscribe("device/1/+/status", "bench", 0)
+				trie.Unsubscribe("device/1/+/status", "bench")
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package topic
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidFilter 主题过滤器不符合协议规则
+var ErrInvalidFilter = errors.New("topic: invalid topic filter")
+
+// ValidateFilter 检查主题过滤器是否符合协议规则
+//
+// MQTT v3.1.1: 参考章节 4.7 Topic Names and Topic Filters
+// MQTT v5.0: 参考章节 4.7 Topic Names and Topic Filters
+// - 主题过滤器至少包含一个字符 [MQTT-4.7.3-1], 不能包含空字符U+0000 [MQTT-4.7.3-2], 编码后不超过65535字节 [MQTT-4.7.3-3]
+// - 多层通配符 "#" 必须单独占据一个层级, 并且是主题过滤器的最后一个字符 [MQTT-4.7.1-2]
+// - 单层通配符 "+" 必须单独占据一个层级 [MQTT-4.7.1-3]
+// - 允许长度为0的层级, 例如 "a//b" 和 "/a"
+func ValidateFilter(filter string) error {
+	if filter == "" || len(filter) > 65535 || strings.ContainsRune(filter, 0) {
+		return ErrInvalidFilter
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return ErrInvalidFilter
+		case level != "#" && level != "+" && strings.ContainsAny(level, "#+"):
+			return ErrInvalidFilter
+		}
+	}
+	return nil
+}
+
+// indexNode 订阅索引中的一个层级
+type indexNode[K comparable, V any] struct {
+	filter      string // 从根节点到该节点的完整主题过滤器
+	children    map[string]*indexNode[K, V]
+	subscribers map[K]V // 订阅了该节点的主题过滤器的订阅者以及订阅选项
+}
+
+func newIndexNode[K comparable, V any](filter string) *indexNode[K, V] {
+	return &indexNode[K, V]{filter: filter, children: make(map[string]*indexNode[K, V])}
+}
+
+// Entry 与主题名匹配的一条订阅
+type Entry[K comparable, V any] struct {
+	Filter     string // 匹配的主题过滤器
+	Subscriber K
+	Value      V // 订阅时保存的订阅选项
+}
+
+// Index 服务端全局的订阅索引, 按主题过滤器的层级组织成树, 每个节点保存订阅了对应主题过滤器的订阅者和订阅选项.
+//
+// 订阅和取消订阅的开销与主题过滤器的层级数成正比, 发布消息时只需要遍历一次树就可以找到所有匹配的订阅.
+// 同一个订阅者的多个主题过滤器匹配同一个主题名时, Match 为每个主题过滤器返回一条订阅, 由调用者合并订阅选项.
+type Index[K comparable, V any] struct {
+	mu   sync.RWMutex
+	root *indexNode[K, V]
+}
+
+func NewIndex[K comparable, V any]() *Index[K, V] {
+	return &Index[K, V]{root: newIndexNode[K, V]("")}
+}
+
+// Subscribe 保存订阅者对主题过滤器的订阅, 返回该订阅之前是否已经存在; 已存在的订阅选项被替换
+func (x *Index[K, V]) Subscribe(filter string, subscriber K, value V) (bool, error) {
+	if err := ValidateFilter(filter); err != nil {
+		return false, err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	current := x.root
+	for _, level := range strings.Split(filter, "/") {
+		next, ok := current.children[level]
+		if !ok {
+			if current == x.root {
+				next = newIndexNode[K, V](level)
+			} else {
+				next = newIndexNode[K, V](current.filter + "/" + level)
+			}
+			current.children[level] = next
+		}
+		current = next
+	}
+	if current.subscribers == nil {
+		current.subscribers = make(map[K]V)
+	}
+	_, existed := current.subscribers[subscriber]
+	current.subscribers[subscriber] = value
+	return existed, nil
+}
+
+// Unsubscribe 取消订阅者对主题过滤器的订阅, 并删除不再有订阅者的空分支; 返回订阅之前是否存在
+func (x *Index[K, V]) Unsubscribe(filter string, subscriber K) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	levels := strings.Split(filter, "/")
+	path := make([]*indexNode[K, V], 0, len(levels)+1)
+	current := x.root
+	path = append(path, current)
+	for _, level := range levels {
+		next, ok := current.children[level]
+		if !ok {
+			return false
+		}
+		current = next
+		path = append(path, current)
+	}
+	if _, ok := current.subscribers[subscriber]; !ok {
+		return false
+	}
+	delete(current.subscribers, subscriber)
+	for i := len(levels) - 1; i >= 0; i-- {
+		node := path[i+1]
+		if len(node.subscribers) > 0 || len(node.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+	return true
+}
+
+// Match 返回与主题名匹配的所有订阅
+//
+// MQTT v3.1.1: 参考章节 4.7 Topic Names and Topic Filters
+// MQTT v5.0: 参考章节 4.7 Topic Names and Topic Filters
+// - "#" 匹配当前层级及其所有子层级, 包括父层级本身, 例如 "a/#" 匹配 "a" [MQTT-4.7.1-2]
+// - "+" 匹配单个层级, 包括长度为0的层级, 例如 "+/+" 匹配 "/a"
+// - 主题名不能包含通配符 [MQTT-4.7.1-1], 空的或者包含通配符的主题名不匹配任何订阅
+// - 以 "$" 开头的主题名不能被以通配符开头的主题过滤器匹配 [MQTT-4.7.2-1]
+func (x *Index[K, V]) Match(topicName string) []Entry[K, V] {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.root.match(topicName)
+}
+
+// match 从根节点n开始查找与主题名匹配的所有订阅, Index 和 CopyOnWriteTrie 共用
+func (n *indexNode[K, V]) match(topicName string) []Entry[K, V] {
+	if topicName == "" || strings.ContainsAny(topicName, "+#") {
+		return nil
+	}
+	var entries []Entry[K, V]
+	add := func(node *indexNode[K, V]) {
+		for subscriber, value := range node.subscribers {
+			entries = append(entries, Entry[K, V]{Filter: node.filter, Subscriber: subscriber, Value: value})
+		}
+	}
+	levels := strings.Split(topicName, "/")
+	var walk func(node *indexNode[K, V], i int)
+	walk = func(node *indexNode[K, V], i int) {
+		wildcard := i > 0 || !strings.HasPrefix(topicName, "$")
+		if wildcard {
+			// "#" 同时匹配父层级, 例如 "a/#" 匹配 "a"
+			if next, ok := node.children["#"]; ok {
+				add(next)
+			}
+		}
+		if i == len(levels) {
+			add(node)
+			return
+		}
+		if wildcard {
+			if next, ok := node.children["+"]; ok {
+				walk(next, i+1)
+			}
+		}
+		if next, ok := node.children[levels[i]]; ok {
+			walk(next, i+1)
+		}
+	}
+	walk(n, 0)
+	return entries
+}
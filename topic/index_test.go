@@ -0,0 +1,124 @@
+package topic
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateFilter(t *testing.T) {
+	testCases := []struct {
+		filter string
+		valid  bool
+	}{
+		{"a/b", true},
+		{"#", true},
+		{"+", true},
+		{"a/#", true},
+		{"+/+/#", true},
+		{"a//b", true},
+		{"/a", true},
+		{"", false},
+		{"a/#/b", false},
+		{"a#", false},
+		{"a/b+", false},
+		{"a/+b/c", false},
+		{"a\x00b", false},
+		{strings.Repeat("a", 65536), false},
+	}
+	for _, tc := range testCases {
+		if err := ValidateFilter(tc.filter); (err == nil) != tc.valid {
+			t.Errorf("ValidateFilter(%.20q) = %v, want valid=%v", tc.filter, err, tc.valid)
+		}
+	}
+}
+
+// subscribers 返回订阅的订阅者, 按字典序排列
+func subscribers[V any](entries []Entry[string, V]) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Subscriber)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestIndexMatch(t *testing.T) {
+	index := NewIndex[string, int]()
+	for _, sub := range [][2]string{
+		{"a/b", "exact"},
+		{"a/+", "plus"},
+		{"a/#", "hash"},
+		{"#", "all"},
+		{"+/b", "first"},
+		{"$SYS/#", "sys"},
+	} {
+		if _, err := index.Subscribe(sub[0], sub[1], 0); err != nil {
+			t.Fatalf("Subscribe(%q): %v", sub[0], err)
+		}
+	}
+	testCases := []struct {
+		topicName string
+		want      []string
+	}{
+		{"a/b", []string{"all", "exact", "first", "hash", "plus"}},
+		{"a", []string{"all", "hash"}}, // "a/#" 同时匹配父层级
+		{"a/c/d", []string{"all", "hash"}},
+		{"x/b", []string{"all", "first"}},
+		{"$SYS/uptime", []string{"sys"}}, // 以 "$" 开头的主题名不匹配以通配符开头的主题过滤器
+	}
+	for _, tc := range testCases {
+		if got := subscribers(index.Match(tc.topicName)); !slices.Equal(got, tc.want) {
+			t.Errorf("Match(%q) = %v, want %v", tc.topicName, got, tc.want)
+		}
+	}
+}
+
+func TestIndexMatchEntries(t *testing.T) {
+	index := NewIndex[string, int]()
+	_, _ = index.Subscribe("a/+", "c1", 1)
+	_, _ = index.Subscribe("a/#", "c1", 2)
+	_, _ = index.Subscribe("a/b", "c1", 0)
+	// 同一个订阅者的每个匹配的主题过滤器各返回一条订阅, 包含各自的订阅选项
+	got := make(map[string]int)
+	for _, e := range index.Match("a/b") {
+		got[e.Filter] = e.Value
+	}
+	if want := map[string]int{"a/+": 1, "a/#": 2, "a/b": 0}; !maps.Equal(got, want) {
+		t.Errorf("Match = %v, want %v", got, want)
+	}
+
+	// 重复订阅替换订阅选项
+	if existed, _ := index.Subscribe("a/+", "c1", 3); !existed {
+		t.Error("Subscribe should report the existing subscription")
+	}
+	for _, e := range index.Match("a/x") {
+		if e.Filter == "a/+" && e.Value != 3 {
+			t.Errorf("a/+ value = %d, want 3", e.Value)
+		}
+	}
+}
+
+func TestIndexUnsubscribe(t *testing.T) {
+	index := NewIndex[string, struct{}]()
+	_, _ = index.Subscribe("a/b/c", "c1", struct{}{})
+	_, _ = index.Subscribe("a/b/c", "c2", struct{}{})
+
+	if index.Unsubscribe("a/b", "c1") {
+		t.Error("Unsubscribe of a missing filter should return false")
+	}
+	if !index.Unsubscribe("a/b/c", "c1") {
+		t.Error("Unsubscribe should return true for an existing subscription")
+	}
+	if got := subscribers(index.Match("a/b/c")); !slices.Equal(got, []string{"c2"}) {
+		t.Errorf("Match = %v, want [c2]", got)
+	}
+	if !index.Unsubscribe("a/b/c", "c2") {
+		t.Error("Unsubscribe should return true for an existing subscription")
+	}
+	// 没有订阅者的分支被删除
+	if len(index.root.children) != 0 {
+		t.Errorf("empty branches should be pruned, got %v", index.root.children)
+	}
+}
@@ -3,131 +3,97 @@ package topic
 import (
 	"fmt"
 	"io"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
 )
 
-type node struct {
-	path string // 路由过滤器的部分
-	// pattern string //
-	m    sync.RWMutex
-	next map[string]*node
+// MemoryTrie 主题过滤器树, 保存订阅的主题过滤器并查找与主题名匹配的主题过滤器.
+// 匹配规则与 Index 相同, 同一个主题过滤器可以订阅多次, 按引用计数取消订阅
+type MemoryTrie struct {
+	index *Index[struct{}, struct{}]
+	mu    sync.Mutex     // 串行化订阅和取消订阅
+	refs  map[string]int // 主题过滤器的订阅次数
 }
 
-func (n *node) print(m int, w io.Writer) {
-	paths := n.paths()
-	fmt.Fprintf(w, "%spath=%s, next=%#v\n", strings.Repeat("\t", m), n.path, paths)
-	for _, path := range paths {
-		n.next[path].print(m+1, w)
-	}
+func NewMemoryTrie() *MemoryTrie {
+	return &MemoryTrie{index: NewIndex[struct{}, struct{}](), refs: make(map[string]int)}
 }
 
-func newNode(path string) *node {
-	return &node{path: path, next: make(map[string]*node)}
+// Print 按层级打印主题过滤器树
+func (m *MemoryTrie) Print(w io.Writer) {
+	m.index.mu.RLock()
+	defer m.index.mu.RUnlock()
+	m.index.root.print("", 0, w)
 }
 
-// Add node
-func (n *node) add(path string) error {
-	if path == "" {
-		return fmt.Errorf("path is empty")
-	}
-	n.m.Lock()
-	defer n.m.Unlock()
-	current := n
-	for _, subPath := range strings.Split(path, "/") {
-		if _, ok := current.next[subPath]; !ok {
-			current.next[subPath] = newNode(subPath)
-		}
-		current = current.next[subPath]
+func (n *indexNode[K, V]) print(path string, depth int, w io.Writer) {
+	paths := slices.Sorted(maps.Keys(n.children))
+	fmt.Fprintf(w, "%spath=%s, next=%#v\n", strings.Repeat("\t", depth), path, paths)
+	for _, next := range paths {
+		n.children[next].print(next, depth+1, w)
 	}
-	return nil
 }
 
-func (n *node) remove(path string) error {
-	if path == "" {
-		return fmt.Errorf("path is empty")
-	}
-	if _, ok := n.find(path); !ok { // 如果不是订阅的主题不允许删除!
-		return fmt.Errorf("topic not found")
-	}
-
-	current := n
-	for _, subPath := range strings.Split(path, "/") {
-		if next, ok := current.get(subPath); ok {
-
-			if len(next.next) == 0 {
-				current.m.Lock()
-				delete(current.next, subPath)
-				current.m.Unlock()
-			}
-			current = next
-		}
+// Subscribe 订阅, 不符合协议规则的主题过滤器返回 ErrInvalidFilter.
+// 同一个主题过滤器可以订阅多次, 需要相同次数的 Unsubscribe 才能删除
+func (m *MemoryTrie) Subscribe(topicFilter string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.index.Subscribe(topicFilter, struct{}{}, struct{}{}); err != nil {
+		return fmt.Errorf("%w: %q", err, topicFilter)
 	}
+	m.refs[topicFilter]++
 	return nil
 }
 
-func (n *node) get(path string) (*node, bool) {
-	n.m.RLock()
-	defer n.m.RUnlock()
-	next, ok := n.next[path]
-	return next, ok
-}
-
-func (n *node) find(path string) ([]string, bool) {
-	current := n
-	var subs []string
-	for _, p := range strings.Split(path, "/") {
-		if next, ok := current.get("#"); ok {
-			subs = append(subs, next.path)
-			return subs, true
-		}
-		next, ok := current.get(p)
-		if !ok {
-			if next, ok = current.get("+"); !ok {
-				return subs, false
-			}
-		}
-		subs = append(subs, next.path)
-		current = next
+// Unsubscribe 取消一次订阅, 返回订阅之前是否存在; 最后一次订阅取消后删除不再有订阅的空分支
+func (m *MemoryTrie) Unsubscribe(topicFilter string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	refs, ok := m.refs[topicFilter]
+	if !ok {
+		return false
 	}
-	return subs, true
-}
-
-func (n *node) paths() []string {
-	var v []string
-	for k := range n.next {
-		v = append(v, k)
+	if refs > 1 {
+		m.refs[topicFilter] = refs - 1
+		return true
 	}
-	return v
-}
-
-func (n *node) Print(w io.Writer) {
-	n.print(0, w)
+	delete(m.refs, topicFilter)
+	return m.index.Unsubscribe(topicFilter, struct{}{})
 }
 
-type MemoryTrie struct {
-	root *node // 主题过滤树
-}
-
-func NewMemoryTrie() *MemoryTrie {
-	return &MemoryTrie{
-		root: newNode(""),
+// Find 返回与主题名匹配的所有主题过滤器, 没有匹配时返回false; 匹配规则见 Index.Match
+func (m *MemoryTrie) Find(topicName string) ([]string, bool) {
+	var filters []string
+	for _, e := range m.index.Match(topicName) {
+		filters = append(filters, e.Filter)
 	}
+	return filters, len(filters) > 0
 }
 
-func (m *MemoryTrie) Print(w io.Writer) {
-	m.root.Print(w)
-}
-
-// Subscribe 订阅
-func (m *MemoryTrie) Subscribe(topicName string) error {
-	return m.root.add(topicName)
-}
-
-func (m *MemoryTrie) Unsubscribe(topicName string) {
-	m.root.remove(topicName)
-}
-
-func (m *MemoryTrie) Find(topicName string) ([]string, bool) {
-	return m.root.find(topicName)
+// Match 判断主题名是否与主题过滤器匹配
+//
+// MQTT v3.1.1: 参考章节 4.7 Topic Names and Topic Filters
+// MQTT v5.0: 参考章节 4.7 Topic Names and Topic Filters
+// - '+' 匹配单个层级, '#' 匹配当前层级及其所有子层级(包括父层级本身, 例如 "a/#" 匹配 "a")
+// - 以 '$' 开头的主题名不能被以通配符开头的主题过滤器匹配 [MQTT-4.7.2-1]
+func Match(filter, topicName string) bool {
+	if strings.HasPrefix(topicName, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filters, names := strings.Split(filter, "/"), strings.Split(topicName, "/")
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i >= len(names) {
+			return false
+		}
+		if f != "+" && f != names[i] {
+			return false
+		}
+	}
+	return len(filters) == len(names)
 }
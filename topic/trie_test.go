@@ -1,20 +1,189 @@
 package topic
 
 import (
+	"errors"
+	"slices"
+	"strings"
 	"testing"
 )
 
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topicName string
+		want              bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"#", "a/b/c", true},
+		{"+/+", "/a", true},
+		{"+", "/a", false},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.filter, tt.topicName); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.filter, tt.topicName, got, tt.want)
+		}
+	}
+}
+
+func TestTrieWildcards(t *testing.T) {
+	for _, impl := range tries {
+		t.Run(impl.name, func(t *testing.T) {
+			trie := impl.new()
+			for _, filter := range []string{"test/+/data", "sensor/#", "home/+/+/temperature"} {
+				_, _ = trie.Subscribe(filter, "c1", 0)
+			}
+			tests := []struct {
+				topicName string
+				match     bool
+			}{
+				{"test/device1/data", true},
+				{"test/device1/sensor/data", false}, // "+" 只匹配单个层级
+				{"sensor/s1/temperature", true},
+				{"sensor", true},
+				{"home/living/room/temperature", true},
+				{"home/living/temperature", false},
+			}
+			for _, tt := range tests {
+				if got := len(trie.Match(tt.topicName)) > 0; got != tt.match {
+					t.Errorf("Match(%q) matched=%v, want %v", tt.topicName, got, tt.match)
+				}
+			}
+		})
+	}
+}
+
+func TestTrieMatchFilters(t *testing.T) {
+	for _, impl := range tries {
+		t.Run(impl.name, func(t *testing.T) {
+			trie := impl.new()
+			for _, filter := range []string{"a/b", "a/+", "a/#", "#", "+/+", "a//b", "$SYS/#", "a/b/c"} {
+				if _, err := trie.Subscribe(filter, "c1", 0); err != nil {
+					t.Fatalf("Subscribe(%q): %v", filter, err)
+				}
+			}
+			tests := []struct {
+				topicName string
+				want      []string
+			}{
+				{"a/b", []string{"#", "+/+", "a/#", "a/+", "a/b"}},
+				{"a", []string{"#", "a/#"}}, // "a/#" 匹配父层级
+				{"a//b", []string{"#", "a/#", "a//b"}},
+				{"/a", []string{"#", "+/+"}},
+				{"$SYS/uptime", []string{"$SYS/#"}}, // 通配符开头的主题过滤器不匹配 "$" 开头的主题名
+				{"a/+", nil},                        // 主题名不能包含通配符
+				{"", nil},
+			}
+			for _, tt := range tests {
+				if got := filters(trie.Match(tt.topicName)); !slices.Equal(got, tt.want) {
+					t.Errorf("Match(%q) = %v, want %v", tt.topicName, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTrieSubscribeInvalid(t *testing.T) {
+	for _, impl := range tries {
+		t.Run(impl.name, func(t *testing.T) {
+			trie := impl.new()
+			for _, filter := range []string{"", "a/#/b", "a+", "a/b#", "#/a"} {
+				if _, err := trie.Subscribe(filter, "c1", 0); !errors.Is(err, ErrInvalidFilter) {
+					t.Errorf("Subscribe(%q) = %v, want ErrInvalidFilter", filter, err)
+				}
+			}
+			// 只存在于路径中间的层级不是订阅的主题过滤器
+			_, _ = trie.Subscribe("a/b/c", "c1", 0)
+			if got := trie.Match("a/b"); len(got) != 0 {
+				t.Errorf("Match(a/b) = %v, a/b is not subscribed", got)
+			}
+		})
+	}
+}
+
+func TestTrieUnsubscribeRefCount(t *testing.T) {
+	for _, impl := range tries {
+		t.Run(impl.name, func(t *testing.T) {
+			trie := impl.new()
+			_, _ = trie.Subscribe("a/b", "c1", 0)
+			_, _ = trie.Subscribe("a/b", "c2", 0)
+			_, _ = trie.Subscribe("a/b/c", "c1", 0)
+
+			// 订阅过的主题过滤器的前缀没有被订阅
+			if trie.Unsubscribe("a", "c1") {
+				t.Error("Unsubscribe(a) should report no subscription")
+			}
+			// 每个订阅者的订阅各自取消
+			if !trie.Unsubscribe("a/b", "c1") {
+				t.Error("Unsubscribe(a/b, c1) should report the subscription")
+			}
+			if got := subscribers(trie.Match("a/b")); !slices.Equal(got, []string{"c2"}) {
+				t.Errorf("Match(a/b) = %v, want [c2]", got)
+			}
+			if trie.Unsubscribe("a/b", "c1") {
+				t.Error("Unsubscribe(a/b, c1) twice should report no subscription")
+			}
+			if !trie.Unsubscribe("a/b", "c2") {
+				t.Error("Unsubscribe(a/b, c2) should report the subscription")
+			}
+			if got := trie.Match("a/b"); len(got) != 0 {
+				t.Errorf("Match(a/b) = %v, want none after unsubscribe", got)
+			}
+			// 中间层级的订阅取消后, 子层级的订阅不受影响
+			if got := filters(trie.Match("a/b/c")); !slices.Equal(got, []string{"a/b/c"}) {
+				t.Errorf("Match(a/b/c) = %v, want [a/b/c]", got)
+			}
+			if !trie.Unsubscribe("a/b/c", "c1") {
+				t.Error("Unsubscribe(a/b/c) should report the subscription")
+			}
+		})
+	}
+}
+
+// TestTrieConsistentWithMatch 订阅索引与 Match 的匹配规则一致
+func TestTrieConsistentWithMatch(t *testing.T) {
+	allFilters := []string{"#", "+", "+/+", "+/#", "a", "a/#", "a/+", "a/b", "a/+/c", "a//b", "/a", "/+", "$SYS/#", "$SYS/+", "+/uptime"}
+	topicNames := []string{"a", "a/b", "a/b/c", "a/x/c", "a//b", "/a", "/", "b", "$SYS", "$SYS/uptime", "x/uptime"}
+	for _, impl := range tries {
+		t.Run(impl.name, func(t *testing.T) {
+			trie := impl.new()
+			for _, filter := range allFilters {
+				_, _ = trie.Subscribe(filter, "c1", 0)
+			}
+			for _, topicName := range topicNames {
+				var want []string
+				for _, filter := range allFilters {
+					if Match(filter, topicName) {
+						want = append(want, filter)
+					}
+				}
+				slices.Sort(want)
+				if got := filters(trie.Match(topicName)); !slices.Equal(got, want) {
+					t.Errorf("Match(%q) = %v, Match rules give %v", topicName, got, want)
+				}
+			}
+		})
+	}
+}
+
 func TestNewMemoryTrie(t *testing.T) {
 	trie := NewMemoryTrie()
 	if trie == nil {
 		t.Fatal("NewMemoryTrie() should return a non-nil trie")
 	}
-	if trie.root == nil {
-		t.Fatal("trie root should not be nil")
+	if trie.index == nil {
+		t.Fatal("trie index should not be nil")
 	}
 }
 
-func TestTrieSubscribe(t *testing.T) {
+func TestMemoryTrieSubscribe(t *testing.T) {
 	trie := NewMemoryTrie()
 
 	// Test basic subscription
@@ -28,7 +197,7 @@ func TestTrieSubscribe(t *testing.T) {
 	}
 }
 
-func TestTrieUnsubscribe(t *testing.T) {
+func TestMemoryTrieUnsubscribe(t *testing.T) {
 	trie := NewMemoryTrie()
 
 	// Subscribe first
@@ -44,7 +213,7 @@ func TestTrieUnsubscribe(t *testing.T) {
 	}
 }
 
-func TestTrieWildcardPlus(t *testing.T) {
+func TestMemoryTrieWildcardPlus(t *testing.T) {
 	trie := NewMemoryTrie()
 
 	// Subscribe with + wildcard
@@ -63,7 +232,7 @@ func TestTrieWildcardPlus(t *testing.T) {
 	}
 }
 
-func TestTrieWildcardHash(t *testing.T) {
+func TestMemoryTrieWildcardHash(t *testing.T) {
 	trie := NewMemoryTrie()
 
 	// Subscribe with # wildcard
@@ -81,7 +250,7 @@ func TestTrieWildcardHash(t *testing.T) {
 	}
 }
 
-func TestTrieMultipleSubscriptions(t *testing.T) {
+func TestMemoryTrieMultipleSubscriptions(t *testing.T) {
 	trie := NewMemoryTrie()
 
 	// Subscribe to multiple topics
@@ -96,8 +265,8 @@ func TestTrieMultipleSubscriptions(t *testing.T) {
 		trie.Subscribe(topic)
 	}
 
-	// Test that all subscriptions work
-	for _, topic := range topics {
+	// Test that all subscriptions work, 主题名不能包含通配符
+	for _, topic := range []string{"test/topic1", "test/topic2", "device/d1/status", "sensor/s1/temperature"} {
 		_, ok := trie.Find(topic)
 		if !ok {
 			t.Errorf("should find subscribed topic: %s", topic)
@@ -105,7 +274,7 @@ func TestTrieMultipleSubscriptions(t *testing.T) {
 	}
 }
 
-func TestTrieUnsubscribeNonExistent(t *testing.T) {
+func TestMemoryTrieUnsubscribeNonExistent(t *testing.T) {
 	trie := NewMemoryTrie()
 
 	// Try to unsubscribe from non-existent topic
@@ -118,7 +287,7 @@ func TestTrieUnsubscribeNonExistent(t *testing.T) {
 	}
 }
 
-func TestTrieComplexWildcards(t *testing.T) {
+func TestMemoryTrieComplexWildcards(t *testing.T) {
 	trie := NewMemoryTrie()
 
 	// Subscribe with complex wildcard pattern
@@ -136,113 +305,108 @@ func TestTrieComplexWildcards(t *testing.T) {
 	// This test documents the current behavior
 }
 
-func TestTrieRootSubscription(t *testing.T) {
+func TestMemoryTrieRootSubscription(t *testing.T) {
 	trie := NewMemoryTrie()
 
-	// Subscribe to root - this should work as root path is valid
-	err := trie.Subscribe("")
-	if err != nil {
-		t.Errorf("should allow root path subscription, got error: %v", err)
+	// 主题过滤器至少包含一个字符 [MQTT-4.7.3-1]
+	if err := trie.Subscribe(""); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("empty topic filter should be rejected, got error: %v", err)
 	}
-
-	// Verify subscription was added - just check that no error occurred
-	// The actual verification would depend on the MemoryTrie implementation
-	t.Log("Root subscription test completed successfully")
 }
 
-func TestTrieNodeAdd(t *testing.T) {
-	node := newNode("test")
-	if node.path != "test" {
-		t.Errorf("expected path 'test', got %s", node.path)
+func TestMemoryTrieFind(t *testing.T) {
+	trie := NewMemoryTrie()
+	for _, filter := range []string{"a/b", "a/+", "a/#", "#", "+/+", "a//b", "$SYS/#", "a/b/c"} {
+		if err := trie.Subscribe(filter); err != nil {
+			t.Fatalf("Subscribe(%q): %v", filter, err)
+		}
 	}
-	if node.next == nil {
-		t.Error("next map should be initialized")
+	tests := []struct {
+		topicName string
+		want      []string
+	}{
+		{"a/b", []string{"#", "+/+", "a/#", "a/+", "a/b"}},
+		{"a", []string{"#", "a/#"}}, // "a/#" 匹配父层级
+		{"a//b", []string{"#", "a/#", "a//b"}},
+		{"/a", []string{"#", "+/+"}},
+		{"$SYS/uptime", []string{"$SYS/#"}}, // 通配符开头的主题过滤器不匹配 "$" 开头的主题名
+		{"a/+", nil},                        // 主题名不能包含通配符
+		{"", nil},
 	}
-}
-
-func TestTrieNodeAddEmptyPath(t *testing.T) {
-	node := newNode("")
-
-	// Adding empty path should work (root node)
-	err := node.add("")
-	if err != nil {
-		t.Errorf("should allow empty path, got error: %v", err)
+	for _, tt := range tests {
+		got, ok := trie.Find(tt.topicName)
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) || ok != (len(tt.want) > 0) {
+			t.Errorf("Find(%q) = %v, %v, want %v", tt.topicName, got, ok, tt.want)
+		}
 	}
-
-	// Verify empty path was added - just check that no error occurred
-	t.Log("Empty path test completed successfully")
 }
 
-func TestTrieNodeRemove(t *testing.T) {
-	node := newNode("")
-
-	// Add a path first
-	node.add("test/topic")
-
-	// Remove it
-	node.remove("test/topic")
-
-	// Try to find it
-	_, ok := node.find("test/topic")
-	if ok {
-		t.Error("should not find removed path")
+func TestMemoryTrieSubscribeInvalid(t *testing.T) {
+	trie := NewMemoryTrie()
+	for _, filter := range []string{"a/#/b", "a+", "a/b#", "#/a"} {
+		if err := trie.Subscribe(filter); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("Subscribe(%q) = %v, want ErrInvalidFilter", filter, err)
+		}
 	}
-}
-
-func TestTrieNodeRemoveNonExistent(t *testing.T) {
-	node := newNode("")
-
-	// Try to remove non-existent path
-	node.remove("non/existent")
-
-	// Should not cause any issues
-	_, ok := node.find("non/existent")
-	if ok {
-		t.Error("should not find non-existent path")
+	// 只存在于路径中间的层级不是订阅的主题过滤器
+	_ = trie.Subscribe("a/b/c")
+	if got, ok := trie.Find("a/b"); ok {
+		t.Errorf("Find(a/b) = %v, a/b is not subscribed", got)
 	}
 }
 
-func TestTrieNodeGet(t *testing.T) {
-	node := newNode("")
-	node.add("test")
+func TestMemoryTrieUnsubscribeRefCount(t *testing.T) {
+	trie := NewMemoryTrie()
+	_ = trie.Subscribe("a/b")
+	_ = trie.Subscribe("a/b")
+	_ = trie.Subscribe("a/b/c")
 
-	next, ok := node.get("test")
-	if !ok {
-		t.Error("should get existing node")
+	// 订阅过的主题过滤器的前缀没有被订阅
+	if trie.Unsubscribe("a") {
+		t.Error("Unsubscribe(a) should report no subscription")
 	}
-	if next.path != "test" {
-		t.Errorf("expected path 'test', got %s", next.path)
+	// 订阅两次需要取消两次
+	if !trie.Unsubscribe("a/b") {
+		t.Error("Unsubscribe(a/b) should report the subscription")
 	}
-
-	// Test non-existent node
-	_, ok = node.get("non-existent")
-	if ok {
-		t.Error("should not get non-existent node")
+	if _, ok := trie.Find("a/b"); !ok {
+		t.Error("a/b is subscribed twice and should still match")
 	}
-}
-
-func TestTrieNodePaths(t *testing.T) {
-	node := newNode("")
-	node.add("test1")
-	node.add("test2")
-
-	paths := node.paths()
-	if len(paths) != 2 {
-		t.Errorf("expected 2 paths, got %d", len(paths))
+	if !trie.Unsubscribe("a/b") {
+		t.Error("Unsubscribe(a/b) should report the subscription")
+	}
+	if trie.Unsubscribe("a/b") {
+		t.Error("Unsubscribe(a/b) a third time should report no subscription")
+	}
+	if _, ok := trie.Find("a/b"); ok {
+		t.Error("a/b should not match after unsubscribe")
+	}
+	// 中间层级的订阅取消后, 子层级的订阅不受影响
+	if filters, ok := trie.Find("a/b/c"); !ok || !slices.Equal(filters, []string{"a/b/c"}) {
+		t.Errorf("Find(a/b/c) = %v, want [a/b/c]", filters)
 	}
 
-	// Check that both paths are present
-	found1, found2 := false, false
-	for _, path := range paths {
-		if path == "test1" {
-			found1 = true
-		}
-		if path == "test2" {
-			found2 = true
-		}
+	// 最后一个订阅取消后, 空分支被删除
+	if !trie.Unsubscribe("a/b/c") {
+		t.Error("Unsubscribe(a/b/c) should report the subscription")
 	}
+	if n := len(trie.index.root.children); n != 0 {
+		t.Errorf("root has %d children, empty branches should be pruned", n)
+	}
+}
 
-	if !found1 || !found2 {
-		t.Error("should find both added paths")
+func TestMemoryTriePrint(t *testing.T) {
+	trie := NewMemoryTrie()
+	_ = trie.Subscribe("a/b")
+	_ = trie.Subscribe("a/+")
+	var buf strings.Builder
+	trie.Print(&buf)
+	want := "path=, next=[]string{\"a\"}\n" +
+		"\tpath=a, next=[]string{\"+\", \"b\"}\n" +
+		"\t\tpath=+, next=[]string(nil)\n" +
+		"\t\tpath=b, next=[]string(nil)\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Print() = %q, want %q", got, want)
 	}
 }
@@ -0,0 +1,108 @@
+package mqtt
+
+import (
+	"log"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+// willMessage 根据CONNECT报文构建遗嘱消息和遗嘱延时间隔, 没有遗嘱时返回nil
+//
+// MQTT v3.1.1: 参考章节 3.1.2.5 Will Flag
+// MQTT v5.0: 参考章节 3.1.2.5 Will Flag, 3.1.3.2 Will Properties
+// - 遗嘱消息使用CONNECT中的遗嘱QoS和遗嘱保留标志发布 [MQTT-3.1.2-14] [MQTT-3.1.2-17]
+// - 遗嘱属性中的载荷格式指示, 消息过期间隔, 内容类型, 响应主题, 对比数据和用户属性在发布遗嘱消息时使用,
+// 用户属性必须保持原来的顺序 [MQTT-3.1.3-10]
+func willMessage(connect *packet.CONNECT) (*packet.PUBLISH, uint32) {
+	if !connect.ConnectFlags.WillFlag() {
+		return nil, 0
+	}
+	retain := uint8(0)
+	if connect.ConnectFlags.WillRetain() {
+		retain = 1
+	}
+	will := &packet.PUBLISH{
+		FixedHeader: &packet.FixedHeader{Kind: PUBLISH, QoS: connect.ConnectFlags.WillQoS(), Retain: retain},
+		Message:     &packet.Message{TopicName: connect.WillTopic, Content: connect.WillPayload},
+	}
+	props := connect.WillProperties
+	if connect.Version != packet.VERSION500 || props == nil {
+		return will, 0
+	}
+	will.Props = &packet.PublishProperties{
+		PayloadFormatIndicator: props.PayloadFormatIndicator,
+		MessageExpiryInterval:  props.MessageExpiryInterval,
+		ContentType:            props.ContentType,
+		ResponseTopic:          props.ResponseTopic,
+		CorrelationData:        props.CorrelationData,
+		UserProperty:           props.UserProperty,
+	}
+	return will, props.WillDelayInterval.Uint32()
+}
+
+// scheduleWill 网络连接关闭后发布或者延迟发布遗嘱消息
+//
+// MQTT v5.0: 参考章节 3.1.3.2.2 Will Delay Interval
+// - 服务端在遗嘱延时间隔到期或者会话结束时发布遗嘱消息, 取决于两者谁先发生
+// - 遗嘱延时间隔到期之前会话创建了新的网络连接时, 服务端不能发送遗嘱消息 [MQTT-3.1.3-9]
+func (s *Server) scheduleWill(c *conn) {
+	will, delay := c.will, c.willDelay
+	if will == nil || !c.authorize(AccessPublish, will.Message.TopicName) {
+		return
+	}
+	m := s.sessions
+	m.mu.Lock()
+	sess := c.session
+	switch {
+	case delay == 0 || m.maps[c.ID] != sess: // 不延时, 或者会话已经结束
+	case sess.conn != nil: // 会话已经被新的网络连接恢复
+		m.mu.Unlock()
+		log.Printf("will cancelled: clientId=%s, topic=%s", c.ID, will.Message.TopicName)
+		return
+	default:
+		if sess.expiryInterval != SessionExpiryNever {
+			delay = min(delay, sess.expiryInterval)
+		}
+		sess.will = will
+		sess.willTimer = time.AfterFunc(time.Duration(delay)*time.Second, func() {
+			if will := m.takeWill(sess); will != nil {
+				_ = s.publishFrom(sess.clientID, will)
+			}
+		})
+		m.mu.Unlock()
+		log.Printf("will delayed: clientId=%s, topic=%s, delay=%d", c.ID, will.Message.TopicName, delay)
+		return
+	}
+	m.mu.Unlock()
+	_ = s.publishFrom(c.ID, will)
+}
+
+// takeWill 取出会话中等待发布的遗嘱消息并停止定时器, 没有时返回nil
+func (m *sessions) takeWill(sess *session) *packet.PUBLISH {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	will := sess.will
+	if sess.willTimer != nil {
+		sess.willTimer.Stop()
+	}
+	sess.will, sess.willTimer = nil, nil
+	return will
+}
+
+// resumeWill 客户端重新连接时处理会话中等待发布的遗嘱消息: 恢复会话时取消遗嘱 [MQTT-3.1.3-9];
+// 开始新会话时旧的会话结束, 返回需要立即发布的遗嘱消息
+func (m *sessions) resumeWill(clientID string, cleanStart bool) *packet.PUBLISH {
+	m.mu.Lock()
+	sess, ok := m.maps[clientID]
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	will := m.takeWill(sess)
+	if will != nil && !cleanStart {
+		log.Printf("will cancelled: clientId=%s, topic=%s", clientID, will.Message.TopicName)
+		return nil
+	}
+	return will
+}
@@ -0,0 +1,113 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-io/mqtt/packet"
+)
+
+// connectWillTestServer 建立携带遗嘱消息的v5.0连接
+func connectWillTestServer(t *testing.T, s *Server, cleanStart bool, sessionExpiry uint32, willDelay uint32) {
+	t.Helper()
+	flags := packet.ConnectFlags(0x04) // WillFlag
+	if cleanStart {
+		flags |= 0x02
+	}
+	rw, connack := connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader:    &packet.FixedHeader{Version: packet.VERSION500},
+		ConnectFlags:   flags,
+		ClientID:       "will",
+		Props:          &packet.ConnectProperties{SessionExpiryInterval: packet.SessionExpiryInterval(sessionExpiry)},
+		WillProperties: &packet.WillProperties{WillDelayInterval: packet.WillDelayInterval(willDelay)},
+		WillTopic:      "will/topic",
+		WillPayload:    []byte("gone"),
+	})
+	if connack.ReturnCode.Code != 0 {
+		t.Fatalf("ReturnCode = %v", connack.ReturnCode)
+	}
+	_ = rw.Close()
+	waitOffline(t, s, "will")
+}
+
+func TestWillMessage(t *testing.T) {
+	will, delay := willMessage(&packet.CONNECT{
+		FixedHeader:    &packet.FixedHeader{Version: packet.VERSION500},
+		ConnectFlags:   packet.ConnectFlags(0x04 | 0x08 | 0x20), // WillFlag, WillQoS=1, WillRetain
+		WillTopic:      "a/b",
+		WillPayload:    []byte("x"),
+		WillProperties: &packet.WillProperties{WillDelayInterval: 10, MessageExpiryInterval: 60, ContentType: "text/plain"},
+	})
+	if will == nil || will.QoS != 1 || will.Retain != 1 || will.Message.TopicName != "a/b" {
+		t.Fatalf("will = %v", will)
+	}
+	if delay != 10 {
+		t.Errorf("delay = %d, want 10", delay)
+	}
+	if will.Props == nil || will.Props.MessageExpiryInterval != 60 || will.Props.ContentType != "text/plain" {
+		t.Errorf("Props = %+v", will.Props)
+	}
+	if will, _ := willMessage(&packet.CONNECT{FixedHeader: &packet.FixedHeader{Version: packet.VERSION311}, WillTopic: "a/b"}); will != nil {
+		t.Error("will should be nil without WillFlag")
+	}
+}
+
+func TestWillPublishedOnClose(t *testing.T) {
+	s := NewServer(context.Background())
+	sub, _ := subscribeTestServer(t, s, "sub", packet.Subscription{TopicFilter: "will/#", MaximumQoS: 1})
+	connectWillTestServer(t, s, true, SessionExpiryNever, 0)
+
+	pub, ok := readTestPacket(t, sub, packet.VERSION311).(*packet.PUBLISH)
+	if !ok || pub.Message.TopicName != "will/topic" || string(pub.Message.Content) != "gone" {
+		t.Fatalf("expected will message, got %v", pub)
+	}
+}
+
+func TestWillDelayCancelledOnResume(t *testing.T) {
+	s := NewServer(context.Background())
+	sub, _ := subscribeTestServer(t, s, "sub", packet.Subscription{TopicFilter: "will/#"})
+	count := countTestPublish(sub, packet.VERSION311)
+	connectWillTestServer(t, s, true, SessionExpiryNever, 60)
+
+	// 遗嘱延时间隔到期之前恢复会话, 服务端不能发送遗嘱消息 [MQTT-3.1.3-9]
+	connectWillTestServer(t, s, false, SessionExpiryNever, 60)
+	if n := <-count; n != 0 {
+		t.Fatalf("received %d will messages, want 0", n)
+	}
+}
+
+func TestWillDelayCleanStart(t *testing.T) {
+	s := NewServer(context.Background())
+	sub, _ := subscribeTestServer(t, s, "sub", packet.Subscription{TopicFilter: "will/#"})
+	count := countTestPublish(sub, packet.VERSION311)
+	connectWillTestServer(t, s, true, SessionExpiryNever, 60)
+
+	// 新开始为1时旧的会话结束, 立即发布等待中的遗嘱消息
+	rw, _ := connectTestServer(t, s, &packet.CONNECT{
+		FixedHeader:  &packet.FixedHeader{Version: packet.VERSION500},
+		ConnectFlags: packet.ConnectFlags(0x02),
+		ClientID:     "will",
+		Props:        &packet.ConnectProperties{},
+	})
+	defer func() { _ = rw.Close() }()
+	if n := <-count; n != 1 {
+		t.Fatalf("received %d will messages, want 1", n)
+	}
+}
+
+func TestWillDelaySessionExpiry(t *testing.T) {
+	s := NewServer(context.Background())
+	sub, _ := subscribeTestServer(t, s, "sub", packet.Subscription{TopicFilter: "will/#"})
+	// 会话过期间隔小于遗嘱延时间隔时, 在会话结束时发布遗嘱消息
+	connectWillTestServer(t, s, true, 1, 60)
+
+	_ = sub.SetReadDeadline(time.Now().Add(3 * time.Second))
+	pub, err := packet.Unpack(packet.VERSION311, sub)
+	if err != nil {
+		t.Fatalf("expected will message at session expiry: %v", err)
+	}
+	if pub, ok := pub.(*packet.PUBLISH); !ok || pub.Message.TopicName != "will/topic" {
+		t.Fatalf("expected will message, got %v", pub)
+	}
+}